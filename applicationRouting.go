@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/davecourtois/Utility"
+)
+
+/**
+ * Return the directory of the application of a request path. The application
+ * is the first part of the path, or the index application if no directory
+ * exist with that name.
+ */
+func (globule *Globule) getApplicationDir(dir string, rqst_path string) string {
+	values := strings.Split(strings.TrimPrefix(rqst_path, "/"), "/")
+	if len(values[0]) > 0 {
+		if info, err := os.Stat(path.Join(dir, values[0])); err == nil && info.IsDir() {
+			return path.Join(dir, values[0])
+		}
+	}
+
+	if len(globule.IndexApplication) > 0 {
+		return path.Join(dir, globule.IndexApplication)
+	}
+
+	return ""
+}
+
+/**
+ * Return true if an application use client side routing.
+ */
+func (globule *Globule) isSinglePageApplication(application string) bool {
+	for i := 0; i < len(globule.SinglePageApplications); i++ {
+		if Utility.ToString(globule.SinglePageApplications[i]) == application {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Return the index.html of the application if the path is a client side
+ * route of a single page application. Path with a file extension are assets
+ * and are never routed.
+ */
+func (globule *Globule) getSinglePageApplicationIndex(dir string, rqst_path string) string {
+	if strings.Contains(path.Base(rqst_path), ".") {
+		return ""
+	}
+
+	appDir := globule.getApplicationDir(dir, rqst_path)
+	if len(appDir) == 0 || !globule.isSinglePageApplication(path.Base(appDir)) {
+		return ""
+	}
+
+	index := path.Join(appDir, "index.html")
+	if !Utility.Exists(index) {
+		return ""
+	}
+
+	return index
+}
+
+/**
+ * Answer a request with an error page. The page <code>.html is taken from the
+ * application directory or from the root directory of the host, a text
+ * message is return if none exist.
+ */
+func (globule *Globule) serveErrorPage(w http.ResponseWriter, r *http.Request, dir string, rqst_path string, code int, msg string) {
+	pages := make([]string, 0)
+	if appDir := globule.getApplicationDir(dir, rqst_path); len(appDir) > 0 {
+		pages = append(pages, path.Join(appDir, strconv.Itoa(code)+".html"))
+	}
+	pages = append(pages, path.Join(dir, strconv.Itoa(code)+".html"))
+
+	for _, page := range pages {
+		f, err := os.Open(page)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(code)
+		if r.Method != http.MethodHead {
+			io.Copy(w, f)
+		}
+		return
+	}
+
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Protect the inventory file of the certificate authority.
+var caInventoryMutex sync.Mutex
+
+/**
+ * The information keep about a certificate signed by the certificate
+ * authority.
+ */
+type IssuedCertificate struct {
+	SerialNumber string // in hexadecimal
+	Subject      string
+	DNSNames     []string
+	IPAddresses  []string
+	NotBefore    time.Time
+	NotAfter     time.Time
+	Requester    string // who ask for the certificate
+
+	// Revocation informations.
+	Revoked          bool
+	RevocationTime   time.Time
+	RevocationReason int
+}
+
+/**
+ * The certificate authority use to sign the client certificates. It use the
+ * ca.crt, ca.key and san.conf files from the creds directory. Every signed
+ * certificate is kept in the issued directory with the inventory of all
+ * certificates.
+ */
+type CertificateAuthority struct {
+	path        string // the creds directory
+	certificate *x509.Certificate
+	privateKey  crypto.Signer
+
+	// The urls where clients can validate the certificates.
+	CrlURL  string
+	OcspURL string
+}
+
+/**
+ * Load the certificate authority from the creds directory. The password is
+ * use to decrypt the ca.key file.
+ */
+func NewCertificateAuthority(path string, password string) (*CertificateAuthority, error) {
+	crtPem, err := ioutil.ReadFile(path + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	crtBlock, _ := pem.Decode(crtPem)
+	if crtBlock == nil {
+		return nil, errors.New("no certificate found in " + path + "/ca.crt")
+	}
+
+	certificate, err := x509.ParseCertificate(crtBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem, err := ioutil.ReadFile(path + "/ca.key")
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := parsePrivateKey(keyPem, password)
+	if err != nil {
+		return nil, err
+	}
+
+	Utility.CreateDirIfNotExist(path + "/issued")
+
+	return &CertificateAuthority{path: path, certificate: certificate, privateKey: privateKey}, nil
+}
+
+/**
+ * Parse a pem private key (pkcs1, pkcs8 or ec) encrypted or not.
+ */
+func parsePrivateKey(keyPem []byte, password string) (crypto.Signer, error) {
+	keyBlock, _ := pem.Decode(keyPem)
+	if keyBlock == nil {
+		return nil, errors.New("no private key found")
+	}
+
+	der := keyBlock.Bytes
+	if x509.IsEncryptedPEMBlock(keyBlock) {
+		var err error
+		der, err = x509.DecryptPEMBlock(keyBlock, []byte(password))
+		if err != nil {
+			return nil, err
+		}
+	} else if keyBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		var err error
+		der, err = decryptPKCS8PrivateKey(der, []byte(password))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	}
+
+	return nil, errors.New("unsupported private key type")
+}
+
+// The asn1 structures of an encrypted pkcs8 private key (rfc 5958 and 8018).
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+/**
+ * Decrypt a pkcs8 private key encrypted with pbes2, the format use by openssl
+ * 3 (ENCRYPTED PRIVATE KEY). Return the der of the pkcs8 private key.
+ */
+func decryptPKCS8PrivateKey(der []byte, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("unsupported private key encryption algorithm " + info.Algorithm.Algorithm.String())
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.New("unsupported key derivation function " + params.KeyDerivationFunc.Algorithm.String())
+	}
+
+	var kdfParams pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	var keyLength int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLength, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLength, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLength, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, errors.New("unsupported encryption scheme " + scheme.String())
+	}
+
+	prf := sha1.New
+	if kdfParams.PRF.Algorithm.Equal(oidHMACSHA256) {
+		prf = sha256.New
+	} else if len(kdfParams.PRF.Algorithm) > 0 && !kdfParams.PRF.Algorithm.Equal(oidHMACSHA1) {
+		return nil, errors.New("unsupported pseudo random function " + kdfParams.PRF.Algorithm.String())
+	}
+
+	key := pbkdf2.Key(password, kdfParams.Salt, kdfParams.IterationCount, keyLength, prf)
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := info.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted private key")
+	}
+
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+
+	// Remove the pkcs7 padding, every padding byte is the padding size.
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, errors.New("fail to decrypt private key, the password may be wrong")
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return nil, errors.New("fail to decrypt private key, the password may be wrong")
+		}
+	}
+
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+/**
+ * Sign a certificate request (pem) and return the certificate (pem). The
+ * certificate is valid for the given number of days and it extensions are
+ * taken from the v3_req section of san.conf. The alternate names of the
+ * request are added if they respect the policy (nil policy accept all). If an
+ * audit record is given it's completed and written in the audit log.
+ */
+func (ca *CertificateAuthority) SignCertificateRequest(csrPem []byte, days int, policy *CertificatePolicy, audit *CertificateAudit) (crt []byte, err error) {
+	if audit != nil {
+		defer func() {
+			if err != nil {
+				audit.Error = err.Error()
+			}
+			if err_ := ca.writeAudit(audit); err_ != nil {
+				log.Println("fail to write certificate audit with error ", err_)
+			}
+		}()
+	}
+
+	csrBlock, _ := pem.Decode(csrPem)
+	if csrBlock == nil {
+		return nil, errors.New("no certificate request found")
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if audit != nil {
+		audit.Subject = csr.Subject.String()
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	if policy != nil {
+		err = policy.Validate(csr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	extensions, err := parseSanConfiguration(ca.path+"/san.conf", "v3_req")
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the names ask in the request.
+	for _, name := range csr.DNSNames {
+		if !Utility.Contains(extensions.DNSNames, name) {
+			extensions.DNSNames = append(extensions.DNSNames, name)
+		}
+	}
+
+	for _, ip := range csr.IPAddresses {
+		exist := false
+		for _, ip_ := range extensions.IPAddresses {
+			exist = exist || ip.Equal(ip_)
+		}
+		if !exist {
+			extensions.IPAddresses = append(extensions.IPAddresses, ip)
+		}
+	}
+
+	// Every certificate has it own serial number.
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               csr.Subject,
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		KeyUsage:              extensions.KeyUsage,
+		ExtKeyUsage:           extensions.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              extensions.DNSNames,
+		IPAddresses:           extensions.IPAddresses,
+		EmailAddresses:        extensions.EmailAddresses,
+	}
+
+	if len(ca.CrlURL) > 0 {
+		template.CRLDistributionPoints = []string{ca.CrlURL}
+	}
+
+	if len(ca.OcspURL) > 0 {
+		template.OCSPServer = []string{ca.OcspURL}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, csr.PublicKey, ca.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	crt = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	// Keep the certificate in the inventory.
+	requester := ""
+	if audit != nil {
+		requester = audit.Requester
+		audit.SerialNumber = certificate.SerialNumber.Text(16)
+		audit.DNSNames = certificate.DNSNames
+		for _, ip := range certificate.IPAddresses {
+			audit.IPAddresses = append(audit.IPAddresses, ip.String())
+		}
+	}
+
+	err = ca.addIssuedCertificate(certificate, crt, requester)
+	if err != nil {
+		return nil, err
+	}
+
+	return crt, nil
+}
+
+func (ca *CertificateAuthority) getInventoryPath() string {
+	return ca.path + "/issued/inventory.json"
+}
+
+/**
+ * Read the inventory of issued certificates.
+ */
+func (ca *CertificateAuthority) readInventory() ([]*IssuedCertificate, error) {
+	certificates := make([]*IssuedCertificate, 0)
+	data, err := ioutil.ReadFile(ca.getInventoryPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return certificates, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &certificates)
+	if err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
+
+/**
+ * Write the inventory, the file is replace only when it's completely written.
+ */
+func (ca *CertificateAuthority) writeInventory(certificates []*IssuedCertificate) error {
+	data, err := json.MarshalIndent(certificates, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := ca.getInventoryPath() + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ca.getInventoryPath())
+}
+
+func (ca *CertificateAuthority) addIssuedCertificate(certificate *x509.Certificate, crt []byte, requester string) error {
+	caInventoryMutex.Lock()
+	defer caInventoryMutex.Unlock()
+
+	serialNumber := certificate.SerialNumber.Text(16)
+	err := ioutil.WriteFile(ca.path+"/issued/"+serialNumber+".crt", crt, 0644)
+	if err != nil {
+		return err
+	}
+
+	certificates, err := ca.readInventory()
+	if err != nil {
+		return err
+	}
+
+	issued := &IssuedCertificate{
+		SerialNumber: serialNumber,
+		Subject:      certificate.Subject.String(),
+		DNSNames:     certificate.DNSNames,
+		IPAddresses:  make([]string, 0),
+		NotBefore:    certificate.NotBefore,
+		NotAfter:     certificate.NotAfter,
+		Requester:    requester,
+	}
+
+	for _, ip := range certificate.IPAddresses {
+		issued.IPAddresses = append(issued.IPAddresses, ip.String())
+	}
+
+	return ca.writeInventory(append(certificates, issued))
+}
+
+/**
+ * Return the list of certificates issued by the certificate authority, the
+ * newest first.
+ */
+func (ca *CertificateAuthority) GetIssuedCertificates() ([]*IssuedCertificate, error) {
+	caInventoryMutex.Lock()
+	defer caInventoryMutex.Unlock()
+
+	certificates, err := ca.readInventory()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(certificates, func(i, j int) bool {
+		return certificates[i].NotBefore.After(certificates[j].NotBefore)
+	})
+
+	return certificates, nil
+}
+
+/**
+ * Return an issued certificate (pem) from it serial number.
+ */
+func (ca *CertificateAuthority) GetIssuedCertificate(serialNumber string) ([]byte, error) {
+	serial, ok := new(big.Int).SetString(serialNumber, 16)
+	if !ok {
+		return nil, errors.New("invalid serial number " + serialNumber)
+	}
+
+	return ioutil.ReadFile(ca.path + "/issued/" + serial.Text(16) + ".crt")
+}
+
+/**
+ * The certificate extensions found in an openssl configuration file.
+ */
+type sanExtensions struct {
+	DNSNames       []string
+	IPAddresses    []net.IP
+	EmailAddresses []string
+	KeyUsage       x509.KeyUsage
+	ExtKeyUsage    []x509.ExtKeyUsage
+}
+
+/**
+ * Read the extensions of a given section of an openssl configuration file
+ * (san.conf). Only subjectAltName, keyUsage and extendedKeyUsage are
+ * supported.
+ */
+func parseSanConfiguration(path string, section string) (*sanExtensions, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// section -> key -> value
+	sections := make(map[string]map[string]string)
+	current := ""
+	sections[current] = make(map[string]string)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index != -1 {
+			line = line[:index]
+		}
+		line = strings.TrimSpace(line)
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			if sections[current] == nil {
+				sections[current] = make(map[string]string)
+			}
+			continue
+		}
+
+		if index := strings.Index(line, "="); index != -1 {
+			sections[current][strings.TrimSpace(line[:index])] = strings.TrimSpace(line[index+1:])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	values := sections[section]
+	if values == nil {
+		return nil, errors.New("no section " + section + " found in " + path)
+	}
+
+	extensions := new(sanExtensions)
+
+	// The alternate names can be in the same line or in another section.
+	names := make([][2]string, 0)
+	if san, ok := values["subjectAltName"]; ok {
+		if strings.HasPrefix(san, "@") {
+			for key, value := range sections[strings.TrimPrefix(san, "@")] {
+				if index := strings.Index(key, "."); index != -1 {
+					key = key[:index]
+				}
+				names = append(names, [2]string{key, value})
+			}
+		} else {
+			for _, name := range strings.Split(san, ",") {
+				if index := strings.Index(name, ":"); index != -1 {
+					names = append(names, [2]string{strings.TrimSpace(name[:index]), strings.TrimSpace(name[index+1:])})
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		switch strings.ToUpper(name[0]) {
+		case "DNS":
+			extensions.DNSNames = append(extensions.DNSNames, name[1])
+		case "IP":
+			if ip := net.ParseIP(name[1]); ip != nil {
+				extensions.IPAddresses = append(extensions.IPAddresses, ip)
+			}
+		case "EMAIL":
+			extensions.EmailAddresses = append(extensions.EmailAddresses, name[1])
+		}
+	}
+
+	sort.Strings(extensions.DNSNames)
+
+	keyUsages := map[string]x509.KeyUsage{
+		"digitalSignature": x509.KeyUsageDigitalSignature,
+		"nonRepudiation":   x509.KeyUsageContentCommitment,
+		"keyEncipherment":  x509.KeyUsageKeyEncipherment,
+		"dataEncipherment": x509.KeyUsageDataEncipherment,
+		"keyAgreement":     x509.KeyUsageKeyAgreement,
+		"keyCertSign":      x509.KeyUsageCertSign,
+		"cRLSign":          x509.KeyUsageCRLSign,
+		"encipherOnly":     x509.KeyUsageEncipherOnly,
+		"decipherOnly":     x509.KeyUsageDecipherOnly,
+	}
+
+	if usages, ok := values["keyUsage"]; ok {
+		for _, usage := range strings.Split(usages, ",") {
+			extensions.KeyUsage |= keyUsages[strings.TrimSpace(usage)]
+		}
+	} else {
+		extensions.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+
+	extKeyUsages := map[string]x509.ExtKeyUsage{
+		"serverAuth":      x509.ExtKeyUsageServerAuth,
+		"clientAuth":      x509.ExtKeyUsageClientAuth,
+		"codeSigning":     x509.ExtKeyUsageCodeSigning,
+		"emailProtection": x509.ExtKeyUsageEmailProtection,
+		"timeStamping":    x509.ExtKeyUsageTimeStamping,
+		"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+	}
+
+	if usages, ok := values["extendedKeyUsage"]; ok {
+		for _, usage := range strings.Split(usages, ",") {
+			if extKeyUsage, ok := extKeyUsages[strings.TrimSpace(usage)]; ok {
+				extensions.ExtKeyUsage = append(extensions.ExtKeyUsage, extKeyUsage)
+			}
+		}
+	}
+
+	return extensions, nil
+}
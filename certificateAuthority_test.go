@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The san.conf of the test certificate authority.
+const testSanConfiguration = `
+[req]
+distinguished_name = req_distinguished_name
+req_extensions = v3_req
+
+[req_distinguished_name]
+
+[v3_req]
+# The extensions of the signed certificates.
+keyUsage = keyEncipherment, dataEncipherment, digitalSignature
+extendedKeyUsage = serverAuth, clientAuth
+subjectAltName = @alt_names
+
+[alt_names]
+DNS.1 = localhost
+DNS.2 = example.com
+IP.1 = 127.0.0.1
+`
+
+/**
+ * Create a certificate authority in a temporary directory, the ca.key is
+ * written with the given function.
+ */
+func newTestCertificateAuthority(t *testing.T, writeKey func(key *rsa.PrivateKey) []byte, password string) *CertificateAuthority {
+	dir, err := ioutil.TempDir("", "globular_ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Globular Root CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"ca.crt":   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"ca.key":   writeKey(key),
+		"san.conf": []byte(testSanConfiguration),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(dir+"/"+name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ca, err := NewCertificateAuthority(dir, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca
+}
+
+// Write a pkcs1 private key without encryption.
+func writeTestPKCS1Key(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+/**
+ * Encrypt a pkcs8 private key like openssl 3 does (pbes2, pbkdf2 with
+ * hmac-sha256 and aes-256-cbc). The padding is given so invalid ones can be
+ * tested, the pkcs7 padding is used if nil.
+ */
+func encryptTestPKCS8Key(t *testing.T, der []byte, password string, padding []byte) []byte {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(salt)
+	rand.Read(iv)
+
+	if padding == nil {
+		size := aes.BlockSize - len(der)%aes.BlockSize
+		for i := 0; i < size; i++ {
+			padding = append(padding, byte(size))
+		}
+	}
+	data := append(append([]byte{}, der...), padding...)
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(password), salt, 2048, 32, sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	marshal := func(value interface{}) asn1.RawValue {
+		der, err := asn1.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asn1.RawValue{FullBytes: der}
+	}
+
+	params := pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBKDF2,
+			Parameters: marshal(pbkdf2Params{Salt: salt, IterationCount: 2048, KeyLength: 32, PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue}}),
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: marshal(iv)},
+	}
+
+	info, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: marshal(params)},
+		EncryptedData: data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: info})
+}
+
+/**
+ * Return a certificate request (pem) for the given names signed by a key.
+ */
+func newTestCertificateRequest(t *testing.T, key crypto.Signer, commonName string, dnsNames []string, ips []net.IP) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestSignCertificateRequest(t *testing.T) {
+	ca := newTestCertificateAuthority(t, writeTestPKCS1Key, "")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dnsNames         []string
+		ips              []net.IP
+		expectedDNSNames []string
+		expectedIPs      []string
+	}{
+		// The names of san.conf are always in the certificate.
+		{nil, nil, []string{"example.com", "localhost"}, []string{"127.0.0.1"}},
+		// The names of the request are added.
+		{[]string{"a.example.com"}, []net.IP{net.ParseIP("10.0.0.1")}, []string{"a.example.com", "example.com", "localhost"}, []string{"10.0.0.1", "127.0.0.1"}},
+		// The names that are already in san.conf are not repeated.
+		{[]string{"localhost", "b.example.com"}, []net.IP{net.ParseIP("127.0.0.1")}, []string{"b.example.com", "example.com", "localhost"}, []string{"127.0.0.1"}},
+	}
+
+	serials := make(map[string]bool)
+	for i, test := range tests {
+		crt, err := ca.SignCertificateRequest(newTestCertificateRequest(t, key, "client", test.dnsNames, test.ips), 30, nil, nil)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		block, _ := pem.Decode(crt)
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		if err := certificate.CheckSignatureFrom(ca.certificate); err != nil {
+			t.Fatalf("%d: the certificate is not signed by the ca: %s", i, err)
+		}
+
+		dnsNames := append([]string{}, certificate.DNSNames...)
+		sort.Strings(dnsNames)
+		if strings.Join(dnsNames, ",") != strings.Join(test.expectedDNSNames, ",") {
+			t.Errorf("%d: expected the dns names %v, got %v", i, test.expectedDNSNames, dnsNames)
+		}
+
+		ips := make([]string, 0)
+		for _, ip := range certificate.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		sort.Strings(ips)
+		if strings.Join(ips, ",") != strings.Join(test.expectedIPs, ",") {
+			t.Errorf("%d: expected the ip addresses %v, got %v", i, test.expectedIPs, ips)
+		}
+
+		// The usages of san.conf.
+		if certificate.KeyUsage != x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment|x509.KeyUsageDigitalSignature {
+			t.Errorf("%d: unexpected key usage %v", i, certificate.KeyUsage)
+		}
+		if len(certificate.ExtKeyUsage) != 2 || certificate.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth || certificate.ExtKeyUsage[1] != x509.ExtKeyUsageClientAuth {
+			t.Errorf("%d: unexpected extended key usage %v", i, certificate.ExtKeyUsage)
+		}
+
+		serial := certificate.SerialNumber.Text(16)
+		if serials[serial] {
+			t.Fatalf("%d: the serial number %s was already issued", i, serial)
+		}
+		serials[serial] = true
+
+		issued, err := ca.GetIssuedCertificate(serial)
+		if err != nil || string(issued) != string(crt) {
+			t.Errorf("%d: the certificate %s is not in the issued directory", i, serial)
+		}
+	}
+
+	// Every certificate is in the inventory.
+	certificates, err := ca.GetIssuedCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificates) != len(tests) {
+		t.Fatalf("expected %d certificates in the inventory, got %d", len(tests), len(certificates))
+	}
+	for _, certificate := range certificates {
+		if !serials[certificate.SerialNumber] {
+			t.Errorf("unexpected certificate %s in the inventory", certificate.SerialNumber)
+		}
+	}
+}
+
+func TestSignCertificateRequestInvalid(t *testing.T) {
+	ca := newTestCertificateAuthority(t, writeTestPKCS1Key, "")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request with an invalid signature.
+	csr := newTestCertificateRequest(t, key, "client", []string{"localhost"}, nil)
+	block, _ := pem.Decode(csr)
+	block.Bytes[len(block.Bytes)-1] ^= 0xFF
+
+	for i, csr := range [][]byte{[]byte("not a request"), pem.EncodeToMemory(block)} {
+		if _, err := ca.SignCertificateRequest(csr, 30, nil, nil); err == nil {
+			t.Errorf("%d: expected an error", i)
+		}
+	}
+
+	if certificates, _ := ca.GetIssuedCertificates(); len(certificates) != 0 {
+		t.Fatalf("expected no certificate in the inventory, got %d", len(certificates))
+	}
+}
+
+func TestParseEncryptedPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A padding of the right size with a wrong first byte, only the last
+	// byte of a padding give its size.
+	size := aes.BlockSize - len(der)%aes.BlockSize
+	invalid := make([]byte, size)
+	for i := range invalid {
+		invalid[i] = byte(size)
+	}
+	invalid[0] ^= 0xFF
+
+	tests := []struct {
+		name     string
+		password string
+		padding  []byte
+		valid    bool
+	}{
+		{"right password", "secret", nil, true},
+		{"wrong password", "wrong", nil, false},
+		{"empty password", "", nil, false},
+		{"invalid padding", "secret", invalid, false},
+	}
+
+	for _, test := range tests {
+		keyPem := encryptTestPKCS8Key(t, der, "secret", test.padding)
+		signer, err := parsePrivateKey(keyPem, test.password)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !key.Equal(signer) {
+			t.Fatalf("%s: the decrypted key is not the encrypted one", test.name)
+		}
+	}
+
+	// The certificate authority can use an encrypted key.
+	newTestCertificateAuthority(t, func(key *rsa.PrivateKey) []byte {
+		der, _ := x509.MarshalPKCS8PrivateKey(key)
+		return encryptTestPKCS8Key(t, der, "secret", nil)
+	}, "secret")
+}
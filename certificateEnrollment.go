@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+)
+
+// The minimum size of a rsa key in a certificate request.
+const minRSAKeySize = 2048
+
+// Protect the enrollment secrets file.
+var enrollmentMutex sync.Mutex
+
+/**
+ * The names and the keys a certificate request can contain.
+ */
+type CertificatePolicy struct {
+	// The allowed dns names, *.domain allow all sub-domains of domain.
+	AllowedDomains []string
+
+	// The allowed ip addresses.
+	AllowedIPs []net.IP
+}
+
+/**
+ * Return the policy of the certificates signed by the globule ca. Names are
+ * limited to the globule domain (and sub-domains), it alternate domains and
+ * the local addresses.
+ */
+func (globule *Globule) getCertificatePolicy() *CertificatePolicy {
+	policy := &CertificatePolicy{
+		AllowedDomains: []string{"localhost", globule.Domain, "*." + globule.Domain, globule.getDomain()},
+		AllowedIPs:     []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	for i := 0; i < len(globule.AlternateDomains); i++ {
+		policy.AllowedDomains = append(policy.AllowedDomains, Utility.ToString(globule.AlternateDomains[i]))
+	}
+
+	for _, ip := range []string{Utility.MyLocalIP(), Utility.MyIP(), myIPv6()} {
+		if ip_ := net.ParseIP(ip); ip_ != nil {
+			policy.AllowedIPs = append(policy.AllowedIPs, ip_)
+		}
+	}
+
+	return policy
+}
+
+/**
+ * Test if a certificate request respect the policy.
+ */
+func (policy *CertificatePolicy) Validate(csr *x509.CertificateRequest) error {
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSAKeySize {
+			return errors.New("the rsa key must be at least " + Utility.ToString(minRSAKeySize) + " bits")
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() && key.Curve != elliptic.P384() && key.Curve != elliptic.P521() {
+			return errors.New("the ecdsa curve " + key.Curve.Params().Name + " is not allowed")
+		}
+	case ed25519.PublicKey:
+	default:
+		return errors.New("the key type of the certificate request is not allowed")
+	}
+
+	for _, name := range csr.DNSNames {
+		if !policy.isAllowedDomain(name) {
+			return errors.New("the name " + name + " is not allowed")
+		}
+	}
+
+	if len(csr.Subject.CommonName) > 0 && strings.Contains(csr.Subject.CommonName, ".") && net.ParseIP(csr.Subject.CommonName) == nil {
+		if !policy.isAllowedDomain(csr.Subject.CommonName) {
+			return errors.New("the common name " + csr.Subject.CommonName + " is not allowed")
+		}
+	}
+
+	for _, ip := range csr.IPAddresses {
+		allowed := false
+		for _, ip_ := range policy.AllowedIPs {
+			allowed = allowed || ip.Equal(ip_)
+		}
+		if !allowed {
+			return errors.New("the ip address " + ip.String() + " is not allowed")
+		}
+	}
+
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("only dns names and ip addresses are allowed")
+	}
+
+	return nil
+}
+
+func (policy *CertificatePolicy) isAllowedDomain(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	// A wildcard certificate is never signed.
+	if strings.HasPrefix(name, "*.") {
+		return false
+	}
+
+	for _, domain := range policy.AllowedDomains {
+		domain = strings.ToLower(domain)
+		if len(domain) == 0 {
+			continue
+		}
+
+		if name == domain {
+			return true
+		}
+
+		// *.domain match the sub-domains.
+		if strings.HasPrefix(domain, "*.") && strings.HasSuffix(name, domain[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * The audit record of a certificate request.
+ */
+type CertificateAudit struct {
+	Time         time.Time
+	Requester    string // account:<id> or enrollment:<id>
+	Address      string // the remote address of the requester
+	Subject      string
+	SerialNumber string
+	DNSNames     []string
+	IPAddresses  []string
+	Error        string
+}
+
+/**
+ * Append an audit record to the audit log (one json record by line).
+ */
+func (ca *CertificateAuthority) writeAudit(audit *CertificateAudit) error {
+	data, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+
+	caInventoryMutex.Lock()
+	defer caInventoryMutex.Unlock()
+
+	file, err := os.OpenFile(ca.path+"/issued/audit.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+/**
+ * A one time secret use by a client to obtain a certificate without token.
+ * Only the hash of the secret is kept.
+ */
+type EnrollmentSecret struct {
+	Id        string
+	Hash      string
+	CreatedBy string
+	Expires   time.Time
+}
+
+func (globule *Globule) getEnrollmentSecretsPath() string {
+	return globule.creds + "/enrollments.json"
+}
+
+func (globule *Globule) readEnrollmentSecrets() ([]*EnrollmentSecret, error) {
+	secrets := make([]*EnrollmentSecret, 0)
+	data, err := ioutil.ReadFile(globule.getEnrollmentSecretsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return secrets, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+func (globule *Globule) writeEnrollmentSecrets(secrets []*EnrollmentSecret) error {
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	tmp := globule.getEnrollmentSecretsPath() + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, globule.getEnrollmentSecretsPath())
+}
+
+func hashEnrollmentSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+/**
+ * Generate a new enrollment secret valid for the given delay. Return the
+ * secret id and the secret itself, the secret cannot be retreived later.
+ */
+func (globule *Globule) createEnrollmentSecret(createdBy string, delay time.Duration) (string, string, time.Time, error) {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(random)
+	enrollment := &EnrollmentSecret{
+		Id:        Utility.RandomUUID(),
+		Hash:      hashEnrollmentSecret(secret),
+		CreatedBy: createdBy,
+		Expires:   time.Now().Add(delay),
+	}
+
+	enrollmentMutex.Lock()
+	defer enrollmentMutex.Unlock()
+
+	secrets, err := globule.readEnrollmentSecrets()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	err = globule.writeEnrollmentSecrets(append(secrets, enrollment))
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	return enrollment.Id, secret, enrollment.Expires, nil
+}
+
+/**
+ * Validate an enrollment secret and remove it, so it can be use only once.
+ * Expired secrets are removed at the same time. Return the secret id.
+ */
+func (globule *Globule) consumeEnrollmentSecret(secret string) (string, error) {
+	enrollmentMutex.Lock()
+	defer enrollmentMutex.Unlock()
+
+	secrets, err := globule.readEnrollmentSecrets()
+	if err != nil {
+		return "", err
+	}
+
+	hash := hashEnrollmentSecret(secret)
+	id := ""
+	remaining := make([]*EnrollmentSecret, 0)
+	for _, enrollment := range secrets {
+		if time.Now().After(enrollment.Expires) {
+			continue
+		}
+
+		if enrollment.Hash == hash {
+			id = enrollment.Id
+			continue
+		}
+
+		remaining = append(remaining, enrollment)
+	}
+
+	err = globule.writeEnrollmentSecrets(remaining)
+	if err != nil {
+		return "", err
+	}
+
+	if len(id) == 0 {
+		return "", errors.New("invalid or expired enrollment secret")
+	}
+
+	return id, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificatePolicyValidate(t *testing.T) {
+	policy := &CertificatePolicy{
+		AllowedDomains: []string{"localhost", "example.com", "*.example.com", "alternate.org"},
+		AllowedIPs:     []net.IP{net.IPv4(127, 0, 0, 1), net.ParseIP("192.168.0.2")},
+	}
+
+	keys := make(map[string]crypto.Signer)
+	generate := map[string]func() (crypto.Signer, error){
+		"rsa1024": func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 1024) },
+		"rsa2048": func() (crypto.Signer, error) { return rsa.GenerateKey(rand.Reader, 2048) },
+		"p224":    func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P224(), rand.Reader) },
+		"p256":    func() (crypto.Signer, error) { return ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+		"ed25519": func() (crypto.Signer, error) {
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			return key, err
+		},
+	}
+	for name, generate := range generate {
+		key, err := generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		commonName string
+		dnsNames   []string
+		ips        []net.IP
+		emails     []string
+		valid      bool
+	}{
+		{"allowed names", "rsa2048", "client", []string{"localhost", "example.com", "alternate.org"}, []net.IP{net.ParseIP("127.0.0.1")}, nil, true},
+		{"sub-domain", "p256", "www.example.com", []string{"a.b.example.com", "WWW.Example.com."}, nil, nil, true},
+		{"ed25519 key", "ed25519", "client", []string{"localhost"}, nil, nil, true},
+		{"no names", "rsa2048", "client", nil, nil, nil, true},
+		{"disallowed domain", "rsa2048", "client", []string{"example.net"}, nil, nil, false},
+		{"disallowed sub-domain", "rsa2048", "client", []string{"www.alternate.org"}, nil, nil, false},
+		{"suffix of a domain", "rsa2048", "client", []string{"badexample.com"}, nil, nil, false},
+		{"wildcard", "rsa2048", "client", []string{"*.example.com"}, nil, nil, false},
+		{"disallowed common name", "rsa2048", "www.example.net", []string{"localhost"}, nil, nil, false},
+		{"disallowed ip", "rsa2048", "client", nil, []net.IP{net.ParseIP("10.0.0.1")}, nil, false},
+		{"email", "rsa2048", "client", nil, nil, []string{"admin@example.com"}, false},
+		{"small rsa key", "rsa1024", "client", []string{"localhost"}, nil, nil, false},
+		{"disallowed curve", "p224", "client", []string{"localhost"}, nil, nil, false},
+	}
+
+	for _, test := range tests {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:        pkix.Name{CommonName: test.commonName},
+			DNSNames:       test.dnsNames,
+			IPAddresses:    test.ips,
+			EmailAddresses: test.emails,
+		}, keys[test.key])
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		err = policy.Validate(csr)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestSignCertificateRequestPolicy(t *testing.T) {
+	ca := newTestCertificateAuthority(t, writeTestPKCS1Key, "")
+	policy := &CertificatePolicy{AllowedDomains: []string{"localhost"}, AllowedIPs: []net.IP{net.IPv4(127, 0, 0, 1)}}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		requester string
+		dnsNames  []string
+		valid     bool
+	}{
+		{"account:sa", []string{"localhost"}, true},
+		{"enrollment:1234", []string{"example.net"}, false},
+	}
+
+	for _, test := range tests {
+		audit := &CertificateAudit{Time: time.Now(), Requester: test.requester, Address: "127.0.0.1"}
+		_, err := ca.SignCertificateRequest(newTestCertificateRequest(t, key, "client", test.dnsNames, nil), 30, policy, audit)
+		if test.valid != (err == nil) {
+			t.Fatalf("%s: unexpected result %v", test.requester, err)
+		}
+	}
+
+	// Only the signed certificate is in the inventory.
+	certificates, err := ca.GetIssuedCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificates) != 1 || certificates[0].Requester != "account:sa" {
+		t.Fatalf("expected the certificate of account:sa in the inventory, got %v", certificates)
+	}
+
+	// Every request is audited, with its error if it was refused.
+	data, err := ioutil.ReadFile(ca.path + "/issued/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("expected %d audit records, got %d", len(tests), len(lines))
+	}
+
+	for i, line := range lines {
+		audit := new(CertificateAudit)
+		if err := json.Unmarshal([]byte(line), audit); err != nil {
+			t.Fatal(err)
+		}
+
+		if audit.Requester != tests[i].requester {
+			t.Errorf("%d: expected the requester %s, got %s", i, tests[i].requester, audit.Requester)
+		}
+		if tests[i].valid && (len(audit.Error) > 0 || audit.SerialNumber != certificates[0].SerialNumber) {
+			t.Errorf("%d: expected the serial number of the certificate, got %v", i, audit)
+		}
+		if !tests[i].valid && (len(audit.Error) == 0 || len(audit.SerialNumber) > 0) {
+			t.Errorf("%d: expected the error of the refused request, got %v", i, audit)
+		}
+	}
+}
+
+func TestEnrollmentSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "globular_enrollment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	g := new(Globule)
+	g.creds = dir
+
+	id, secret, _, err := g.createEnrollmentSecret("sa", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expired, _, err := g.createEnrollmentSecret("sa", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _, err := g.createEnrollmentSecret("sa", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		id     string
+	}{
+		{"unknown secret", "unknown", ""},
+		{"expired secret", expired, ""},
+		{"valid secret", secret, id},
+		{"reused secret", secret, ""},
+	}
+
+	for _, test := range tests {
+		id, err := g.consumeEnrollmentSecret(test.secret)
+		if len(test.id) == 0 {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil || id != test.id {
+			t.Errorf("%s: expected the id %s, got %s %v", test.name, test.id, id, err)
+		}
+	}
+
+	// Only the hash of the unused secret is kept, the expired one is removed.
+	secrets, err := g.readEnrollmentSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || secrets[0].Id != other {
+		t.Fatalf("expected the other secret only, got %v", secrets)
+	}
+
+	data, _ := ioutil.ReadFile(g.getEnrollmentSecretsPath())
+	if strings.Contains(string(data), secret) {
+		t.Fatal("the secret is kept in clear")
+	}
+}
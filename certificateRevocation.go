@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// The validity of the revocation list and the ocsp responses.
+var revocationListValidity = 7 * 24 * time.Hour
+
+// The revocation list is regenerated before it expire.
+var revocationListRefreshInterval = 24 * time.Hour
+
+// The reason code extension of a revoked certificate (rfc 5280).
+var oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+/**
+ * Revoke a certificate issued by the certificate authority. The reason is one
+ * of the ocsp revocation reason (ocsp.KeyCompromise...). The revocation list
+ * file is regenerated.
+ */
+func (ca *CertificateAuthority) RevokeCertificate(serialNumber string, reason int) error {
+	serial, ok := new(big.Int).SetString(serialNumber, 16)
+	if !ok {
+		return errors.New("invalid serial number " + serialNumber)
+	}
+
+	if reason < ocsp.Unspecified || reason > ocsp.AACompromise || reason == 7 {
+		return errors.New("invalid revocation reason")
+	}
+
+	caInventoryMutex.Lock()
+	certificates, err := ca.readInventory()
+	if err != nil {
+		caInventoryMutex.Unlock()
+		return err
+	}
+
+	var revoked *IssuedCertificate
+	for _, certificate := range certificates {
+		if certificate.SerialNumber == serial.Text(16) {
+			revoked = certificate
+			break
+		}
+	}
+
+	if revoked == nil {
+		caInventoryMutex.Unlock()
+		return errors.New("no certificate found with serial number " + serialNumber)
+	}
+
+	if !revoked.Revoked {
+		revoked.Revoked = true
+		revoked.RevocationTime = time.Now()
+		revoked.RevocationReason = reason
+		err = ca.writeInventory(certificates)
+	}
+	caInventoryMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return ca.WriteRevocationList()
+}
+
+/**
+ * Return the certificate revocation list (der) signed by the certificate
+ * authority.
+ */
+func (ca *CertificateAuthority) GetRevocationList() ([]byte, error) {
+	caInventoryMutex.Lock()
+	certificates, err := ca.readInventory()
+	caInventoryMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	revokedCertificates := make([]pkix.RevokedCertificate, 0)
+	for _, certificate := range certificates {
+		if !certificate.Revoked {
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString(certificate.SerialNumber, 16)
+		if !ok {
+			continue
+		}
+
+		reason, err := asn1.Marshal(asn1.Enumerated(certificate.RevocationReason))
+		if err != nil {
+			return nil, err
+		}
+
+		revokedCertificates = append(revokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: certificate.RevocationTime.UTC(),
+			Extensions:     []pkix.Extension{{Id: oidReasonCode, Value: reason}},
+		})
+	}
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		RevokedCertificates: revokedCertificates,
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(revocationListValidity),
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, template, ca.certificate, ca.privateKey)
+	if err != nil {
+		// A ca created without the crlSign key usage can only sign a v1 list.
+		return ca.certificate.CreateCRL(rand.Reader, ca.privateKey, revokedCertificates, now, now.Add(revocationListValidity))
+	}
+
+	return crl, nil
+}
+
+/**
+ * Write the revocation list in the creds directory (ca.crl), that file is
+ * given to the services to reject revoked peers.
+ */
+func (ca *CertificateAuthority) WriteRevocationList() error {
+	crl, err := ca.GetRevocationList()
+	if err != nil {
+		return err
+	}
+
+	tmp := ca.path + "/ca.crl.tmp"
+	err = ioutil.WriteFile(tmp, crl, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ca.path+"/ca.crl")
+}
+
+/**
+ * Create the ocsp response (der) to a given ocsp request (der).
+ */
+func (ca *CertificateAuthority) GetOcspResponse(request []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(request)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse, err
+	}
+
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(revocationListValidity),
+		IssuerHash:   req.HashAlgorithm,
+	}
+
+	// The certificate must be issued by that ca.
+	if ca.isIssuerKeyHash(req) {
+		caInventoryMutex.Lock()
+		certificates, err := ca.readInventory()
+		caInventoryMutex.Unlock()
+		if err != nil {
+			return ocsp.InternalErrorErrorResponse, err
+		}
+
+		for _, certificate := range certificates {
+			if certificate.SerialNumber == req.SerialNumber.Text(16) {
+				if certificate.Revoked {
+					template.Status = ocsp.Revoked
+					template.RevokedAt = certificate.RevocationTime
+					template.RevocationReason = certificate.RevocationReason
+				} else {
+					template.Status = ocsp.Good
+				}
+				break
+			}
+		}
+	}
+
+	response, err := ocsp.CreateResponse(ca.certificate, ca.certificate, template, ca.privateKey)
+	if err != nil {
+		return ocsp.InternalErrorErrorResponse, err
+	}
+
+	return response, nil
+}
+
+/**
+ * Test if the issuer key hash of an ocsp request is the one of the ca.
+ */
+func (ca *CertificateAuthority) isIssuerKeyHash(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	if _, err := asn1.Unmarshal(ca.certificate.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+
+	return bytes.Equal(h.Sum(nil), req.IssuerKeyHash)
+}
+
+/**
+ * Keep the revocation list file valid until the server stop.
+ */
+func (globule *Globule) startRevocationListRefresh() {
+	writeRevocationList := func() {
+		ca, err := globule.getCertificateAuthority()
+		if err == nil {
+			err = ca.WriteRevocationList()
+		}
+
+		if err != nil {
+			log.Println("fail to write certificate revocation list with error ", err)
+		}
+	}
+
+	writeRevocationList()
+	ticker := time.NewTicker(revocationListRefreshInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				writeRevocationList()
+			case <-globule.exit:
+				ticker.Stop()
+				return // exit from the loop when the service exit.
+			}
+		}
+	}()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// The delay to wait after the last file change before reloading certificates,
+// the certificate and it key are not written at the same time.
+var certificateReloadDelay = 2 * time.Second
+
+// The files of a certificate and it private key.
+type certificateFiles struct {
+	certFile string
+	keyFile  string
+}
+
+/**
+ * Keep the https certificates in memory and give them to the tls server at
+ * handshake time. The certificate is choose with the server name (SNI) ask by
+ * the client, the default certificate is use when no certificate exist for
+ * that name. When the certificate files change on disk the new certificates
+ * are load and swap with the previous ones, so renewal or manual replacement
+ * take effect without restarting the server.
+ */
+type CertificateStore struct {
+	mutex        sync.RWMutex
+	files        map[string]certificateFiles // host -> files, the default certificate host is ""
+	certificates map[string]*tls.Certificate // host -> certificate
+
+	// Use to reload only once when many files change at the same time.
+	timerMutex sync.Mutex
+	timer      *time.Timer
+}
+
+/**
+ * Create a new store and load the default certificate from the given files.
+ */
+func NewCertificateStore(certFile string, keyFile string) (*CertificateStore, error) {
+	store := &CertificateStore{files: make(map[string]certificateFiles), certificates: make(map[string]*tls.Certificate)}
+	err := store.AddCertificate("", certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+/**
+ * Load a certificate and use it for the given host. An empty host set the
+ * default certificate.
+ */
+func (store *CertificateStore) AddCertificate(host string, certFile string, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	host = strings.ToLower(host)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.files[host] = certificateFiles{certFile: certFile, keyFile: keyFile}
+	store.certificates[host] = &certificate
+
+	return nil
+}
+
+/**
+ * Return true if a certificate was load for the given host.
+ */
+func (store *CertificateStore) HasCertificate(host string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	_, ok := store.certificates[strings.ToLower(host)]
+	return ok
+}
+
+/**
+ * Load the certificates from the disk. If the files of a certificate are
+ * invalid the previous certificate is kept.
+ */
+func (store *CertificateStore) Load() error {
+	store.mutex.RLock()
+	files := make(map[string]certificateFiles, len(store.files))
+	for host, f := range store.files {
+		files[host] = f
+	}
+	store.mutex.RUnlock()
+
+	var err error
+	for host, f := range files {
+		certificate, err_ := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err_ != nil {
+			err = err_
+			continue
+		}
+
+		store.mutex.Lock()
+		store.certificates[host] = &certificate
+		store.mutex.Unlock()
+	}
+
+	return err
+}
+
+/**
+ * Use as tls.Config.GetCertificate.
+ */
+func (store *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if certificate, ok := store.certificates[name]; ok {
+		return certificate, nil
+	}
+
+	// Try a wildcard certificate for the parent domain.
+	if index := strings.Index(name, "."); index != -1 {
+		if certificate, ok := store.certificates["*"+name[index:]]; ok {
+			return certificate, nil
+		}
+	}
+
+	if certificate, ok := store.certificates[""]; ok {
+		return certificate, nil
+	}
+
+	return nil, errors.New("no certificate was found for " + hello.ServerName)
+}
+
+/**
+ * Reload the certificates when the files in the given directory change. The
+ * watch stop when the exit channel is closed (see Globule.closeExit).
+ */
+func (store *CertificateStore) Watch(dir string, exit chan bool) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	err = watcher.Add(dir)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case evt := <-watcher.Events:
+				if store.isCertificateFile(evt.Name) {
+					store.reloadLater()
+				}
+			case err := <-watcher.Errors:
+				log.Println("certificates watcher error ", err)
+			case <-exit:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (store *CertificateStore) isCertificateFile(path string) bool {
+	path = filepath.Clean(path)
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for _, f := range store.files {
+		if path == filepath.Clean(f.certFile) || path == filepath.Clean(f.keyFile) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (store *CertificateStore) reloadLater() {
+	store.timerMutex.Lock()
+	defer store.timerMutex.Unlock()
+
+	if store.timer != nil {
+		store.timer.Stop()
+	}
+
+	store.timer = time.AfterFunc(certificateReloadDelay, func() {
+		err := store.Load()
+		if err != nil {
+			log.Println("fail to reload certificates with error", err)
+			return
+		}
+		log.Println("certificates were reloaded")
+	})
+}
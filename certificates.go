@@ -0,0 +1,595 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"github.com/go-acme/lego/certcrypto"
+	"github.com/go-acme/lego/certificate"
+	"github.com/go-acme/lego/challenge"
+	"github.com/go-acme/lego/challenge/http01"
+	"github.com/go-acme/lego/challenge/tlsalpn01"
+	"github.com/go-acme/lego/lego"
+)
+
+// The path where the ACME server will look for http-01 challenge token.
+const http01ChallengePath = "/.well-known/acme-challenge/"
+
+// The delay between two verifications of the certificate expiration date.
+var certRenewalCheckInterval = 12 * time.Hour
+
+// The time to wait for the dns-01 TXT record propagation and the delay
+// between two verifications.
+var (
+	dnsPropagationTimeout  = 2 * time.Minute
+	dnsPropagationInterval = 5 * time.Second
+)
+
+/**
+ * That provider answer the let's encrypt http-01 challenge directly from the
+ * globular http server. Because the challenge is not served by a second
+ * server on the same port, the certificate can be obtain (or renew) while the
+ * server is running.
+ */
+type HTTPProviderGlobular struct {
+	mutex  sync.RWMutex
+	tokens map[string]string // token -> key authorization
+}
+
+func NewHTTPProviderGlobular() *HTTPProviderGlobular {
+	return &HTTPProviderGlobular{tokens: make(map[string]string)}
+}
+
+func (p *HTTPProviderGlobular) Present(domain, token, keyAuth string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.tokens[token] = keyAuth
+	return nil
+}
+
+func (p *HTTPProviderGlobular) CleanUp(domain, token, keyAuth string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.tokens, token)
+	return nil
+}
+
+/**
+ * Return the key authorization of a given challenge token.
+ */
+func (p *HTTPProviderGlobular) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, http01ChallengePath)
+
+	p.mutex.RLock()
+	keyAuth, ok := p.tokens[token]
+	p.mutex.RUnlock()
+
+	if !ok || r.URL.Path != http01.ChallengePath(token) {
+		http.Error(w, "No challenge found for token "+token, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+}
+
+/**
+ * That provider answer the let's encrypt tls-alpn-01 challenge from the
+ * globular https server, the challenge certificate is given to the clients
+ * that ask for the acme-tls/1 protocol.
+ */
+type TLSALPNProviderGlobular struct {
+	mutex        sync.RWMutex
+	certificates map[string]*tls.Certificate // domain -> challenge certificate
+}
+
+func NewTLSALPNProviderGlobular() *TLSALPNProviderGlobular {
+	return &TLSALPNProviderGlobular{certificates: make(map[string]*tls.Certificate)}
+}
+
+func (p *TLSALPNProviderGlobular) Present(domain, token, keyAuth string) error {
+	certificate, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.certificates[strings.ToLower(domain)] = certificate
+	return nil
+}
+
+func (p *TLSALPNProviderGlobular) CleanUp(domain, token, keyAuth string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.certificates, strings.ToLower(domain))
+	return nil
+}
+
+/**
+ * Use as tls.Config.GetConfigForClient, return the challenge certificate to
+ * the ACME server and nil (the server configuration) to other clients.
+ */
+func (p *TLSALPNProviderGlobular) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != tlsalpn01.ACMETLS1Protocol {
+		return nil, nil
+	}
+
+	p.mutex.RLock()
+	certificate, ok := p.certificates[strings.ToLower(hello.ServerName)]
+	p.mutex.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no tls-alpn-01 challenge found for " + hello.ServerName)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		NextProtos:   []string{tlsalpn01.ACMETLS1Protocol},
+	}, nil
+}
+
+/**
+ * Return the challenges to try, in order, to validate the given domains.
+ * The dns-01 challenge is use when dns are configured, the http-01 and the
+ * tls-alpn-01 challenges can't validate wildcard domains.
+ */
+func (globule *Globule) getAcmeChallengeTypes(domains []string) []challenge.Type {
+	challengeTypes := make([]challenge.Type, 0)
+	if len(globule.DNS) > 0 {
+		challengeTypes = append(challengeTypes, challenge.DNS01)
+	}
+
+	for _, domain := range domains {
+		if strings.HasPrefix(domain, "*.") {
+			return challengeTypes
+		}
+	}
+
+	return append(challengeTypes, challenge.HTTP01, challenge.TLSALPN01)
+}
+
+/**
+ * Run an ACME request (obtain or renew a certificate) with each possible
+ * challenge until one succeed.
+ */
+func (globule *Globule) acmeRequest(domains []string, request func(client *lego.Client) (*certificate.Resource, error)) (*certificate.Resource, error) {
+	challengeTypes := globule.getAcmeChallengeTypes(domains)
+	if len(challengeTypes) == 0 {
+		return nil, errors.New("a dns must be configured to obtain a certificate for " + strings.Join(domains, ", "))
+	}
+
+	errs := make([]string, 0)
+	for _, challengeType := range challengeTypes {
+		client, err := globule.getAcmeClient(challengeType)
+		if err == nil {
+			var resource *certificate.Resource
+			resource, err = request(client)
+			if err == nil {
+				return resource, nil
+			}
+		}
+
+		log.Println("fail to validate", strings.Join(domains, ", "), "with challenge", challengeType, "with error", err)
+		errs = append(errs, challengeType.String()+": "+err.Error())
+	}
+
+	return nil, errors.New("fail to validate " + strings.Join(domains, ", ") + " " + strings.Join(errs, ", "))
+}
+
+/**
+ * Write the certificate received from the ACME server in the creds directory
+ * and keep it information in the configuration.
+ */
+func (globule *Globule) saveCertificateResource(resource *certificate.Resource) error {
+
+	// Keep certificates url in the config.
+	globule.CertURL = resource.CertURL
+	globule.CertStableURL = resource.CertStableURL
+
+	// Set the certificates paths...
+	globule.Certificate = globule.getDomain() + ".crt"
+	globule.CertificateAuthorityBundle = globule.getDomain() + ".issuer.crt"
+
+	// The files are read only so I will remove the previous one before.
+	os.Remove(globule.creds + "/" + globule.Certificate)
+	os.Remove(globule.creds + "/" + globule.CertificateAuthorityBundle)
+
+	// Save the certificate in the cerst folder.
+	err := ioutil.WriteFile(globule.creds+"/"+globule.Certificate, resource.Certificate, 0400)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(globule.creds+"/"+globule.CertificateAuthorityBundle, resource.IssuerCertificate, 0400)
+	if err != nil {
+		return err
+	}
+
+	// save the config with the values.
+	return globule.saveConfig()
+}
+
+/**
+ * Return the expiration date of the https certificate.
+ */
+func (globule *Globule) getCertificateExpiration() (time.Time, error) {
+	crt, err := ioutil.ReadFile(globule.creds + "/" + globule.Certificate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The certificate can be a bundle, the first block is the server certificate.
+	block, _ := pem.Decode(crt)
+	if block == nil {
+		return time.Time{}, errors.New("no certificate found in " + globule.Certificate)
+	}
+
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return x509Cert.NotAfter, nil
+}
+
+/**
+ * Renew the https certificate with the ACME server. The server csr is reuse
+ * so the server private key stay the same.
+ */
+func (globule *Globule) renewCertificate() error {
+	crt, err := ioutil.ReadFile(globule.creds + "/" + globule.Certificate)
+	if err != nil {
+		return err
+	}
+
+	csr, err := ioutil.ReadFile(globule.creds + "/server.csr")
+	if err != nil {
+		return err
+	}
+
+	x509Cert, err := certcrypto.ParsePEMCertificate(crt)
+	if err != nil {
+		return err
+	}
+
+	resource, err := globule.acmeRequest(x509Cert.DNSNames, func(client *lego.Client) (*certificate.Resource, error) {
+		return client.Certificate.Renew(certificate.Resource{
+			Domain:        globule.getDomain(),
+			CertURL:       globule.CertURL,
+			CertStableURL: globule.CertStableURL,
+			Certificate:   crt,
+			CSR:           csr,
+		}, true, false)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return globule.saveCertificateResource(resource)
+}
+
+/**
+ * Renew the certificate if it expire in less than CertRenewalDelay days. The
+ * result is publish as certificate_renewed_event or
+ * certificate_renewal_failed_event.
+ */
+func (globule *Globule) renewCertificateIfExpired() error {
+	expiration, err := globule.getCertificateExpiration()
+	if err != nil {
+		return err
+	}
+
+	if time.Until(expiration) > time.Duration(globule.CertRenewalDelay)*24*time.Hour {
+		return nil // nothing to do.
+	}
+
+	log.Println("the certificate", globule.Certificate, "expire at", expiration, "try to renew it...")
+	infos := map[string]interface{}{"domain": globule.getDomain(), "certificate": globule.Certificate}
+	err = globule.renewCertificate()
+	if err != nil {
+		log.Println("fail to renew certificate with error ", err)
+		infos["error"] = err.Error()
+		data, _ := json.Marshal(infos)
+		globule.publish("certificate_renewal_failed_event", data)
+		return err
+	}
+
+	expiration, _ = globule.getCertificateExpiration()
+	infos["expiration"] = expiration.Unix()
+	data, _ := json.Marshal(infos)
+	globule.publish("certificate_renewed_event", data)
+	log.Println("the certificate", globule.Certificate, "was renew and now expire at", expiration)
+
+	return nil
+}
+
+/**
+ * Return the list of hosts other than the globule domain that must have their
+ * own certificate, the alternate domains and the directories of the webroot
+ * named as a host.
+ */
+func (globule *Globule) getVirtualHosts() []string {
+	hosts := make([]string, 0)
+	exist := make(map[string]bool)
+	exist[globule.getDomain()] = true
+
+	add := func(host string) {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if len(host) == 0 || exist[host] || host == "localhost" {
+			return
+		}
+		exist[host] = true
+		hosts = append(hosts, host)
+	}
+
+	for i := 0; i < len(globule.AlternateDomains); i++ {
+		add(Utility.ToString(globule.AlternateDomains[i]))
+	}
+
+	files, err := ioutil.ReadDir(globule.webRoot)
+	if err == nil {
+		for _, f := range files {
+			if f.IsDir() && strings.Contains(f.Name(), ".") && !strings.HasPrefix(f.Name(), ".") {
+				add(f.Name())
+			}
+		}
+	}
+
+	return hosts
+}
+
+/**
+ * Return true if a certificate can be ask to the ACME server for a given host.
+ * A directory of the webroot named as a host is not a proof that the host
+ * point to the server, so the host must be an alternate domain or resolve to
+ * the public address of the server.
+ */
+func (globule *Globule) canObtainHostCertificate(host string) bool {
+	for i := 0; i < len(globule.AlternateDomains); i++ {
+		if strings.EqualFold(Utility.ToString(globule.AlternateDomains[i]), host) {
+			return true
+		}
+	}
+
+	addresses, err := globule.lookupIp()
+	if err != nil {
+		return false
+	}
+
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range ips {
+		if ip == addresses.Public || (len(addresses.PublicV6) > 0 && net.ParseIP(ip).Equal(net.ParseIP(addresses.PublicV6))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Return the path of the certificate, the private key and the ACME
+ * informations of a given host.
+ */
+func (globule *Globule) getHostCertificatePaths(host string) (string, string, string) {
+	path := globule.creds + "/" + strings.ReplaceAll(host, "*", "_")
+	return path + ".crt", path + ".pem", path + ".json"
+}
+
+/**
+ * Obtain a certificate for a given host from the ACME server. A new private
+ * key is generated for that host.
+ */
+func (globule *Globule) obtainHostCertificate(host string) error {
+	privateKey, err := certcrypto.GeneratePrivateKey(certcrypto.RSA2048)
+	if err != nil {
+		return err
+	}
+
+	resource, err := globule.acmeRequest([]string{host}, func(client *lego.Client) (*certificate.Resource, error) {
+		return client.Certificate.Obtain(certificate.ObtainRequest{
+			Domains:    []string{host},
+			Bundle:     true,
+			PrivateKey: privateKey,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return globule.saveHostCertificateResource(host, resource)
+}
+
+/**
+ * Write the certificate of a given host in the creds directory. The ACME
+ * informations are kept beside the certificate to be able to renew it.
+ */
+func (globule *Globule) saveHostCertificateResource(host string, resource *certificate.Resource) error {
+	certFile, keyFile, infoFile := globule.getHostCertificatePaths(host)
+
+	infos, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certFile, keyFile, infoFile} {
+		os.Remove(path)
+	}
+
+	err = ioutil.WriteFile(keyFile, resource.PrivateKey, 0400)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(certFile, resource.Certificate, 0400)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(infoFile, infos, 0400)
+}
+
+/**
+ * Load the certificate of each virtual host in the certificate store. The
+ * certificate is taken from the creds directory (<host>.crt and <host>.pem)
+ * if it exist, otherwise it is obtain from the ACME server when the host point
+ * to the server.
+ */
+func (globule *Globule) initHostsCertificates() {
+	if globule.certificateStore == nil {
+		return
+	}
+
+	hosts := globule.getVirtualHosts()
+	for i := 0; i < len(hosts); i++ {
+		host := hosts[i]
+		certFile, keyFile, _ := globule.getHostCertificatePaths(host)
+		if !Utility.Exists(certFile) || !Utility.Exists(keyFile) {
+			// Wildcard domains can only be validated by the dns-01 challenge.
+			if strings.HasPrefix(host, "*") && len(globule.DNS) == 0 || !globule.canObtainHostCertificate(host) {
+				log.Println("no certificate found for", host)
+				continue
+			}
+
+			log.Println("obtain certificate for", host)
+			err := globule.obtainHostCertificate(host)
+			if err != nil {
+				log.Println("fail to obtain certificate for", host, "with error", err)
+				continue
+			}
+		}
+
+		err := globule.certificateStore.AddCertificate(host, certFile, keyFile)
+		if err != nil {
+			log.Println("fail to load certificate for", host, "with error", err)
+		}
+	}
+}
+
+/**
+ * Renew the certificate of a given host if it was obtain from ACME and it
+ * expire in less than CertRenewalDelay days.
+ */
+func (globule *Globule) renewHostCertificateIfExpired(host string) error {
+	certFile, keyFile, infoFile := globule.getHostCertificatePaths(host)
+	if !Utility.Exists(infoFile) {
+		return nil // the certificate was not obtain with ACME.
+	}
+
+	crt, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+
+	x509Cert, err := certcrypto.ParsePEMCertificate(crt)
+	if err != nil {
+		return err
+	}
+
+	if time.Until(x509Cert.NotAfter) > time.Duration(globule.CertRenewalDelay)*24*time.Hour {
+		return nil // nothing to do.
+	}
+
+	data, err := ioutil.ReadFile(infoFile)
+	if err != nil {
+		return err
+	}
+
+	resource := certificate.Resource{}
+	err = json.Unmarshal(data, &resource)
+	if err != nil {
+		return err
+	}
+
+	resource.Certificate = crt
+	resource.PrivateKey, err = ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	infos := map[string]interface{}{"domain": host, "certificate": certFile}
+	err = func() error {
+		renewed, err := globule.acmeRequest([]string{host}, func(client *lego.Client) (*certificate.Resource, error) {
+			return client.Certificate.Renew(resource, true, false)
+		})
+		if err != nil {
+			return err
+		}
+
+		return globule.saveHostCertificateResource(host, renewed)
+	}()
+
+	if err != nil {
+		log.Println("fail to renew certificate of", host, "with error ", err)
+		infos["error"] = err.Error()
+		data, _ := json.Marshal(infos)
+		globule.publish("certificate_renewal_failed_event", data)
+		return err
+	}
+
+	data, _ = json.Marshal(infos)
+	globule.publish("certificate_renewed_event", data)
+	log.Println("the certificate of", host, "was renew")
+
+	return nil
+}
+
+/**
+ * Renew all certificates obtain with ACME that will expire soon.
+ */
+func (globule *Globule) renewCertificatesIfExpired() {
+	// Only certificate obtain with ACME can be renew.
+	if len(globule.Certificate) > 0 && len(globule.CertURL) > 0 {
+		globule.renewCertificateIfExpired()
+	}
+
+	hosts := globule.getVirtualHosts()
+	for i := 0; i < len(hosts); i++ {
+		globule.renewHostCertificateIfExpired(hosts[i])
+	}
+}
+
+/**
+ * Keep the let's encrypt certificates valid until the server stop.
+ */
+func (globule *Globule) startCertificateRenewal() {
+
+	if globule.Protocol != "https" {
+		return
+	}
+
+	ticker := time.NewTicker(certRenewalCheckInterval)
+	go func() {
+		// The http server must be running to answer the challenge.
+		globule.initHostsCertificates()
+		globule.renewCertificatesIfExpired()
+		for {
+			select {
+			case <-ticker.C:
+				// New virtual hosts can be added while the server is running.
+				globule.initHostsCertificates()
+				globule.renewCertificatesIfExpired()
+			case <-globule.exit:
+				ticker.Stop()
+				return // exit from the loop when the service exit.
+			}
+		}
+	}()
+}
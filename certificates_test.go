@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+/**
+ * Write a self signed certificate for the domain of the globule that expire
+ * at the given time.
+ */
+func writeTestCertificate(t *testing.T, g *Globule, notAfter time.Time) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: g.getDomain()},
+		DNSNames:     []string{g.getDomain()},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Certificate = g.getDomain() + ".crt"
+	err = ioutil.WriteFile(g.creds+"/"+g.Certificate, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+/**
+ * Write the server csr of the globule domain, the key is also use as the
+ * ACME account key.
+ */
+func writeTestCsr(t *testing.T, g *Globule, key *rsa.PrivateKey) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(g.creds+"/client.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: g.getDomain()}, DNSNames: []string{g.getDomain()}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(g.creds+"/server.csr", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+/**
+ * Return a globule that keep its credentials and configuration in a
+ * temporary directory.
+ */
+func newTestCertificatesGlobule(t *testing.T) *Globule {
+	dir, err := ioutil.TempDir("", "globular_certificates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	previous := configPath
+	configPath = dir + "/config.json"
+	t.Cleanup(func() { configPath = previous })
+
+	g := new(Globule)
+	g.Name = "globular"
+	g.Domain = "example.com"
+	g.Protocol = "https"
+	g.creds = dir
+	g.CertRenewalDelay = 30
+	g.exit = make(chan bool)
+	g.http01Provider = NewHTTPProviderGlobular()
+	g.tlsAlpn01Provider = NewTLSALPNProviderGlobular()
+
+	return g
+}
+
+func TestGetCertificateExpiration(t *testing.T) {
+	g := newTestCertificatesGlobule(t)
+	notAfter := time.Now().Add(60 * 24 * time.Hour).Truncate(time.Second)
+	writeTestCertificate(t, g, notAfter)
+
+	expiration, err := g.getCertificateExpiration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !expiration.Equal(notAfter) {
+		t.Fatalf("expected expiration %v, got %v", notAfter, expiration)
+	}
+}
+
+func TestRenewCertificateIfExpiredNotDue(t *testing.T) {
+	g := newTestCertificatesGlobule(t)
+	writeTestCertificate(t, g, time.Now().Add(60*24*time.Hour))
+
+	// The ACME server must not be contacted before the renewal delay.
+	acme := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected ACME request %s", r.URL.Path)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer acme.Close()
+	g.AcmeDirectoryURL = acme.URL + "/dir"
+
+	err := g.renewCertificateIfExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenewCertificateIfExpiredFailure(t *testing.T) {
+	g := newTestCertificatesGlobule(t)
+	writeTestCertificate(t, g, time.Now().Add(10*24*time.Hour))
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCsr(t, g, key)
+
+	// The ACME server is unavailable, the certificate must be kept.
+	acme := httptest.NewServer(http.NotFoundHandler())
+	defer acme.Close()
+	g.AcmeDirectoryURL = acme.URL + "/dir"
+
+	crt, _ := ioutil.ReadFile(g.creds + "/" + g.Certificate)
+	err = g.renewCertificateIfExpired()
+	if err == nil {
+		t.Fatal("expected the renewal to fail")
+	}
+
+	crt_, _ := ioutil.ReadFile(g.creds + "/" + g.Certificate)
+	if string(crt) != string(crt_) {
+		t.Fatal("the certificate was changed by a failed renewal")
+	}
+}
+
+/**
+ * Obtain and renew a certificate from a local Pebble server
+ * (https://github.com/letsencrypt/pebble). The test run only if
+ * PEBBLE_DIRECTORY is set, ex:
+ *
+ *   PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+ *   LEGO_CA_CERTIFICATES=test/certs/pebble.minica.pem PEBBLE_DIRECTORY=https://localhost:14000/dir go test -run Pebble
+ */
+func TestRenewCertificatePebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if len(directory) == 0 {
+		t.Skip("PEBBLE_DIRECTORY is not set")
+	}
+
+	g := newTestCertificatesGlobule(t)
+	g.AcmeDirectoryURL = directory
+	g.AdminEmail = "admin@example.com"
+
+	// The account key and the server csr.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCsr(t, g, key)
+
+	// Answer the http-01 challenge on the Pebble default validation port.
+	server := &http.Server{Addr: ":5002", Handler: g.http01Provider}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	err = g.obtainCertificateForCsr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, _ := ioutil.ReadFile(g.creds + "/" + g.Certificate)
+
+	// Pebble certificates expire in less than the renewal delay.
+	g.CertRenewalDelay = 3650
+	err = g.renewCertificateIfExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt_, _ := ioutil.ReadFile(g.creds + "/" + g.Certificate)
+	if string(crt) == string(crt_) {
+		t.Fatal("the certificate was not renewed")
+	}
+}
+
+func TestCloseExit(t *testing.T) {
+	g := newTestCertificatesGlobule(t)
+	g.WatchIpDelay = 1
+	g.ipLookup = func() (*IpAddresses, error) {
+		return new(IpAddresses), nil
+	}
+
+	count := runtime.NumGoroutine()
+	g.startIpWatcher()
+	g.startProxyHealthChecks()
+
+	// Every listener must stop, and closing twice must not panic.
+	g.closeExit()
+	g.closeExit()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d loops still running after exit", runtime.NumGoroutine()-count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/**
+ * A service logger that write nothing.
+ */
+type testServiceLogger struct{}
+
+func (testServiceLogger) Error(v ...interface{}) error                   { return nil }
+func (testServiceLogger) Warning(v ...interface{}) error                 { return nil }
+func (testServiceLogger) Info(v ...interface{}) error                    { return nil }
+func (testServiceLogger) Errorf(format string, a ...interface{}) error   { return nil }
+func (testServiceLogger) Warningf(format string, a ...interface{}) error { return nil }
+func (testServiceLogger) Infof(format string, a ...interface{}) error    { return nil }
+
+func TestStopAfterStopServices(t *testing.T) {
+	previous := logger
+	logger = testServiceLogger{}
+	defer func() { logger = previous }()
+
+	g := newTestCertificatesGlobule(t)
+	g.data = g.creds
+	g.grpcWebGateway = NewGrpcWebGateway()
+
+	previousGlobule := globule
+	globule = g
+	defer func() { globule = previousGlobule }()
+
+	if err := g.startMediaQueue(); err != nil {
+		t.Fatal(err)
+	}
+	g.startFileWatcher()
+
+	// The service manager call Stop, the services may already be stopped.
+	g.stopServices()
+	err := g.Stop(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-g.exit:
+	default:
+		t.Fatal("the exit channel is not closed")
+	}
+}
+
+/**
+ * Write a self signed certificate and its private key for a given host in the
+ * creds directory.
+ */
+func writeTestHostCertificate(t *testing.T, g *Globule, host string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile, _ := g.getHostCertificatePaths(host)
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestInitHostsCertificates(t *testing.T) {
+	g := newTestCertificatesGlobule(t)
+	g.webRoot = g.creds + "/webroot"
+	g.ipLookup = func() (*IpAddresses, error) {
+		return &IpAddresses{Public: "192.0.2.1"}, nil
+	}
+
+	// The ACME server must not be contacted for a host that doesn't point to
+	// the server.
+	acme := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected ACME request %s", r.URL.Path)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer acme.Close()
+	g.AcmeDirectoryURL = acme.URL + "/dir"
+
+	for _, host := range []string{"site.example.com", "unknown.invalid", ".hidden", "static"} {
+		if err := os.MkdirAll(g.webRoot+"/"+host, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certFile, keyFile := writeTestHostCertificate(t, g, g.getDomain())
+	store, err := NewCertificateStore(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.certificateStore = store
+	writeTestHostCertificate(t, g, "site.example.com")
+
+	hosts := g.getVirtualHosts()
+	if len(hosts) != 2 || hosts[0] != "site.example.com" || hosts[1] != "unknown.invalid" {
+		t.Fatalf("unexpected virtual hosts %v", hosts)
+	}
+
+	g.initHostsCertificates()
+
+	if !store.HasCertificate("site.example.com") {
+		t.Fatal("the certificate of site.example.com was not loaded from the disk")
+	}
+	if store.HasCertificate("unknown.invalid") {
+		t.Fatal("unexpected certificate for unknown.invalid")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files smaller than that are not worth compressing.
+const minCompressSize = 1024
+
+// Files bigger than that are not compressed on the fly.
+var maxCompressSize int64 = 10 * 1024 * 1024
+
+// The maximum size of the compressed files kept in memory.
+var maxCompressCacheSize int64 = 64 * 1024 * 1024
+
+// The encodings supported in the order of preference and the extension of the
+// precompressed files. Only gzip can be compressed on the fly.
+var contentEncodings = []struct {
+	name      string
+	extension string
+}{{"br", ".br"}, {"gzip", ".gz"}}
+
+/**
+ * Return true if a mime type is worth compressing. Images, videos, audio and
+ * archives are already compressed.
+ */
+func isCompressible(mimeType string) bool {
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+
+	switch mimeType {
+	case "application/javascript", "application/x-javascript", "application/json", "application/manifest+json",
+		"application/xml", "application/xhtml+xml", "application/wasm", "image/svg+xml", "image/x-icon",
+		"font/ttf", "font/otf", "application/vnd.ms-fontobject":
+		return true
+	}
+
+	return false
+}
+
+/**
+ * Return the quality of each encoding of the Accept-Encoding header.
+ */
+func getAcceptedEncodings(r *http.Request) map[string]float64 {
+	encodings := make(map[string]float64)
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			values := strings.Split(encoding, ";")
+			name := strings.ToLower(strings.TrimSpace(values[0]))
+			if len(name) == 0 {
+				continue
+			}
+
+			q := 1.0
+			for _, param := range values[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q_, err := strconv.ParseFloat(param[2:], 64)
+					if err == nil {
+						q = q_
+					}
+				}
+			}
+			encodings[name] = q
+		}
+	}
+
+	return encodings
+}
+
+/**
+ * Return true if the client accept a given encoding.
+ */
+func acceptEncoding(encodings map[string]float64, encoding string) bool {
+	if q, ok := encodings[encoding]; ok {
+		return q > 0
+	}
+
+	q, ok := encodings["*"]
+	return ok && q > 0
+}
+
+/**
+ * A compressed file kept in memory.
+ */
+type compressedFile struct {
+	key     string
+	modTime time.Time
+	size    int64 // the size of the source file
+	data    []byte
+}
+
+/**
+ * The compressed files cache, the least recently used files are removed
+ * when the cache is full.
+ */
+var compressCache = struct {
+	sync.Mutex
+	files map[string]*list.Element
+	lru   *list.List
+	size  int64
+}{files: make(map[string]*list.Element), lru: list.New()}
+
+/**
+ * Return the gzip version of a content, the result is kept in memory until
+ * the source change.
+ */
+func getCompressedContent(key string, modTime time.Time, size int64, read func() ([]byte, error)) ([]byte, error) {
+	compressCache.Lock()
+	if element, ok := compressCache.files[key]; ok {
+		file := element.Value.(*compressedFile)
+		if file.modTime.Equal(modTime) && file.size == size {
+			compressCache.lru.MoveToFront(element)
+			compressCache.Unlock()
+			return file.data, nil
+		}
+	}
+	compressCache.Unlock()
+
+	data, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := &compressedFile{key: key, modTime: modTime, size: size, data: buffer.Bytes()}
+
+	compressCache.Lock()
+	defer compressCache.Unlock()
+
+	if element, ok := compressCache.files[key]; ok {
+		compressCache.size -= int64(len(element.Value.(*compressedFile).data))
+		compressCache.lru.Remove(element)
+	}
+
+	compressCache.files[key] = compressCache.lru.PushFront(file)
+	compressCache.size += int64(len(file.data))
+
+	for compressCache.size > maxCompressCacheSize && compressCache.lru.Len() > 1 {
+		element := compressCache.lru.Back()
+		removed := element.Value.(*compressedFile)
+		compressCache.lru.Remove(element)
+		delete(compressCache.files, removed.key)
+		compressCache.size -= int64(len(removed.data))
+	}
+
+	return file.data, nil
+}
+
+/**
+ * Set the headers of an encoded response. The etag of the encoded content
+ * must not be the same as the identity one.
+ */
+func setContentEncoding(w http.ResponseWriter, encoding string) {
+	w.Header().Set("Content-Encoding", encoding)
+	if etag := w.Header().Get("ETag"); len(etag) > 0 {
+		w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+encoding+`"`)
+	}
+}
+
+/**
+ * Serve a file compressed if the client accept it. A precompressed file
+ * (<name>.br or <name>.gz) is served if it exist and it's not older than the
+ * file, otherwise the file is compressed on the fly. Range requests are
+ * served with the identity encoding.
+ */
+func serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	info, err := os.Stat(name)
+	if err != nil || info.IsDir() || strings.HasSuffix(r.URL.Path, "/index.html") {
+		http.ServeFile(w, r, name)
+		return
+	}
+
+	mimeType := w.Header().Get("Content-Type")
+	if len(mimeType) == 0 {
+		mimeType = mime.TypeByExtension(filepath.Ext(name))
+	}
+
+	if !isCompressible(mimeType) || info.Size() < minCompressSize {
+		http.ServeFile(w, r, name)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	encodings := getAcceptedEncodings(r)
+	if len(r.Header.Get("Range")) == 0 {
+		for _, encoding := range contentEncodings {
+			if !acceptEncoding(encodings, encoding.name) {
+				continue
+			}
+
+			compressed, err := os.Open(name + encoding.extension)
+			if err != nil {
+				continue
+			}
+
+			compressedInfo, err := compressed.Stat()
+			if err != nil || compressedInfo.ModTime().Before(info.ModTime()) {
+				compressed.Close()
+				continue
+			}
+
+			setContentEncoding(w, encoding.name)
+			http.ServeContent(w, r, name, info.ModTime(), compressed)
+			compressed.Close()
+			return
+		}
+
+		if acceptEncoding(encodings, "gzip") && info.Size() <= maxCompressSize {
+			data, err := getCompressedContent(name, info.ModTime(), info.Size(), func() ([]byte, error) {
+				return ioutil.ReadFile(name)
+			})
+
+			if err == nil {
+				setContentEncoding(w, "gzip")
+				http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+				return
+			}
+		}
+	}
+
+	http.ServeFile(w, r, name)
+}
+
+/**
+ * Serve a content compressed if the client accept it, the key identify the
+ * content in the cache.
+ */
+func serveContent(w http.ResponseWriter, r *http.Request, key string, name string, modTime time.Time, content []byte) {
+	if len(content) >= minCompressSize {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if len(r.Header.Get("Range")) == 0 && acceptEncoding(getAcceptedEncodings(r), "gzip") {
+			data, err := getCompressedContent(key, modTime, int64(len(content)), func() ([]byte, error) {
+				return content, nil
+			})
+
+			if err == nil {
+				setContentEncoding(w, "gzip")
+				http.ServeContent(w, r, name, modTime, bytes.NewReader(data))
+				return
+			}
+		}
+	}
+
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(content))
+}
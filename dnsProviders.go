@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"github.com/globulario/services/golang/dns/dns_client"
+	"github.com/globulario/services/golang/interceptors"
+	"github.com/miekg/dns"
+)
+
+// The default time to live of the address records.
+const defaultDnsTtl = 600
+
+/**
+ * A DnsProvider keep the address of a domain up to date on a dns server or
+ * a registrar. The domain and the credentials are given by the configuration
+ * of the provider (one entry of DnsUpdateIpInfos).
+ */
+type DnsProvider interface {
+	// Set the ip v4 address (A record) of the domain.
+	SetA(ip string) error
+
+	// Set the ip v6 address (AAAA record) of the domain.
+	SetAAAA(ip string) error
+}
+
+/**
+ * Create a provider from it configuration.
+ */
+type DnsProviderFactory func(infos map[string]interface{}) (DnsProvider, error)
+
+var (
+	dnsProvidersMutex sync.RWMutex
+	dnsProviders      = make(map[string]DnsProviderFactory)
+)
+
+/**
+ * Make a provider available to the configuration, the type is the value of
+ * the Type field of the DnsUpdateIpInfos entries.
+ */
+func RegisterDnsProvider(typeName string, factory DnsProviderFactory) {
+	dnsProvidersMutex.Lock()
+	defer dnsProvidersMutex.Unlock()
+	dnsProviders[strings.ToLower(typeName)] = factory
+}
+
+func init() {
+	RegisterDnsProvider("godaddy", NewGoDaddyDnsProvider)
+	RegisterDnsProvider("cloudflare", NewCloudflareDnsProvider)
+	RegisterDnsProvider("rfc2136", NewRFC2136DnsProvider)
+	RegisterDnsProvider("globular", NewGlobularDnsProvider)
+	RegisterDnsProvider("fake", NewFakeDnsProvider)
+}
+
+/**
+ * Create the provider given by the Type of the configuration. Entries without
+ * type are GoDaddy entries (the only one supported before).
+ */
+func NewDnsProvider(infos map[string]interface{}) (DnsProvider, error) {
+	typeName := strings.ToLower(getDnsInfo(infos, "Type"))
+	if len(typeName) == 0 {
+		typeName = "godaddy"
+	}
+
+	dnsProvidersMutex.RLock()
+	factory, ok := dnsProviders[typeName]
+	dnsProvidersMutex.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no dns provider exist with type " + typeName)
+	}
+
+	return factory(infos)
+}
+
+/**
+ * Return the providers use to set the globule address: a Globular dns
+ * provider for each dns of the configuration, followed by the providers
+ * of DnsUpdateIpInfos.
+ */
+func (globule *Globule) getDnsProviders() ([]DnsProvider, error) {
+	providers := make([]DnsProvider, 0)
+
+	// Globular DNS is use to create sub-domain.
+	// ex: globular1.globular.io here globular.io is the domain and globular1 is
+	// the sub-domain.
+	for i := 0; i < len(globule.DNS); i++ {
+		provider, err := NewGlobularDnsProvider(map[string]interface{}{"Address": globule.DNS[i]})
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	// The domain must be manage by dns provider directly.
+	for i := 0; i < len(globule.DnsUpdateIpInfos); i++ {
+		infos, ok := globule.DnsUpdateIpInfos[i].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid dns update ip infos at index " + Utility.ToString(i))
+		}
+
+		provider, err := NewDnsProvider(infos)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
+
+// Return a string value of a provider configuration.
+func getDnsInfo(infos map[string]interface{}, key string) string {
+	if infos[key] == nil {
+		return ""
+	}
+	return Utility.ToString(infos[key])
+}
+
+// Return the time to live of a provider configuration.
+func getDnsTtl(infos map[string]interface{}) int {
+	if infos["Ttl"] == nil {
+		return defaultDnsTtl
+	}
+	return Utility.ToInt(infos["Ttl"])
+}
+
+// Return an error if the http response is not a success.
+func checkDnsResponse(rsp *http.Response) error {
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(rsp.Body)
+	return errors.New("dns update fail with status " + rsp.Status + " " + string(body))
+}
+
+///////////////////////////////////// GoDaddy /////////////////////////////////////
+
+/**
+ * Set the records with the GoDaddy api. The configuration contain the Key
+ * and the Secret of the api and the record url in SetA,
+ * ex: "https://api.godaddy.com/v1/domains/globular.io/records/A/@", or the
+ * Domain and the record Name (@ by default).
+ */
+type GoDaddyDnsProvider struct {
+	url    string // the url of the A record
+	urlV6  string // the url of the AAAA record
+	key    string
+	secret string
+	ttl    int
+}
+
+func NewGoDaddyDnsProvider(infos map[string]interface{}) (DnsProvider, error) {
+	provider := &GoDaddyDnsProvider{
+		url:    getDnsInfo(infos, "SetA"),
+		key:    getDnsInfo(infos, "Key"),
+		secret: getDnsInfo(infos, "Secret"),
+		ttl:    getDnsTtl(infos),
+	}
+
+	if len(provider.url) == 0 {
+		domain := getDnsInfo(infos, "Domain")
+		if len(domain) == 0 {
+			return nil, errors.New("the godaddy dns provider need a SetA url or a Domain")
+		}
+
+		name := getDnsInfo(infos, "Name")
+		if len(name) == 0 {
+			name = "@"
+		}
+		provider.url = "https://api.godaddy.com/v1/domains/" + url.PathEscape(domain) + "/records/A/" + url.PathEscape(name)
+	}
+
+	// The AAAA record url can be given by SetAAAA, otherwise it's the A record
+	// url with the AAAA type.
+	provider.urlV6 = getDnsInfo(infos, "SetAAAA")
+	if len(provider.urlV6) == 0 {
+		provider.urlV6 = strings.Replace(provider.url, "/records/A/", "/records/AAAA/", 1)
+	}
+
+	if len(provider.key) == 0 || len(provider.secret) == 0 {
+		return nil, errors.New("the godaddy dns provider need a Key and a Secret")
+	}
+
+	return provider, nil
+}
+
+func (provider *GoDaddyDnsProvider) setRecord(recordUrl string, ip string) error {
+	data, err := json.Marshal([]map[string]interface{}{{"data": ip, "ttl": provider.ttl}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, recordUrl, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	// set the request header Content-Type for json
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "sso-key "+provider.key+":"+provider.secret)
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	return checkDnsResponse(rsp)
+}
+
+func (provider *GoDaddyDnsProvider) SetA(ip string) error {
+	return provider.setRecord(provider.url, ip)
+}
+
+func (provider *GoDaddyDnsProvider) SetAAAA(ip string) error {
+	return provider.setRecord(provider.urlV6, ip)
+}
+
+///////////////////////////////////// Cloudflare /////////////////////////////////////
+
+// The cloudflare api, a variable so the tests can use a local server.
+var cloudflareApi = "https://api.cloudflare.com/client/v4"
+
+/**
+ * Set the records with the Cloudflare api. The configuration contain the
+ * api Token, the ZoneId and the record Name (the full domain name).
+ */
+type CloudflareDnsProvider struct {
+	token  string
+	zoneId string
+	name   string
+	ttl    int
+}
+
+func NewCloudflareDnsProvider(infos map[string]interface{}) (DnsProvider, error) {
+	provider := &CloudflareDnsProvider{
+		token:  getDnsInfo(infos, "Token"),
+		zoneId: getDnsInfo(infos, "ZoneId"),
+		name:   getDnsInfo(infos, "Name"),
+		ttl:    getDnsTtl(infos),
+	}
+
+	if len(provider.token) == 0 || len(provider.zoneId) == 0 || len(provider.name) == 0 {
+		return nil, errors.New("the cloudflare dns provider need a Token, a ZoneId and a Name")
+	}
+
+	return provider, nil
+}
+
+// The response of the cloudflare api.
+type cloudflareResponse struct {
+	Success bool
+	Errors  []struct {
+		Code    int
+		Message string
+	}
+	Result json.RawMessage
+}
+
+func (provider *CloudflareDnsProvider) do(method string, path string, data interface{}) (*cloudflareResponse, error) {
+	var body *bytes.Buffer
+	if data != nil {
+		data_, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(data_)
+	} else {
+		body = new(bytes.Buffer)
+	}
+
+	req, err := http.NewRequest(method, cloudflareApi+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+provider.token)
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	result := new(cloudflareResponse)
+	err = json.NewDecoder(rsp.Body).Decode(result)
+	if err != nil {
+		return nil, errors.New("invalid cloudflare response with status " + rsp.Status)
+	}
+
+	if !result.Success {
+		msg := "cloudflare request fail with status " + rsp.Status
+		for _, e := range result.Errors {
+			msg += " " + Utility.ToString(e.Code) + ": " + e.Message
+		}
+		return nil, errors.New(msg)
+	}
+
+	return result, nil
+}
+
+func (provider *CloudflareDnsProvider) setRecord(recordType string, ip string) error {
+	path := "/zones/" + url.PathEscape(provider.zoneId) + "/dns_records"
+
+	// Find the existing record if any.
+	rsp, err := provider.do(http.MethodGet, path+"?type="+recordType+"&name="+url.QueryEscape(provider.name), nil)
+	if err != nil {
+		return err
+	}
+
+	records := make([]struct{ Id string }, 0)
+	err = json.Unmarshal(rsp.Result, &records)
+	if err != nil {
+		return err
+	}
+
+	record := map[string]interface{}{"type": recordType, "name": provider.name, "content": ip, "ttl": provider.ttl}
+	if len(records) > 0 {
+		_, err = provider.do(http.MethodPut, path+"/"+url.PathEscape(records[0].Id), record)
+	} else {
+		_, err = provider.do(http.MethodPost, path, record)
+	}
+
+	return err
+}
+
+func (provider *CloudflareDnsProvider) SetA(ip string) error {
+	return provider.setRecord("A", ip)
+}
+
+func (provider *CloudflareDnsProvider) SetAAAA(ip string) error {
+	return provider.setRecord("AAAA", ip)
+}
+
+///////////////////////////////////// RFC 2136 /////////////////////////////////////
+
+/**
+ * Set the records with a dynamic update (rfc 2136) sent to a dns server. The
+ * configuration contain the Server address (host:port), the Zone, the record
+ * Name and optionaly the TsigKey, TsigSecret (base64) and TsigAlgorithm
+ * (hmac-sha256 by default) use to sign the update.
+ */
+type RFC2136DnsProvider struct {
+	server        string
+	zone          string
+	name          string
+	ttl           int
+	tsigKey       string
+	tsigSecret    string
+	tsigAlgorithm string
+}
+
+func NewRFC2136DnsProvider(infos map[string]interface{}) (DnsProvider, error) {
+	provider := &RFC2136DnsProvider{
+		server:        getDnsInfo(infos, "Server"),
+		zone:          dns.Fqdn(getDnsInfo(infos, "Zone")),
+		name:          dns.Fqdn(getDnsInfo(infos, "Name")),
+		ttl:           getDnsTtl(infos),
+		tsigKey:       getDnsInfo(infos, "TsigKey"),
+		tsigSecret:    getDnsInfo(infos, "TsigSecret"),
+		tsigAlgorithm: getDnsInfo(infos, "TsigAlgorithm"),
+	}
+
+	if len(provider.server) == 0 || provider.zone == "." || provider.name == "." {
+		return nil, errors.New("the rfc2136 dns provider need a Server, a Zone and a Name")
+	}
+
+	if _, _, err := net.SplitHostPort(provider.server); err != nil {
+		provider.server = net.JoinHostPort(provider.server, "53")
+	}
+
+	if len(provider.tsigAlgorithm) == 0 {
+		provider.tsigAlgorithm = dns.HmacSHA256
+	}
+	provider.tsigAlgorithm = dns.Fqdn(provider.tsigAlgorithm)
+
+	if len(provider.tsigKey) > 0 {
+		provider.tsigKey = dns.Fqdn(provider.tsigKey)
+	}
+
+	return provider, nil
+}
+
+func (provider *RFC2136DnsProvider) setRecord(rr dns.RR) error {
+	msg := new(dns.Msg)
+	msg.SetUpdate(provider.zone)
+	msg.RemoveRRset([]dns.RR{rr})
+	msg.Insert([]dns.RR{rr})
+
+	client := &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	if len(provider.tsigKey) > 0 {
+		msg.SetTsig(provider.tsigKey, provider.tsigAlgorithm, 300, time.Now().Unix())
+		client.TsigSecret = map[string]string{provider.tsigKey: provider.tsigSecret}
+	}
+
+	rsp, _, err := client.Exchange(msg, provider.server)
+	if err != nil {
+		return err
+	}
+
+	if rsp.Rcode != dns.RcodeSuccess {
+		return errors.New("dns update fail with code " + dns.RcodeToString[rsp.Rcode])
+	}
+
+	return nil
+}
+
+func (provider *RFC2136DnsProvider) SetA(ip string) error {
+	ip_ := net.ParseIP(ip).To4()
+	if ip_ == nil {
+		return errors.New("invalid ip v4 address " + ip)
+	}
+
+	return provider.setRecord(&dns.A{
+		Hdr: dns.RR_Header{Name: provider.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(provider.ttl)},
+		A:   ip_,
+	})
+}
+
+func (provider *RFC2136DnsProvider) SetAAAA(ip string) error {
+	ip_ := net.ParseIP(ip)
+	if ip_ == nil || ip_.To4() != nil {
+		return errors.New("invalid ip v6 address " + ip)
+	}
+
+	return provider.setRecord(&dns.AAAA{
+		Hdr:  dns.RR_Header{Name: provider.name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: uint32(provider.ttl)},
+		AAAA: ip_,
+	})
+}
+
+///////////////////////////////////// Globular /////////////////////////////////////
+
+/**
+ * Set the records on a Globular dns service. The configuration contain the
+ * Address of the dns, the globule domain is set as sub-domain of it
+ * Domain (the globule domain by default).
+ */
+type GlobularDnsProvider struct {
+	address string
+	domain  string
+	ttl     int
+}
+
+func NewGlobularDnsProvider(infos map[string]interface{}) (DnsProvider, error) {
+	provider := &GlobularDnsProvider{
+		address: getDnsInfo(infos, "Address"),
+		domain:  getDnsInfo(infos, "Domain"),
+		ttl:     getDnsTtl(infos),
+	}
+
+	if len(provider.address) == 0 {
+		return nil, errors.New("the globular dns provider need the Address of the dns")
+	}
+
+	if infos["Ttl"] == nil {
+		provider.ttl = 60
+	}
+
+	return provider, nil
+}
+
+func (provider *GlobularDnsProvider) getClient() (*dns_client.Dns_Client, string, error) {
+	dns_client_, err := dns_client.NewDnsService_Client(provider.address, "dns.DnsService")
+	if err != nil {
+		return nil, "", err
+	}
+
+	// That peer must be register on the dns to be able to generate a valid token.
+	token, err := interceptors.GenerateToken(time.Duration(globule.SessionTimeout), dns_client_.GetMac(), globule.Name, "", globule.AdminEmail)
+	if err != nil {
+		dns_client_.Close()
+		return nil, "", err
+	}
+
+	return dns_client_, token, nil
+}
+
+func (provider *GlobularDnsProvider) getDomain() string {
+	if len(provider.domain) > 0 {
+		return provider.domain
+	}
+	return globule.Domain
+}
+
+func (provider *GlobularDnsProvider) SetA(ip string) error {
+	dns_client_, token, err := provider.getClient()
+	if err != nil {
+		return err
+	}
+	defer dns_client_.Close()
+
+	// The domain is the parent domain and getDomain the sub-domain
+	_, err = dns_client_.SetA(token, provider.getDomain(), globule.getDomain(), ip, uint32(provider.ttl))
+	if err != nil {
+		return err
+	}
+
+	log.Println("address was set to ", dns_client_.GetDomain(), "for", globule.getDomain(), "with value", ip)
+	return nil
+}
+
+func (provider *GlobularDnsProvider) SetAAAA(ip string) error {
+	dns_client_, token, err := provider.getClient()
+	if err != nil {
+		return err
+	}
+	defer dns_client_.Close()
+
+	_, err = dns_client_.SetAAAA(token, provider.getDomain(), globule.getDomain(), ip, uint32(provider.ttl))
+	if err != nil {
+		return err
+	}
+
+	log.Println("ip v6 address was set to ", dns_client_.GetDomain(), "for", globule.getDomain(), "with value", ip)
+	return nil
+}
+
+///////////////////////////////////// Fake /////////////////////////////////////
+
+var (
+	fakeDnsProvidersMutex sync.Mutex
+	fakeDnsProviders      = make(map[string]*FakeDnsProvider)
+)
+
+/**
+ * Keep the records in memory, use to test the dns update without a real
+ * dns. Providers with the same Name share the same records, so a test can
+ * get them with GetFakeDnsProvider. If Error is set every update fail with
+ * that error.
+ */
+type FakeDnsProvider struct {
+	mutex   sync.Mutex
+	Name    string
+	Records map[string][]string // record type -> values in update order
+	Error   string
+}
+
+func NewFakeDnsProvider(infos map[string]interface{}) (DnsProvider, error) {
+	name := getDnsInfo(infos, "Name")
+
+	fakeDnsProvidersMutex.Lock()
+	defer fakeDnsProvidersMutex.Unlock()
+
+	provider, ok := fakeDnsProviders[name]
+	if !ok {
+		provider = &FakeDnsProvider{Name: name, Records: make(map[string][]string)}
+		fakeDnsProviders[name] = provider
+	}
+	provider.Error = getDnsInfo(infos, "Error")
+
+	return provider, nil
+}
+
+/**
+ * Return the fake provider with a given name, nil if it was never created.
+ */
+func GetFakeDnsProvider(name string) *FakeDnsProvider {
+	fakeDnsProvidersMutex.Lock()
+	defer fakeDnsProvidersMutex.Unlock()
+	return fakeDnsProviders[name]
+}
+
+func (provider *FakeDnsProvider) setRecord(recordType string, value string) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if len(provider.Error) > 0 {
+		return errors.New(provider.Error)
+	}
+
+	provider.Records[recordType] = append(provider.Records[recordType], value)
+	return nil
+}
+
+/**
+ * Return the last value set for a record type.
+ */
+func (provider *FakeDnsProvider) GetRecord(recordType string) string {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	values := provider.Records[recordType]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+func (provider *FakeDnsProvider) SetA(ip string) error {
+	return provider.setRecord("A", ip)
+}
+
+func (provider *FakeDnsProvider) SetAAAA(ip string) error {
+	return provider.setRecord("AAAA", ip)
+}
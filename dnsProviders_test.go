@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+/**
+ * A request received by a test dns api.
+ */
+type dnsTestRequest struct {
+	Method        string
+	Path          string
+	Query         string
+	Authorization string
+	Body          interface{}
+}
+
+/**
+ * Start a server that keep the requests it receive and answer them with the
+ * given handler.
+ */
+func newDnsTestServer(t *testing.T, answer func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, func() []*dnsTestRequest) {
+	var mutex sync.Mutex
+	requests := make([]*dnsTestRequest, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rqst := &dnsTestRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Authorization: r.Header.Get("Authorization")}
+		data, _ := ioutil.ReadAll(r.Body)
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &rqst.Body); err != nil {
+				t.Errorf("the body of %s %s is not json: %s", r.Method, r.URL.Path, data)
+			}
+		}
+
+		mutex.Lock()
+		requests = append(requests, rqst)
+		mutex.Unlock()
+
+		answer(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []*dnsTestRequest {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]*dnsTestRequest{}, requests...)
+	}
+}
+
+// Compare a json body with the expected value.
+func assertDnsBody(t *testing.T, rqst *dnsTestRequest, expected string) {
+	var expected_ interface{}
+	json.Unmarshal([]byte(expected), &expected_)
+
+	body, _ := json.Marshal(rqst.Body)
+	expectedBody, _ := json.Marshal(expected_)
+	if string(body) != string(expectedBody) {
+		t.Errorf("%s %s: expected body %s, got %s", rqst.Method, rqst.Path, expectedBody, body)
+	}
+}
+
+func TestGoDaddyDnsProvider(t *testing.T) {
+	server, requests := newDnsTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	provider, err := NewDnsProvider(map[string]interface{}{
+		"SetA":   server.URL + "/v1/domains/globular.io/records/A/@",
+		"Key":    "key",
+		"Secret": "secret",
+		"Ttl":    300,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.SetA("1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.SetAAAA("2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+
+	rqsts := requests()
+	if len(rqsts) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(rqsts))
+	}
+
+	for i, path := range []string{"/v1/domains/globular.io/records/A/@", "/v1/domains/globular.io/records/AAAA/@"} {
+		if rqsts[i].Method != http.MethodPut || rqsts[i].Path != path {
+			t.Errorf("expected PUT %s, got %s %s", path, rqsts[i].Method, rqsts[i].Path)
+		}
+		if rqsts[i].Authorization != "sso-key key:secret" {
+			t.Errorf("expected the sso-key authorization, got %q", rqsts[i].Authorization)
+		}
+	}
+
+	assertDnsBody(t, rqsts[0], `[{"data":"1.2.3.4","ttl":300}]`)
+	assertDnsBody(t, rqsts[1], `[{"data":"2001:db8::1","ttl":300}]`)
+}
+
+func TestGoDaddyDnsProviderError(t *testing.T) {
+	server, _ := newDnsTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"UNABLE_TO_AUTHENTICATE"}`, http.StatusUnauthorized)
+	})
+
+	provider, err := NewDnsProvider(map[string]interface{}{"Type": "godaddy", "SetA": server.URL + "/v1/domains/globular.io/records/A/@", "Key": "key", "Secret": "bad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.SetA("1.2.3.4"); err == nil {
+		t.Fatal("expected an error for an unauthorized request")
+	}
+}
+
+func TestCloudflareDnsProvider(t *testing.T) {
+	// The A record exist and the AAAA record doesn't.
+	server, requests := newDnsTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		result := "{}"
+		if r.Method == http.MethodGet {
+			result = "[]"
+			if r.URL.Query().Get("type") == "A" {
+				result = `[{"id":"record-a"}]`
+			}
+		}
+		w.Write([]byte(`{"success":true,"errors":[],"result":` + result + `}`))
+	})
+
+	previous := cloudflareApi
+	cloudflareApi = server.URL + "/client/v4"
+	defer func() { cloudflareApi = previous }()
+
+	provider, err := NewDnsProvider(map[string]interface{}{"Type": "Cloudflare", "Token": "token", "ZoneId": "zone", "Name": "globular.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.SetA("1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.SetAAAA("2001:db8::1"); err != nil {
+		t.Fatal(err)
+	}
+
+	rqsts := requests()
+	if len(rqsts) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(rqsts))
+	}
+
+	expected := []struct{ method, path, query string }{
+		{http.MethodGet, "/client/v4/zones/zone/dns_records", "type=A&name=globular.io"},
+		{http.MethodPut, "/client/v4/zones/zone/dns_records/record-a", ""},
+		{http.MethodGet, "/client/v4/zones/zone/dns_records", "type=AAAA&name=globular.io"},
+		{http.MethodPost, "/client/v4/zones/zone/dns_records", ""},
+	}
+	for i, e := range expected {
+		if rqsts[i].Method != e.method || rqsts[i].Path != e.path || rqsts[i].Query != e.query {
+			t.Errorf("expected %s %s?%s, got %s %s?%s", e.method, e.path, e.query, rqsts[i].Method, rqsts[i].Path, rqsts[i].Query)
+		}
+		if rqsts[i].Authorization != "Bearer token" {
+			t.Errorf("expected the bearer authorization, got %q", rqsts[i].Authorization)
+		}
+	}
+
+	assertDnsBody(t, rqsts[1], `{"type":"A","name":"globular.io","content":"1.2.3.4","ttl":600}`)
+	assertDnsBody(t, rqsts[3], `{"type":"AAAA","name":"globular.io","content":"2001:db8::1","ttl":600}`)
+}
+
+func TestCloudflareDnsProviderError(t *testing.T) {
+	server, _ := newDnsTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"success":false,"errors":[{"code":10000,"message":"Authentication error"}],"result":null}`))
+	})
+
+	previous := cloudflareApi
+	cloudflareApi = server.URL
+	defer func() { cloudflareApi = previous }()
+
+	provider, err := NewDnsProvider(map[string]interface{}{"Type": "cloudflare", "Token": "bad", "ZoneId": "zone", "Name": "globular.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.SetA("1.2.3.4"); err == nil {
+		t.Fatal("expected an error for an unauthorized request")
+	}
+}
+
+func TestNewDnsProviderInvalid(t *testing.T) {
+	for _, infos := range []map[string]interface{}{
+		{"Type": "unknown"},
+		{"Type": "godaddy", "Domain": "globular.io"},
+		{"Type": "cloudflare", "Token": "token"},
+	} {
+		if _, err := NewDnsProvider(infos); err == nil {
+			t.Errorf("expected an error for %v", infos)
+		}
+	}
+}
+
+func TestFakeDnsProvider(t *testing.T) {
+	g := new(Globule)
+	g.DnsUpdateIpInfos = []interface{}{map[string]interface{}{"Type": "fake", "Name": "TestFakeDnsProvider"}}
+	addresses := &IpAddresses{Public: "1.2.3.4", PublicV6: "2001:db8::1", Local: "192.168.0.2"}
+
+	err := g.registerIpToDns(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := GetFakeDnsProvider("TestFakeDnsProvider")
+	if provider == nil {
+		t.Fatal("the fake provider was not created")
+	}
+	if provider.GetRecord("A") != "1.2.3.4" || provider.GetRecord("AAAA") != "2001:db8::1" {
+		t.Fatalf("unexpected records %v", provider.Records)
+	}
+
+	// The errors of the provider are return by the registration.
+	g.DnsUpdateIpInfos = []interface{}{map[string]interface{}{"Type": "fake", "Name": "TestFakeDnsProvider", "Error": "unavailable"}}
+	if err := g.registerIpToDns(addresses); err == nil || err.Error() != "unavailable" {
+		t.Fatalf("expected the provider error, got %v", err)
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"regexp"
+	"strings"
+)
+
+// The exif tags used.
+const (
+	exifTagOrientation = 0x0112
+	exifTagExifIfd     = 0x8769
+	exifTagGpsIfd      = 0x8825
+)
+
+// The names of the exif tags of the image and exif directories that are
+// extracted, the other tags (maker notes, thumbnails...) are ignored.
+var exifTagNames = map[uint16]string{
+	0x010F: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011A: "XResolution",
+	0x011B: "YResolution",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x8298: "Copyright",
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920A: "FocalLength",
+	0xA002: "PixelXDimension",
+	0xA003: "PixelYDimension",
+	0xA405: "FocalLengthIn35mmFilm",
+	0xA406: "SceneCaptureType",
+	0xA431: "BodySerialNumber",
+	0xA433: "LensMake",
+	0xA434: "LensModel",
+}
+
+// The size of the values of each exif type, the unknown types are ignored.
+var exifTypeSizes = map[uint16]int{
+	1:  1, // byte
+	2:  1, // ascii
+	3:  2, // short
+	4:  4, // long
+	5:  8, // rational
+	6:  1, // signed byte
+	7:  1, // undefined
+	8:  2, // signed short
+	9:  4, // signed long
+	10: 8, // signed rational
+	11: 4, // float
+	12: 8, // double
+}
+
+/**
+ * An entry of an exif directory.
+ */
+type exifEntry struct {
+	tag      uint16
+	typ      uint16
+	count    int
+	position int // The position of the entry in the tiff data.
+	value    int // The position of the value in the tiff data.
+}
+
+/**
+ * The exif data of an image, the data are the tiff data of the image file so
+ * the changes are made in the file.
+ */
+type exifData struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+/**
+ * Return the position of the exif data (tiff header) in a jpeg, png or webp
+ * file, -1 if the file has no exif data. The position of the png chunk is
+ * also return, its crc must be computed again if the exif data change.
+ */
+func findExif(data []byte) (int, int, int) {
+	switch {
+	case len(data) > 4 && data[0] == 0xFF && data[1] == 0xD8:
+		// jpeg, the exif data are in the app1 segment.
+		i := 2
+		for i+4 <= len(data) && data[i] == 0xFF {
+			marker := data[i+1]
+			if marker == 0xFF {
+				i++ // fill byte.
+				continue
+			}
+			if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+				i += 2
+				continue
+			}
+			if marker == 0xDA || marker == 0xD9 {
+				break // start of the image data.
+			}
+
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			end := i + 2 + length
+			if length < 2 || end > len(data) {
+				break
+			}
+			if marker == 0xE1 && bytes.HasPrefix(data[i+4:end], []byte("Exif\x00\x00")) {
+				return i + 10, end, -1
+			}
+			i = end
+		}
+
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		// png, the exif data are in the eXIf chunk.
+		i := 8
+		for i+12 <= len(data) {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			end := i + 12 + length
+			if length < 0 || end > len(data) {
+				break
+			}
+			if string(data[i+4:i+8]) == "eXIf" {
+				return i + 8, i + 8 + length, i
+			}
+			i = end
+		}
+
+	case len(data) > 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		// webp, the exif data are in the EXIF chunk.
+		i := 12
+		for i+8 <= len(data) {
+			length := int(binary.LittleEndian.Uint32(data[i+4:]))
+			end := i + 8 + length
+			if length < 0 || end > len(data) {
+				break
+			}
+			if string(data[i:i+4]) == "EXIF" {
+				start := i + 8
+				// Some encoders keep the jpeg exif header.
+				if bytes.HasPrefix(data[start:end], []byte("Exif\x00\x00")) {
+					start += 6
+				}
+				return start, end, -1
+			}
+			i = end + length%2 // the chunks are padded to an even size.
+		}
+	}
+
+	return -1, -1, -1
+}
+
+/**
+ * Read the exif data of tiff data.
+ */
+func newExifData(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("the exif data are too small")
+	}
+
+	exif := &exifData{tiff: tiff}
+	switch string(tiff[0:4]) {
+	case "II*\x00":
+		exif.order = binary.LittleEndian
+	case "MM\x00*":
+		exif.order = binary.BigEndian
+	default:
+		return nil, errors.New("the exif data have no valid tiff header")
+	}
+
+	return exif, nil
+}
+
+/**
+ * Return the exif data of an image file, nil if the file has none.
+ */
+func readExif(data []byte) *exifData {
+	start, end, _ := findExif(data)
+	if start < 0 {
+		return nil
+	}
+
+	exif, err := newExifData(data[start:end])
+	if err != nil {
+		return nil
+	}
+
+	return exif
+}
+
+/**
+ * Return the position of the first directory.
+ */
+func (exif *exifData) root() int {
+	return int(exif.order.Uint32(exif.tiff[4:]))
+}
+
+/**
+ * Return the entries of a directory, the entries with an invalid value are
+ * ignored.
+ */
+func (exif *exifData) entries(offset int) []exifEntry {
+	entries := make([]exifEntry, 0)
+	if offset <= 0 || offset+2 > len(exif.tiff) {
+		return entries
+	}
+
+	count := int(exif.order.Uint16(exif.tiff[offset:]))
+	for i := 0; i < count; i++ {
+		position := offset + 2 + i*12
+		if position+12 > len(exif.tiff) {
+			break
+		}
+
+		entry := exifEntry{
+			tag:      exif.order.Uint16(exif.tiff[position:]),
+			typ:      exif.order.Uint16(exif.tiff[position+2:]),
+			count:    int(exif.order.Uint32(exif.tiff[position+4:])),
+			position: position,
+			value:    position + 8,
+		}
+
+		size, ok := exifTypeSizes[entry.typ]
+		if !ok || entry.count < 0 || entry.count > len(exif.tiff) {
+			continue
+		}
+
+		// The values bigger than 4 bytes are elsewhere.
+		if size*entry.count > 4 {
+			entry.value = int(exif.order.Uint32(exif.tiff[position+8:]))
+		}
+
+		if entry.value < 0 || entry.value+size*entry.count > len(exif.tiff) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+/**
+ * Return an entry of a directory, nil if it's not found.
+ */
+func (exif *exifData) find(offset int, tag uint16) *exifEntry {
+	for _, entry := range exif.entries(offset) {
+		if entry.tag == tag {
+			return &entry
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Return an integer value of an entry.
+ */
+func (exif *exifData) uint(entry *exifEntry, index int) int {
+	if index >= entry.count {
+		return 0
+	}
+
+	switch entry.typ {
+	case 1, 7:
+		return int(exif.tiff[entry.value+index])
+	case 3:
+		return int(exif.order.Uint16(exif.tiff[entry.value+index*2:]))
+	case 4:
+		return int(exif.order.Uint32(exif.tiff[entry.value+index*4:]))
+	}
+
+	return 0
+}
+
+/**
+ * Return the orientation of the image (1 to 8), 1 if it's not set.
+ */
+func (exif *exifData) orientation() int {
+	entry := exif.find(exif.root(), exifTagOrientation)
+	if entry == nil {
+		return 1
+	}
+
+	orientation := exif.uint(entry, 0)
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
+/**
+ * Return the value of an entry, a string, a number or a list of numbers.
+ * Nil is return for the undefined values.
+ */
+func (exif *exifData) value(entry *exifEntry) interface{} {
+	values := make([]interface{}, 0)
+	for i := 0; i < entry.count && i < 64; i++ {
+		switch entry.typ {
+		case 2:
+			return strings.TrimSpace(strings.TrimRight(string(exif.tiff[entry.value:entry.value+entry.count]), "\x00"))
+		case 1, 3, 4:
+			values = append(values, exif.uint(entry, i))
+		case 9:
+			values = append(values, int(int32(exif.order.Uint32(exif.tiff[entry.value+i*4:]))))
+		case 5, 10:
+			position := entry.value + i*8
+			numerator, denominator := float64(exif.order.Uint32(exif.tiff[position:])), float64(exif.order.Uint32(exif.tiff[position+4:]))
+			if entry.typ == 10 {
+				numerator, denominator = float64(int32(exif.order.Uint32(exif.tiff[position:]))), float64(int32(exif.order.Uint32(exif.tiff[position+4:])))
+			}
+			if denominator == 0 {
+				values = append(values, 0.0)
+			} else {
+				values = append(values, numerator/denominator)
+			}
+		default:
+			return nil
+		}
+	}
+
+	if len(values) == 1 {
+		return values[0]
+	}
+
+	return values
+}
+
+/**
+ * Return the named tags of the image and exif directories, the gps position
+ * is return in decimal degrees (GPSLatitude, GPSLongitude and GPSAltitude).
+ */
+func (exif *exifData) tags() map[string]interface{} {
+	tags := make(map[string]interface{})
+	directories := []int{exif.root()}
+	if entry := exif.find(exif.root(), exifTagExifIfd); entry != nil {
+		directories = append(directories, exif.uint(entry, 0))
+	}
+
+	for _, directory := range directories {
+		for _, entry := range exif.entries(directory) {
+			if name, ok := exifTagNames[entry.tag]; ok {
+				if value := exif.value(&entry); value != nil {
+					tags[name] = value
+				}
+			}
+		}
+	}
+
+	entry := exif.find(exif.root(), exifTagGpsIfd)
+	if entry == nil {
+		return tags
+	}
+
+	// The latitude and longitude are in degrees, minutes and seconds with
+	// a reference (N, S, E, W).
+	gps := make(map[uint16]*exifEntry)
+	for _, entry := range exif.entries(exif.uint(entry, 0)) {
+		entry := entry
+		gps[entry.tag] = &entry
+	}
+
+	for _, coordinate := range []struct {
+		name      string
+		reference uint16
+		value     uint16
+		negative  string
+	}{{"GPSLatitude", 1, 2, "S"}, {"GPSLongitude", 3, 4, "W"}} {
+		value, ok := gps[coordinate.value]
+		if !ok || value.typ != 5 || value.count != 3 {
+			continue
+		}
+
+		dms, _ := exif.value(value).([]interface{})
+		if len(dms) != 3 {
+			continue
+		}
+
+		degrees := dms[0].(float64) + dms[1].(float64)/60 + dms[2].(float64)/3600
+		if reference, ok := gps[coordinate.reference]; ok && exif.value(reference) == coordinate.negative {
+			degrees = -degrees
+		}
+		tags[coordinate.name] = degrees
+	}
+
+	if value, ok := gps[6]; ok && value.typ == 5 {
+		altitude, _ := exif.value(value).(float64)
+		// The altitude is below the sea level if the reference is 1.
+		if reference, ok := gps[5]; ok && exif.uint(reference, 0) == 1 {
+			altitude = -altitude
+		}
+		tags["GPSAltitude"] = altitude
+	}
+
+	return tags
+}
+
+/**
+ * Remove the gps data, the values are erased and the gps directory is
+ * removed from the first directory. The size of the data does not change.
+ * Return true if there was gps data.
+ */
+func (exif *exifData) stripGps() bool {
+	root := exif.root()
+	entry := exif.find(root, exifTagGpsIfd)
+	if entry == nil {
+		return false
+	}
+
+	// Erase the gps values and directory.
+	gps := exif.uint(entry, 0)
+	for _, value := range exif.entries(gps) {
+		size := exifTypeSizes[value.typ] * value.count
+		if size > 4 {
+			erase(exif.tiff[value.value : value.value+size])
+		}
+	}
+	if gps > 0 && gps+2 <= len(exif.tiff) {
+		end := gps + 2 + int(exif.order.Uint16(exif.tiff[gps:]))*12 + 4
+		if end > len(exif.tiff) {
+			end = len(exif.tiff)
+		}
+		erase(exif.tiff[gps:end])
+	}
+
+	// Remove the entry, the next entries and the offset of the next
+	// directory are moved.
+	count := int(exif.order.Uint16(exif.tiff[root:]))
+	end := root + 2 + count*12 + 4
+	if end > len(exif.tiff) {
+		return true
+	}
+	copy(exif.tiff[entry.position:], exif.tiff[entry.position+12:end])
+	erase(exif.tiff[end-12 : end])
+	exif.order.PutUint16(exif.tiff[root:], uint16(count-1))
+
+	return true
+}
+
+func erase(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+/**
+ * Return the orientation of an image file, 1 if it's not set.
+ */
+func getImageOrientation(data []byte) int {
+	exif := readExif(data)
+	if exif == nil {
+		return 1
+	}
+
+	return exif.orientation()
+}
+
+// The gps properties of the xmp data (ex. exif:GPSLatitude), as element or
+// as attribute of a description.
+var (
+	xmpGpsElement   = regexp.MustCompile(`<([A-Za-z_][\w.-]*:GPS[\w.-]*)[\s/>]`)
+	xmpGpsAttribute = regexp.MustCompile(`[A-Za-z_][\w.-]*:GPS[\w.-]*\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+/**
+ * Return the positions of the xmp data in a jpeg, png or webp file. The
+ * position of the png chunk is also return, its crc must be computed again if
+ * the xmp data change. The compressed png xmp data are not return.
+ */
+func findXmp(data []byte) [][3]int {
+	positions := make([][3]int, 0)
+	switch {
+	case len(data) > 4 && data[0] == 0xFF && data[1] == 0xD8:
+		// jpeg, the xmp data (and the extended xmp data) are in app1 segments.
+		i := 2
+		for i+4 <= len(data) && data[i] == 0xFF {
+			marker := data[i+1]
+			if marker == 0xFF {
+				i++ // fill byte.
+				continue
+			}
+			if marker == 0xD8 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+				i += 2
+				continue
+			}
+			if marker == 0xDA || marker == 0xD9 {
+				break // start of the image data.
+			}
+
+			length := int(binary.BigEndian.Uint16(data[i+2:]))
+			end := i + 2 + length
+			if length < 2 || end > len(data) {
+				break
+			}
+			if marker == 0xE1 {
+				for _, namespace := range []string{"http://ns.adobe.com/xap/1.0/\x00", "http://ns.adobe.com/xmp/extension/\x00"} {
+					if bytes.HasPrefix(data[i+4:end], []byte(namespace)) {
+						positions = append(positions, [3]int{i + 4 + len(namespace), end, -1})
+					}
+				}
+			}
+			i = end
+		}
+
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		// png, the xmp data are in the iTXt chunk with the XML:com.adobe.xmp
+		// keyword: keyword, 0, compression flag and method, language, 0,
+		// translated keyword, 0, text.
+		i := 8
+		for i+12 <= len(data) {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			end := i + 12 + length
+			if length < 0 || end > len(data) {
+				break
+			}
+			if string(data[i+4:i+8]) == "iTXt" {
+				text := data[i+8 : i+8+length]
+				keyword := []byte("XML:com.adobe.xmp\x00")
+				if bytes.HasPrefix(text, keyword) && len(text) > len(keyword)+2 && text[len(keyword)] == 0 {
+					start := len(keyword) + 2
+					for n := 0; n < 2 && start >= 0; n++ {
+						if next := bytes.IndexByte(text[start:], 0); next >= 0 {
+							start += next + 1
+						} else {
+							start = -1
+						}
+					}
+					if start >= 0 {
+						positions = append(positions, [3]int{i + 8 + start, i + 8 + length, i})
+					}
+				}
+			}
+			i = end
+		}
+
+	case len(data) > 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		// webp, the xmp data are in the XMP chunk.
+		i := 12
+		for i+8 <= len(data) {
+			length := int(binary.LittleEndian.Uint32(data[i+4:]))
+			end := i + 8 + length
+			if length < 0 || end > len(data) {
+				break
+			}
+			if string(data[i:i+4]) == "XMP " {
+				positions = append(positions, [3]int{i + 8, end, -1})
+			}
+			i = end + length%2 // the chunks are padded to an even size.
+		}
+	}
+
+	return positions
+}
+
+/**
+ * Remove the gps properties of xmp data, the properties are replaced by
+ * spaces so the size of the data does not change. Return true if there was
+ * gps data. A property split between two extended xmp segments is not found.
+ */
+func stripXmpGps(xmp []byte) bool {
+	stripped := false
+	for _, match := range xmpGpsElement.FindAllSubmatchIndex(xmp, -1) {
+		start := match[0]
+		if xmp[start] == ' ' {
+			continue // removed with a previous element.
+		}
+
+		end := bytes.IndexByte(xmp[start:], '>')
+		if end < 0 {
+			break
+		}
+		end += start + 1
+
+		// The element with a value or with sub elements.
+		if xmp[end-2] != '/' {
+			closing := []byte("</" + string(xmp[match[2]:match[3]]) + ">")
+			i := bytes.Index(xmp[end:], closing)
+			if i < 0 {
+				continue
+			}
+			end += i + len(closing)
+		}
+
+		blank(xmp[start:end])
+		stripped = true
+	}
+
+	for _, match := range xmpGpsAttribute.FindAllIndex(xmp, -1) {
+		blank(xmp[match[0]:match[1]])
+		stripped = true
+	}
+
+	return stripped
+}
+
+func blank(data []byte) {
+	for i := range data {
+		data[i] = ' '
+	}
+}
+
+/**
+ * Return a copy of an image file without its gps data, the gps data are
+ * removed from the exif and the xmp data. The compressed png xmp data are
+ * kept as is.
+ */
+func stripImageGps(data []byte) []byte {
+	data_ := make([]byte, len(data))
+	copy(data_, data)
+
+	start, end, chunk := findExif(data_)
+	if start >= 0 {
+		exif, err := newExifData(data_[start:end])
+		if err == nil && exif.stripGps() && chunk >= 0 {
+			// The crc of the png chunk.
+			binary.BigEndian.PutUint32(data_[end:], crc32.ChecksumIEEE(data_[chunk+4:end]))
+		}
+	}
+
+	for _, position := range findXmp(data_) {
+		start, end, chunk := position[0], position[1], position[2]
+		if stripXmpGps(data_[start:end]) && chunk >= 0 {
+			binary.BigEndian.PutUint32(data_[end:], crc32.ChecksumIEEE(data_[chunk+4:end]))
+		}
+	}
+
+	return data_
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/davecourtois/Utility"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/net/html"
+)
+
+// Only the beginning of big files is indexed.
+var maxIndexSize int64 = 10 * 1024 * 1024
+
+// The size of the text kept to create the search results snippets.
+const maxIndexContentSize = 64 * 1024
+
+// Only the best results of a search are considered, the access to the files
+// is validated for each one until the page is filled.
+const maxSearchResults = 1000
+
+// The number of characters of a search result snippet.
+const snippetSize = 160
+
+// The occurrences of a term in the title of a document are worth more.
+const titleTermBoost = 3
+
+// The keys of the index, a term key is followed by the term, a zero byte and
+// the path of the document.
+const (
+	indexDocumentKey  = "d:"
+	indexTermKey      = "t:"
+	indexContentKey   = "c:"
+	indexDocumentsKey = "s:documents"
+	indexLengthKey    = "s:length"
+)
+
+/**
+ * An indexed file.
+ */
+type IndexedFile struct {
+	Path     string // The path of the resource (ex. /users/bob/readme.md)
+	Name     string // The path of the file on the disk.
+	Title    string
+	MimeType string
+	Size     int64
+	ModTime  time.Time
+	Length   int      // The number of terms.
+	Terms    []string // The distinct terms, needed to remove the file.
+}
+
+/**
+ * A result of a file search.
+ */
+type FileSearchResult struct {
+	Path     string
+	Title    string
+	MimeType string
+	Size     int64
+	ModTime  time.Time
+	Score    float64
+	Snippet  string
+}
+
+/**
+ * An inverted index of the files content kept in a leveldb database.
+ */
+type FileIndex struct {
+	sync.Mutex // Only one file is indexed at time.
+	db         *leveldb.DB
+}
+
+var (
+	fileIndex_     *FileIndex
+	fileIndexMutex sync.Mutex
+)
+
+/**
+ * Return the index of the files, it's open the first time it's needed.
+ */
+func (globule *Globule) getFileIndex() (*FileIndex, error) {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	if fileIndex_ != nil {
+		return fileIndex_, nil
+	}
+
+	path := globule.data + "/search/files"
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		// The index can be rebuild, so I will try to recover it.
+		db, err = leveldb.RecoverFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fileIndex_ = &FileIndex{db: db}
+	return fileIndex_, nil
+}
+
+/**
+ * Close the index of the files.
+ */
+func closeFileIndex() {
+	fileIndexMutex.Lock()
+	defer fileIndexMutex.Unlock()
+
+	if fileIndex_ != nil {
+		fileIndex_.db.Close()
+		fileIndex_ = nil
+	}
+}
+
+/**
+ * Return the mime type of a file, the types of the files indexed are known
+ * even if the system has no mime types database.
+ */
+func getIndexMimeType(name string) string {
+	extension := strings.ToLower(filepath.Ext(name))
+	if mimeType := mime.TypeByExtension(extension); len(mimeType) > 0 {
+		return mimeType
+	}
+
+	switch extension {
+	case ".txt", ".text", ".log":
+		return "text/plain"
+	case ".md", ".markdown":
+		return "text/markdown"
+	case ".htm", ".html":
+		return "text/html"
+	case ".pdf":
+		return "application/pdf"
+	}
+
+	return ""
+}
+
+/**
+ * Return true if the content of a file can be indexed.
+ */
+func isIndexable(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") || strings.HasPrefix(mimeType, "application/pdf") || strings.HasPrefix(mimeType, "application/xhtml+xml")
+}
+
+/**
+ * Return the path of the resource of a file, the files are in the web root or
+ * in the files directory.
+ */
+func (globule *Globule) getResourcePath(name string) (string, error) {
+	name = filepath.ToSlash(filepath.Clean(name))
+	for _, root := range []string{globule.data + "/files", globule.webRoot} {
+		root = filepath.ToSlash(filepath.Clean(root))
+		if strings.HasPrefix(name, root+"/") {
+			return strings.TrimPrefix(name, root), nil
+		}
+	}
+
+	return "", errors.New("the file " + name + " is not a served file")
+}
+
+/**
+ * Split a text in lower case terms.
+ */
+func tokenize(text string) []string {
+	terms := make([]string, 0)
+	for _, term := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		// Very short and very long terms are not useful.
+		if utf8.RuneCountInString(term) < 2 || len(term) > 64 {
+			continue
+		}
+		terms = append(terms, strings.ToLower(term))
+	}
+
+	return terms
+}
+
+/**
+ * Return the text of an html document and its title, the scripts and styles
+ * are ignored.
+ */
+func extractHtmlText(r io.Reader) (string, string) {
+	var text strings.Builder
+	var title strings.Builder
+	skip := ""
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(title.String()), text.String()
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "noscript", "template":
+				skip = string(name)
+			case "title":
+				inTitle = true
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if string(name) == skip {
+				skip = ""
+			} else if string(name) == "title" {
+				inTitle = false
+			}
+		case html.TextToken:
+			if len(skip) > 0 {
+				continue
+			}
+			data := html.UnescapeString(string(tokenizer.Text()))
+			if inTitle {
+				title.WriteString(data)
+			} else {
+				text.WriteString(data)
+				text.WriteString(" ")
+			}
+		}
+	}
+}
+
+/**
+ * Return the title and the text of a file. The text of the pdf files is
+ * extracted with pdftotext.
+ */
+func extractText(name string, mimeType string) (string, string, error) {
+	if strings.HasPrefix(mimeType, "application/pdf") {
+		// pdftotext -enc UTF-8 file.pdf -
+		cmd := exec.Command("pdftotext", "-enc", "UTF-8", name, "-")
+
+		var out bytes.Buffer
+		var stderr bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			return "", "", errors.New(err.Error() + ": " + stderr.String())
+		}
+
+		text := out.String()
+		if int64(len(text)) > maxIndexSize {
+			text = text[:maxIndexSize]
+		}
+		return "", text, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	r := io.LimitReader(f, maxIndexSize)
+	if strings.HasPrefix(mimeType, "text/html") || strings.HasPrefix(mimeType, "application/xhtml+xml") {
+		title, text := extractHtmlText(r)
+		return title, text, nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", "", err
+	}
+
+	text := string(data)
+	title := ""
+	if strings.HasPrefix(mimeType, "text/markdown") {
+		// The title is the first heading.
+		for _, line := range strings.Split(text, "\n") {
+			if strings.HasPrefix(line, "# ") {
+				title = strings.TrimSpace(line[2:])
+				break
+			}
+		}
+	}
+
+	return title, text, nil
+}
+
+func encodeUint(value uint64) []byte {
+	data := make([]byte, binary.MaxVarintLen64)
+	return data[:binary.PutUvarint(data, value)]
+}
+
+func decodeUint(data []byte) uint64 {
+	value, _ := binary.Uvarint(data)
+	return value
+}
+
+/**
+ * Return an index statistic.
+ */
+func (index *FileIndex) getStatistic(key string) uint64 {
+	data, err := index.db.Get([]byte(key), nil)
+	if err != nil {
+		return 0
+	}
+
+	return decodeUint(data)
+}
+
+/**
+ * Return an indexed file, nil if the file is not indexed.
+ */
+func (index *FileIndex) getDocument(path string) *IndexedFile {
+	data, err := index.db.Get([]byte(indexDocumentKey+path), nil)
+	if err != nil {
+		return nil
+	}
+
+	document := new(IndexedFile)
+	if json.Unmarshal(data, document) != nil {
+		return nil
+	}
+
+	return document
+}
+
+/**
+ * Add the removal of a document to a batch. The statistics are updated with
+ * the given number of documents and length.
+ */
+func (index *FileIndex) removeDocument(batch *leveldb.Batch, document *IndexedFile, documents *uint64, length *uint64) {
+	for _, term := range document.Terms {
+		batch.Delete([]byte(indexTermKey + term + "\x00" + document.Path))
+	}
+	batch.Delete([]byte(indexDocumentKey + document.Path))
+	batch.Delete([]byte(indexContentKey + document.Path))
+
+	if *documents > 0 {
+		*documents--
+	}
+	if *length >= uint64(document.Length) {
+		*length -= uint64(document.Length)
+	}
+}
+
+/**
+ * Index a file, the previous version of the file is replaced.
+ */
+func (index *FileIndex) indexDocument(document *IndexedFile, title string, text string) error {
+	frequencies := make(map[string]uint64)
+	for _, term := range tokenize(text) {
+		frequencies[term]++
+		document.Length++
+	}
+
+	for _, term := range tokenize(title) {
+		frequencies[term] += titleTermBoost
+	}
+
+	document.Terms = make([]string, 0, len(frequencies))
+	for term := range frequencies {
+		document.Terms = append(document.Terms, term)
+	}
+
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	index.Lock()
+	defer index.Unlock()
+
+	documents := index.getStatistic(indexDocumentsKey)
+	length := index.getStatistic(indexLengthKey)
+
+	batch := new(leveldb.Batch)
+	if previous := index.getDocument(document.Path); previous != nil {
+		index.removeDocument(batch, previous, &documents, &length)
+	}
+
+	for term, frequency := range frequencies {
+		batch.Put([]byte(indexTermKey+term+"\x00"+document.Path), encodeUint(frequency))
+	}
+
+	if len(text) > maxIndexContentSize {
+		// Don't cut a character in the middle.
+		end := maxIndexContentSize
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		text = text[:end]
+	}
+
+	batch.Put([]byte(indexDocumentKey+document.Path), data)
+	batch.Put([]byte(indexContentKey+document.Path), []byte(text))
+	batch.Put([]byte(indexDocumentsKey), encodeUint(documents+1))
+	batch.Put([]byte(indexLengthKey), encodeUint(length+uint64(document.Length)))
+
+	return index.db.Write(batch, nil)
+}
+
+/**
+ * Remove a file from the index.
+ */
+func (index *FileIndex) remove(path string) error {
+	index.Lock()
+	defer index.Unlock()
+
+	document := index.getDocument(path)
+	if document == nil {
+		return nil
+	}
+
+	documents := index.getStatistic(indexDocumentsKey)
+	length := index.getStatistic(indexLengthKey)
+
+	batch := new(leveldb.Batch)
+	index.removeDocument(batch, document, &documents, &length)
+	batch.Put([]byte(indexDocumentsKey), encodeUint(documents))
+	batch.Put([]byte(indexLengthKey), encodeUint(length))
+
+	return index.db.Write(batch, nil)
+}
+
+/**
+ * Remove the files of a directory from the index.
+ */
+func (index *FileIndex) removeDir(dir string) error {
+	index.Lock()
+	defer index.Unlock()
+
+	documents := index.getStatistic(indexDocumentsKey)
+	length := index.getStatistic(indexLengthKey)
+
+	batch := new(leveldb.Batch)
+	it := index.db.NewIterator(util.BytesPrefix([]byte(indexDocumentKey+strings.TrimSuffix(dir, "/")+"/")), nil)
+	for it.Next() {
+		document := new(IndexedFile)
+		if json.Unmarshal(it.Value(), document) == nil {
+			index.removeDocument(batch, document, &documents, &length)
+		}
+	}
+	it.Release()
+
+	if batch.Len() == 0 {
+		return it.Error()
+	}
+
+	batch.Put([]byte(indexDocumentsKey), encodeUint(documents))
+	batch.Put([]byte(indexLengthKey), encodeUint(length))
+
+	return index.db.Write(batch, nil)
+}
+
+/**
+ * Call a function with each indexed file, the terms of the files are not
+ * set.
+ */
+func (index *FileIndex) forEachDocument(fn func(document *IndexedFile)) error {
+	it := index.db.NewIterator(util.BytesPrefix([]byte(indexDocumentKey)), nil)
+	defer it.Release()
+
+	for it.Next() {
+		document := new(IndexedFile)
+		if json.Unmarshal(it.Value(), document) == nil {
+			document.Terms = nil
+			fn(document)
+		}
+	}
+
+	return it.Error()
+}
+
+/**
+ * Return the frequency of a term in each file that contain it.
+ */
+func (index *FileIndex) getPostings(term string) map[string]uint64 {
+	postings := make(map[string]uint64)
+	prefix := []byte(indexTermKey + term + "\x00")
+
+	iterator := index.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iterator.Release()
+
+	for iterator.Next() {
+		postings[string(iterator.Key()[len(prefix):])] = decodeUint(iterator.Value())
+	}
+
+	return postings
+}
+
+/**
+ * Return the part of a text around the first term found.
+ */
+func (index *FileIndex) getSnippet(path string, terms []string) string {
+	data, err := index.db.Get([]byte(indexContentKey+path), nil)
+	if err != nil {
+		return ""
+	}
+
+	text := string(data)
+	start := 0
+	lower := strings.ToLower(text)
+
+	// The position can be use only if the lower case text has the same size.
+	if len(lower) == len(text) {
+		for _, term := range terms {
+			if position := strings.Index(lower, term); position >= 0 {
+				start = position - snippetSize/4
+				break
+			}
+		}
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	end := start + snippetSize
+	if end > len(text) {
+		end = len(text)
+	}
+
+	// Do not cut a word.
+	for i := 0; start > 0 && i < 16 && text[start-1] != ' ' && text[start-1] != '\n'; i++ {
+		start--
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end--
+	}
+
+	return strings.Join(strings.Fields(text[start:end]), " ")
+}
+
+/**
+ * Return the files that contain all the terms of a query, the best results
+ * first (bm25). Only the files of a directory are return if it's given.
+ */
+func (index *FileIndex) search(query string, dir string) ([]*FileSearchResult, error) {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil, errors.New("the query contains no term to search")
+	}
+
+	documents := float64(index.getStatistic(indexDocumentsKey))
+	averageLength := 1.0
+	if documents > 0 {
+		averageLength = math.Max(float64(index.getStatistic(indexLengthKey))/documents, 1)
+	}
+
+	const k1 = 1.2
+	const b = 0.75
+
+	scores := make(map[string]float64)
+	for i, term := range terms {
+		postings := index.getPostings(term)
+		idf := math.Log(1 + (documents-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+
+		scores_ := make(map[string]float64)
+		for path, frequency := range postings {
+			// All the terms must be found.
+			if _, ok := scores[path]; i > 0 && !ok {
+				continue
+			}
+			scores_[path] = scores[path] + idf*float64(frequency)*(k1+1)/(float64(frequency)+k1)
+		}
+		scores = scores_
+	}
+
+	results := make([]*FileSearchResult, 0, len(scores))
+	for path, score := range scores {
+		if len(dir) > 0 && dir != "/" && !isSubPath(dir, path) {
+			continue
+		}
+
+		document := index.getDocument(path)
+		if document == nil {
+			continue
+		}
+
+		// Normalize the score with the length of the document.
+		score = score / (1 - b + b*float64(document.Length)/averageLength)
+
+		results = append(results, &FileSearchResult{Path: path, Title: document.Title, MimeType: document.MimeType, Size: document.Size, ModTime: document.ModTime, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].Path < results[j].Path
+		}
+		return results[i].Score > results[j].Score
+	})
+
+	return results, nil
+}
+
+/**
+ * Set file indexation to be able to search text file on the server. The path
+ * is the path of the file on the disk.
+ */
+func indexFile(path string, fileType string) error {
+	if !isIndexable(fileType) {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	resource, err := globule.getResourcePath(path)
+	if err != nil {
+		return err
+	}
+
+	title, text, err := extractText(path, fileType)
+	if err != nil {
+		return err
+	}
+
+	if len(title) == 0 {
+		title = filepath.Base(path)
+	}
+
+	index, err := globule.getFileIndex()
+	if err != nil {
+		return err
+	}
+
+	document := &IndexedFile{Path: resource, Name: filepath.ToSlash(path), Title: title, MimeType: fileType, Size: info.Size(), ModTime: info.ModTime()}
+	return index.indexDocument(document, title, text)
+}
+
+/**
+ * Remove a file, or the files of a directory, from the search index, the path
+ * is the path of the file on the disk.
+ */
+func removeFileIndex(path string) error {
+	resource, err := globule.getResourcePath(path)
+	if err != nil {
+		return err
+	}
+
+	index, err := globule.getFileIndex()
+	if err != nil {
+		return err
+	}
+
+	err = index.remove(resource)
+	if err != nil {
+		return err
+	}
+
+	return index.removeDir(resource)
+}
+
+/**
+ * Search the files that contain the terms of a query (q). The search can be
+ * limited to a directory (path), the results are paginated with offset and
+ * limit. Only the files the requester can read are return, More is true if
+ * there is a next page.
+ */
+func searchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	query := r.FormValue("q")
+	dir := ""
+	if len(r.FormValue("path")) > 0 {
+		dir = cleanUploadPath(r.FormValue("path"))
+	}
+
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	index, err := globule.getFileIndex()
+	if err != nil {
+		http.Error(w, "fail to open the search index with error "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results, err := index.search(query, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	// The access is validated in the order of the results until the page
+	// and the first result of the next page are found.
+	application := r.Header.Get("application")
+	terms := tokenize(query)
+	allowed := make([]*FileSearchResult, 0, limit+1)
+	found := 0
+	for _, result := range results {
+		if found > offset+limit {
+			break
+		}
+
+		if !isPublicFile(result.Path) {
+			if _, _, hasAccess := globule.validateFileAccess(r, application, "/file.FileService/ServeFileHandler", "read", result.Path); !hasAccess {
+				continue
+			}
+		}
+
+		// The file can be deleted by another process.
+		if document := index.getDocument(result.Path); document == nil || !Utility.Exists(document.Name) {
+			index.remove(result.Path)
+			continue
+		}
+
+		if found >= offset {
+			allowed = append(allowed, result)
+		}
+		found++
+	}
+
+	more := len(allowed) > limit
+	if more {
+		allowed = allowed[:limit]
+	}
+
+	for _, result := range allowed {
+		result.Snippet = index.getSnippet(result.Path, terms)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"Query": query, "More": more, "Results": allowed})
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"gopkg.in/fsnotify.v1"
+)
+
+// The kinds of file events.
+const (
+	FileCreated  = "created"
+	FileModified = "modified"
+	FileRenamed  = "renamed"
+	FileDeleted  = "deleted"
+)
+
+// The delay to wait after the last change of a file before processing it, a
+// file is written with many events.
+var fileEventDelay = 2 * time.Second
+
+/**
+ * A change of a file. The old path is set only when the file is renamed.
+ */
+type FileEvent struct {
+	Type    string
+	Path    string
+	OldPath string
+}
+
+// A file event waiting the end of the changes of the file.
+type pendingFileEvent struct {
+	event   *FileEvent
+	updated time.Time
+}
+
+/**
+ * Watch the files of a directory and its sub-directories, the changes are
+ * merged and send to a single pipeline that process them one at time. The
+ * events of the hidden files (.hidden directories, temporary files...) are
+ * ignored. Because the system can lose events (too many changes, limit of
+ * watches...), a reconciliation function is also run periodically.
+ */
+type FileWatcher struct {
+	sync.Mutex
+	root    string
+	watcher *fsnotify.Watcher
+	pending map[string]*pendingFileEvent
+
+	// The last renamed file, the next created file is its new name.
+	renamed     string
+	renamedTime time.Time
+
+	events  chan *FileEvent
+	done    chan bool
+	workers sync.WaitGroup
+}
+
+/**
+ * Create a watcher of the files of a directory.
+ */
+func NewFileWatcher(root string) *FileWatcher {
+	return &FileWatcher{
+		root:    filepath.ToSlash(filepath.Clean(root)),
+		pending: make(map[string]*pendingFileEvent),
+		events:  make(chan *FileEvent, 1024),
+		done:    make(chan bool),
+	}
+}
+
+/**
+ * Return true if a file is hidden, its name or the name of one of its
+ * directories start with a dot.
+ */
+func isHiddenFile(path string) bool {
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		if strings.HasPrefix(name, ".") && name != "." && name != ".." {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Start the pipeline and the reconciliation, the reconciliation run at start
+ * and each delay. The error is return if the system watcher can't be
+ * created, the files are then only processed by the reconciliation.
+ */
+func (fileWatcher *FileWatcher) Start(process func(*FileEvent), reconcile func(), delay time.Duration) error {
+	// The pipeline.
+	fileWatcher.workers.Add(1)
+	go func() {
+		defer fileWatcher.workers.Done()
+		for {
+			select {
+			case evt := <-fileWatcher.events:
+				process(evt)
+			case <-fileWatcher.done:
+				return
+			}
+		}
+	}()
+
+	// Send the events to the pipeline when the files stop changing.
+	fileWatcher.workers.Add(1)
+	go func() {
+		defer fileWatcher.workers.Done()
+		ticker := time.NewTicker(fileEventDelay / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fileWatcher.flush()
+			case <-fileWatcher.done:
+				return
+			}
+		}
+	}()
+
+	// The reconciliation.
+	fileWatcher.workers.Add(1)
+	go func() {
+		defer fileWatcher.workers.Done()
+		reconcile()
+
+		ticker := time.NewTicker(delay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reconcile()
+			case <-fileWatcher.done:
+				return
+			}
+		}
+	}()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	fileWatcher.Lock()
+	fileWatcher.watcher = watcher
+	fileWatcher.Unlock()
+
+	fileWatcher.addDir(fileWatcher.root, false)
+
+	fileWatcher.workers.Add(1)
+	go func() {
+		defer fileWatcher.workers.Done()
+		for {
+			select {
+			case evt := <-watcher.Events:
+				fileWatcher.handle(evt)
+			case err := <-watcher.Errors:
+				// Events can be lost, the reconciliation will find them.
+				log.Println("files watcher error ", err)
+			case <-fileWatcher.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+/**
+ * Stop watching the files, the pending events are lost and will be found by
+ * the next reconciliation. Closing a closed watcher does nothing.
+ */
+func (fileWatcher *FileWatcher) Close() {
+	fileWatcher.Lock()
+	select {
+	case <-fileWatcher.done:
+		fileWatcher.Unlock()
+		return
+	default:
+	}
+	close(fileWatcher.done)
+
+	if fileWatcher.watcher != nil {
+		fileWatcher.watcher.Close()
+	}
+	fileWatcher.Unlock()
+
+	fileWatcher.workers.Wait()
+}
+
+/**
+ * Return true if a file is in the watched directory.
+ */
+func (fileWatcher *FileWatcher) Contains(path string) bool {
+	return isSubPath(fileWatcher.root, filepath.ToSlash(filepath.Clean(path)))
+}
+
+/**
+ * Add an event to the pipeline, the events of the same file are merged until
+ * the file stop changing.
+ */
+func (fileWatcher *FileWatcher) Notify(eventType string, path string) {
+	fileWatcher.Lock()
+	defer fileWatcher.Unlock()
+	fileWatcher.notify(&FileEvent{Type: eventType, Path: filepath.ToSlash(filepath.Clean(path))})
+}
+
+func (fileWatcher *FileWatcher) notify(evt *FileEvent) {
+	previous, ok := fileWatcher.pending[evt.Path]
+	if !ok {
+		fileWatcher.pending[evt.Path] = &pendingFileEvent{event: evt, updated: time.Now()}
+		return
+	}
+
+	previous.updated = time.Now()
+	switch evt.Type {
+	case FileDeleted:
+		if previous.event.Type == FileCreated {
+			// The file did not exist long enough to be processed.
+			delete(fileWatcher.pending, evt.Path)
+		} else if previous.event.Type == FileRenamed {
+			// The file is deleted from it old path.
+			delete(fileWatcher.pending, evt.Path)
+			fileWatcher.pending[previous.event.OldPath] = &pendingFileEvent{event: &FileEvent{Type: FileDeleted, Path: previous.event.OldPath}, updated: time.Now()}
+		} else {
+			previous.event = evt
+		}
+	case FileRenamed:
+		previous.event = evt
+	default:
+		// A file deleted and created again is modified, a created or renamed
+		// file stay created or renamed when its content change.
+		if previous.event.Type == FileDeleted {
+			previous.event = &FileEvent{Type: FileModified, Path: evt.Path}
+		}
+	}
+}
+
+/**
+ * Send the events of the files that stop changing to the pipeline.
+ */
+func (fileWatcher *FileWatcher) flush() {
+	fileWatcher.Lock()
+	events := make([]*FileEvent, 0)
+	for path, pending := range fileWatcher.pending {
+		if time.Since(pending.updated) >= fileEventDelay {
+			events = append(events, pending.event)
+			delete(fileWatcher.pending, path)
+		}
+	}
+	fileWatcher.Unlock()
+
+	for _, evt := range events {
+		select {
+		case fileWatcher.events <- evt:
+		case <-fileWatcher.done:
+			return
+		}
+	}
+}
+
+/**
+ * Watch a directory and its sub-directories. If created is true the files of
+ * the directories are created events, a directory can be moved or created
+ * with files before it's watched.
+ */
+func (fileWatcher *FileWatcher) addDir(dir string, created bool) {
+	filepath.Walk(dir, func(path_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		path_ = filepath.ToSlash(path_)
+		if isHiddenFile(strings.TrimPrefix(path_, fileWatcher.root)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			err := fileWatcher.watcher.Add(path_)
+			if err != nil {
+				log.Println("fail to watch directory", path_, "with error", err)
+			}
+		} else if created {
+			fileWatcher.Lock()
+			fileWatcher.notify(&FileEvent{Type: FileCreated, Path: path_})
+			fileWatcher.Unlock()
+		}
+
+		return nil
+	})
+}
+
+/**
+ * Transform a system event to a file event.
+ */
+func (fileWatcher *FileWatcher) handle(evt fsnotify.Event) {
+	path_ := filepath.ToSlash(filepath.Clean(evt.Name))
+	if !fileWatcher.Contains(path_) || isHiddenFile(strings.TrimPrefix(path_, fileWatcher.root)) {
+		return
+	}
+
+	switch {
+	case evt.Op&fsnotify.Create == fsnotify.Create:
+		info, err := os.Stat(path_)
+		if err != nil {
+			return
+		}
+
+		if info.IsDir() {
+			fileWatcher.addDir(path_, true)
+			return
+		}
+
+		fileWatcher.Lock()
+		defer fileWatcher.Unlock()
+
+		// The file moved from the last renamed file, the system send the
+		// old name then the new name.
+		renamed := fileWatcher.renamed
+		fileWatcher.renamed = ""
+		if len(renamed) > 0 && time.Since(fileWatcher.renamedTime) < fileEventDelay {
+			if pending, ok := fileWatcher.pending[renamed]; ok && pending.event.Type == FileDeleted {
+				delete(fileWatcher.pending, renamed)
+				fileWatcher.notify(&FileEvent{Type: FileRenamed, Path: path_, OldPath: renamed})
+				return
+			}
+		}
+
+		fileWatcher.notify(&FileEvent{Type: FileCreated, Path: path_})
+
+	case evt.Op&fsnotify.Write == fsnotify.Write:
+		fileWatcher.Lock()
+		fileWatcher.notify(&FileEvent{Type: FileModified, Path: path_})
+		fileWatcher.Unlock()
+
+	case evt.Op&fsnotify.Remove == fsnotify.Remove:
+		fileWatcher.Lock()
+		fileWatcher.notify(&FileEvent{Type: FileDeleted, Path: path_})
+		fileWatcher.Unlock()
+
+	case evt.Op&fsnotify.Rename == fsnotify.Rename:
+		// A moved directory is watched again with its new name.
+		fileWatcher.watcher.Remove(path_)
+
+		fileWatcher.Lock()
+		fileWatcher.notify(&FileEvent{Type: FileDeleted, Path: path_})
+		if pending, ok := fileWatcher.pending[path_]; ok && pending.event.Type == FileDeleted {
+			fileWatcher.renamed = path_
+			fileWatcher.renamedTime = time.Now()
+		}
+		fileWatcher.Unlock()
+	}
+}
+
+/**
+ * Return the mime type of a file, the content is read if the file has no
+ * extension.
+ */
+func getFileMimeType(path string) string {
+	mimeType := getIndexMimeType(path)
+	if len(mimeType) == 0 && len(filepath.Ext(path)) == 0 {
+		f, err := os.Open(path)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		mimeType, _ = Utility.GetFileContentType(f)
+	} else if len(mimeType) == 0 {
+		mimeType = mediaMimeTypes[strings.ToLower(filepath.Ext(path))]
+	}
+
+	return mimeType
+}
+
+/**
+ * Return the directory of the generated files (previews, streams...) of a
+ * file.
+ */
+func getGeneratedFilesDir(path_ string) string {
+	name_ := strings.TrimSuffix(filepath.Base(path_), filepath.Ext(path_))
+	return filepath.ToSlash(filepath.Dir(path_)) + "/.hidden/" + name_
+}
+
+/**
+ * Return true if a file other than the given one use the same generated
+ * files directory, a converted video and its original have the same.
+ */
+func hasGeneratedFilesSibling(path_ string) bool {
+	name_ := strings.TrimSuffix(filepath.Base(path_), filepath.Ext(path_))
+	files, err := ioutil.ReadDir(filepath.Dir(path_))
+	if err != nil {
+		return false
+	}
+
+	for _, f := range files {
+		if !f.IsDir() && f.Name() != filepath.Base(path_) && strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())) == name_ {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * Remove the generated files of a media file older than the file, they were
+ * created from a previous version of the file.
+ */
+func removeOutdatedMediaFiles(path_ string) {
+	info, err := os.Stat(path_)
+	if err != nil {
+		return
+	}
+
+	for _, dir := range []string{getVideoPreviewDir(path_), getVideoHlsDir(path_), getImageVariantsDir(path_), getMediaMetadataPath(path_)} {
+		if generated, err := os.Stat(dir); err == nil && generated.ModTime().Before(info.ModTime()) {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+/**
+ * Process a created or modified file, the file is indexed and its media jobs
+ * are added.
+ */
+func (globule *Globule) processFile(path_ string) {
+	// The file can be a script previously served.
+	invalidateRewrittenScript(filepath.Clean(path_))
+
+	fileType := getFileMimeType(path_)
+	if isIndexable(fileType) {
+		err := indexFile(path_, fileType)
+		if err != nil {
+			log.Println("fail to index file ", path_, " with error ", err)
+		}
+	} else if isMediaMimeType(fileType) {
+		removeOutdatedMediaFiles(path_)
+
+		// The metadata are already extracted if the file was moved.
+		if Utility.Exists(getMediaMetadataPath(path_)) {
+			err := globule.catalogMediaFile(path_)
+			if err != nil {
+				log.Println("fail to catalog file ", path_, " with error ", err)
+			}
+		}
+
+		globule.addMediaJobs(path_, fileType)
+	}
+}
+
+/**
+ * Remove what was created for a deleted file or directory.
+ */
+func (globule *Globule) processDeletedFile(path_ string) {
+	invalidateRewrittenScript(filepath.Clean(path_))
+
+	err := removeFileIndex(path_)
+	if err != nil {
+		log.Println("fail to remove file ", path_, " from the index with error ", err)
+	}
+
+	err = globule.removeMediaCatalog(path_)
+	if err != nil {
+		log.Println("fail to remove file ", path_, " from the media catalog with error ", err)
+	}
+
+	if globule.mediaQueue != nil {
+		globule.mediaQueue.CancelPath(path_)
+	}
+
+	// The generated files of a directory are removed with it.
+	if !hasGeneratedFilesSibling(path_) {
+		os.RemoveAll(getGeneratedFilesDir(path_))
+	}
+
+	// The size of the files removed is no longer counted.
+	globule.scheduleStorageUsageScan(strings.TrimPrefix(path_, globule.data+"/files"))
+}
+
+/**
+ * Process an event of the files pipeline.
+ */
+func (globule *Globule) processFileEvent(evt *FileEvent) {
+	switch evt.Type {
+	case FileCreated, FileModified:
+		globule.processFile(evt.Path)
+	case FileDeleted:
+		globule.processDeletedFile(evt.Path)
+	case FileRenamed:
+		// The generated files follow the file.
+		generated := getGeneratedFilesDir(evt.OldPath)
+		if Utility.Exists(generated) && !hasGeneratedFilesSibling(evt.OldPath) && !Utility.Exists(getGeneratedFilesDir(evt.Path)) {
+			err := Utility.CreateDirIfNotExist(path.Dir(getGeneratedFilesDir(evt.Path)))
+			if err == nil {
+				err = os.Rename(generated, getGeneratedFilesDir(evt.Path))
+			}
+			if err != nil {
+				log.Println("fail to move generated files of ", evt.OldPath, " with error ", err)
+			}
+		}
+
+		globule.processDeletedFile(evt.OldPath)
+		globule.processFile(evt.Path)
+
+		// The file can be moved to the directory of another subject.
+		globule.scheduleStorageUsageScan(strings.TrimPrefix(evt.Path, globule.data+"/files"))
+	}
+
+	// Tell the clients that the directory has change.
+	if strings.HasPrefix(evt.Path, globule.data+"/files/") {
+		globule.publish("reload_dir_event", []byte(path.Dir(strings.TrimPrefix(evt.Path, globule.data+"/files"))))
+	}
+}
+
+/**
+ * Find the changes missed by the files watcher: the files not indexed or
+ * indexed before their last change, the media files not processed or not
+ * cataloged and the indexed or cataloged files that no longer exist. The
+ * storage usage is computed again by the same walk.
+ */
+func (globule *Globule) reconcileFiles() {
+	start := time.Now()
+	fileWatcher := globule.fileWatcher
+	if fileWatcher == nil {
+		return
+	}
+
+	index, err := globule.getFileIndex()
+	if err != nil {
+		log.Println("fail to open the files index with error ", err)
+	}
+
+	catalog, err := globule.getMediaCatalog()
+	if err != nil {
+		log.Println("fail to open the media catalog with error ", err)
+	}
+
+	count := 0
+	changes := getStorageUsageChanges()
+	used := make(map[string]int64)
+	err = filepath.Walk(fileWatcher.root, func(path_ string, info os.FileInfo, err error) error {
+		// The walk stop with the watcher.
+		select {
+		case <-fileWatcher.done:
+			return errors.New("the file watcher is closed")
+		default:
+		}
+
+		if err != nil {
+			return nil
+		}
+
+		// The generated files are counted in the storage usage but they're
+		// not processed.
+		path_ = filepath.ToSlash(path_)
+		resource := strings.TrimPrefix(path_, fileWatcher.root)
+		if info.Mode().IsRegular() {
+			if owner := getStorageOwner(resource); len(owner) > 0 {
+				used[owner] += info.Size()
+			}
+		}
+
+		if info.IsDir() || isHiddenFile(resource) {
+			return nil
+		}
+
+		changed := false
+		mimeType := getFileMimeType(path_)
+		if isIndexable(mimeType) && index != nil {
+			resource, err := globule.getResourcePath(path_)
+			if err == nil {
+				document := index.getDocument(resource)
+				changed = document == nil || document.Size != info.Size() || !document.ModTime.Equal(info.ModTime())
+			}
+		} else if isMediaMimeType(mimeType) {
+			changed = len(globule.getMediaJobTypes(path_, mimeType)) > 0
+			if !changed && catalog != nil {
+				resource, err := globule.getResourcePath(path_)
+				if err == nil {
+					metadata := catalog.get(resource)
+					changed = metadata == nil || metadata.Size != info.Size() || !metadata.ModTime.Equal(info.ModTime())
+				}
+			}
+		}
+
+		if changed {
+			fileWatcher.Notify(FileModified, path_)
+			count++
+		}
+
+		return nil
+	})
+
+	// The storage usage of an interrupted walk is incomplete.
+	if err != nil {
+		log.Println("files reconciliation stopped with error ", err)
+		return
+	}
+
+	// The indexed files that no longer exist.
+	if index != nil {
+		deleted := make([]string, 0)
+		index.forEachDocument(func(document *IndexedFile) {
+			if !Utility.Exists(document.Name) {
+				deleted = append(deleted, document.Name)
+			}
+		})
+
+		for _, name := range deleted {
+			fileWatcher.Notify(FileDeleted, name)
+		}
+		count += len(deleted)
+	}
+
+	// The cataloged files that no longer exist.
+	if catalog != nil {
+		deleted := make([]string, 0)
+		catalog.forEach("", func(metadata *MediaMetadata) {
+			if !Utility.Exists(metadata.Name) {
+				deleted = append(deleted, metadata.Name)
+			}
+		})
+
+		for _, name := range deleted {
+			fileWatcher.Notify(FileDeleted, name)
+		}
+		count += len(deleted)
+	}
+
+	err = globule.setScannedStorageUsages(used, changes)
+	if err != nil {
+		log.Println("fail to save storage usage with error ", err)
+	}
+
+	log.Println("files reconciliation found", count, "changes in", time.Since(start))
+}
+
+/**
+ * Start watching the files of the accounts and applications.
+ */
+func (globule *Globule) startFileWatcher() {
+	root := globule.data + "/files"
+	Utility.CreateDirIfNotExist(root)
+
+	delay := time.Duration(globule.FileReconciliationDelay) * time.Second
+	if delay <= 0 {
+		delay = time.Hour
+	}
+
+	globule.fileWatcher = NewFileWatcher(root)
+	err := globule.fileWatcher.Start(globule.processFileEvent, globule.reconcileFiles, delay)
+	if err != nil {
+		log.Println("fail to watch the files with error ", err, ", the changes will be found by the reconciliation")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
@@ -11,16 +10,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/globulario/services/golang/admin/admin_client"
 	"github.com/globulario/services/golang/authentication/authentication_client"
 	"github.com/globulario/services/golang/config"
 	"github.com/globulario/services/golang/dns/dns_client"
@@ -41,10 +40,13 @@ import (
 	// Client services.
 	"github.com/davecourtois/Utility"
 	"github.com/go-acme/lego/certcrypto"
-	"github.com/go-acme/lego/challenge/http01"
+	"github.com/go-acme/lego/certificate"
+	"github.com/go-acme/lego/challenge"
+	"github.com/go-acme/lego/challenge/dns01"
+	"github.com/go-acme/lego/challenge/tlsalpn01"
 	"github.com/go-acme/lego/lego"
 	"github.com/go-acme/lego/registration"
-	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/miekg/dns"
 )
 
 // Global variable.
@@ -74,6 +76,57 @@ type Globule struct {
 	AlternateDomains []interface{} // Alternate domain for multiple domains
 	IndexApplication string        // If defined It will be use as the entry point where not application path was given in the url.
 
+	// The applications with client side routing, their index.html is return
+	// for the unknown paths (other than assets) of the application.
+	SinglePageApplications []interface{}
+
+	// The response headers of the file server, see HeaderPolicy.
+	HeaderPolicies []*HeaderPolicy
+
+	// The origins allowed to do cross origin requests, * allow all origins.
+	// If empty only the globule domains are allowed.
+	AllowedOrigins []string
+
+	// Start a grpc-web proxy process for each service. The services are
+	// also reachable with grpc-web from the http server.
+	ServiceProxies bool
+
+	// The routes of the http server to other http backends, see ProxyRoute.
+	ProxyRoutes []*ProxyRoute
+
+	// The maximum size in bytes of an uploaded file, 0 for no limit.
+	MaxUploadSize int64
+
+	// The extensions (ex. .mp4) of the files that can be uploaded, all
+	// extensions are allowed if empty. The denied extensions are never allowed.
+	AllowedUploadExtensions []string
+	DeniedUploadExtensions  []string
+
+	// The storage limits in bytes of the accounts and applications without
+	// quota, 0 for no limit.
+	DefaultAccountQuota     int64
+	DefaultApplicationQuota int64
+
+	// The storage limits of accounts, applications and organizations.
+	StorageQuotas []*StorageQuota
+
+	// The number of media jobs (video conversion...) run at the same time and
+	// the number of times a job is tried before it fail.
+	MediaWorkers     int
+	MediaJobAttempts int
+
+	// Create the hls streams (.hidden/<name>/hls/master.m3u8) of the videos.
+	HlsStreaming bool
+
+	// Keep the gps position of the images in their metadata, it can then be
+	// found with /search_media. Only the images processed after the change
+	// are affected.
+	MediaGpsMetadata bool
+
+	// The delay in seconds between the scans that find the file changes
+	// missed by the files watcher.
+	FileReconciliationDelay int
+
 	// Certificate generation variables.
 	CertExpirationDelay int
 	CertPassword        string
@@ -87,6 +140,8 @@ type Globule struct {
 	CertificateAuthorityBundle string
 	CertURL                    string
 	CertStableURL              string
+	CertRenewalDelay           int    // The number of days before expiration when the certificate must be renew.
+	AcmeDirectoryURL           string // The ACME directory, let's encrypt by default (can be set to a local pebble server for test)
 
 	// Keep the version number.
 	Version  string
@@ -105,6 +160,9 @@ type Globule struct {
 	// Update delay in second...
 	WatchUpdateDelay int
 
+	// The delay in second between ip address checks, 0 disable the check.
+	WatchIpDelay int
+
 	// DNS stuff.
 	DNS              []interface{} // Domain name server use to located the server.
 	DnsUpdateIpInfos []interface{} // The internet provader SetA info to keep ip up to date.
@@ -124,13 +182,42 @@ type Globule struct {
 	// ACME protocol registration
 	registration *registration.Resource
 
-	// exit channel.
-	exit  chan bool
-	exit_ bool
+	// Keep the http-01 challenge tokens until the ACME server validate them.
+	http01Provider *HTTPProviderGlobular
+
+	// Keep the tls-alpn-01 challenge certificates until the ACME server
+	// validate them.
+	tlsAlpn01Provider *TLSALPNProviderGlobular
+
+	// Return the public and local ip address, the network is use if nil.
+	ipLookup IpLookup
+
+	// Publish the events, the event service is use if nil.
+	publisher Publisher
+
+	// exit channel, it's closed when the server stop.
+	exit     chan bool
+	exit_    bool
+	exitOnce sync.Once
 
 	// The http server
 	http_server  *http.Server
 	https_server *http.Server
+
+	// The https certificate in use.
+	certificateStore *CertificateStore
+
+	// Send the grpc-web requests to the services.
+	grpcWebGateway *GrpcWebGateway
+
+	// Send the requests of the proxy routes to their upstreams.
+	reverseProxy *ReverseProxy
+
+	// The video conversions and other media processing.
+	mediaQueue *MediaQueue
+
+	// Send the changes of the files to the indexation and media processing.
+	fileWatcher *FileWatcher
 }
 
 /**
@@ -151,6 +238,11 @@ func NewGlobule() *Globule {
 	g.PortHttp = 80              // The default http port
 	g.PortHttps = 443            // The default https port number
 	g.PortsRange = "10000-10100" // The default port range.
+	g.ServiceProxies = true      // The services are reachable by their proxy port.
+	g.MediaWorkers = 1           // ffmpeg use all the cores.
+	g.MediaJobAttempts = 3
+	g.HlsStreaming = true
+	g.FileReconciliationDelay = 60 * 60 // one hour.
 
 	// Set the default checksum...
 	g.Protocol = "http"
@@ -158,12 +250,15 @@ func NewGlobule() *Globule {
 
 	// set default values.
 	g.CertExpirationDelay = 365
+	g.CertRenewalDelay = 30 // renew a month before the let's encrypt certificate expire.
+	g.AcmeDirectoryURL = lego.LEDirectoryProduction
 	g.CertPassword = "1111"
 	g.AdminEmail = "root@globular.app"
 	g.RootPassword = "adminadmin"
 
 	// keep up to date by default.
 	g.WatchUpdateDelay = 30 // seconds...
+	g.WatchIpDelay = 60     // seconds...
 	g.SessionTimeout = 15 * 60 * 1000
 
 	// Keep in global var to by http handlers.
@@ -186,12 +281,55 @@ func NewGlobule() *Globule {
 	// Handle the signing certificate function.
 	http.HandleFunc("/sign_ca_certificate", signCaCertificateHandler)
 
+	// Create a one time secret use by a client to get it certificate.
+	http.HandleFunc("/create_enrollment_secret", createEnrollmentSecretHandler)
+
+	// Return the list of certificates signed by the ca.
+	http.HandleFunc("/get_issued_certificates", getIssuedCertificatesHandler)
+
+	// Revoke a certificate signed by the ca.
+	http.HandleFunc("/revoke_certificate", revokeCertificateHandler)
+
+	// Return the list of revoked certificates.
+	http.HandleFunc("/get_ca_crl", getCaCrlHandler)
+
+	// Answer certificate status requests.
+	http.HandleFunc("/ocsp", ocspHandler)
+	http.HandleFunc("/ocsp/", ocspHandler)
+
 	// Start listen for http request.
 	http.HandleFunc("/", ServeFileHandler)
 
 	// The file upload handler.
 	http.HandleFunc("/uploads", FileUploadHandler)
 
+	// Resumable upload with the tus protocol.
+	http.HandleFunc(tusUploadPath, tusUploadHandler)
+
+	// The storage usage and quotas.
+	http.HandleFunc("/get_storage_usage", getStorageUsageHandler)
+	http.HandleFunc("/set_storage_quota", setStorageQuotaHandler)
+	http.HandleFunc("/scan_storage_usage", scanStorageUsageHandler)
+
+	// Search the content of the files.
+	http.HandleFunc("/search_files", searchFilesHandler)
+
+	// The media processing jobs.
+	http.HandleFunc("/get_media_jobs", getMediaJobsHandler)
+	http.HandleFunc("/cancel_media_job", cancelMediaJobHandler)
+
+	// Search the metadata of the media files (duration, tags, exif...).
+	http.HandleFunc("/search_media", searchMediaHandler)
+
+	// Answer the let's encrypt http-01 challenge.
+	g.http01Provider = NewHTTPProviderGlobular()
+	g.tlsAlpn01Provider = NewTLSALPNProviderGlobular()
+
+	// The grpc-web requests are sent to the services.
+	g.grpcWebGateway = NewGrpcWebGateway()
+	g.reverseProxy = NewReverseProxy()
+	http.HandleFunc(http01ChallengePath, g.http01Provider.ServeHTTP)
+
 	g.path, _ = filepath.Abs(filepath.Dir(os.Args[0]))
 
 	if Utility.Exists(g.path+"/bin/grpcwebproxy") || Utility.Exists(g.path+"/bin/grpcwebproxy.exe") {
@@ -240,7 +378,9 @@ func (globule *Globule) getConfig() map[string]interface{} {
  * Save the configuration
  */
 func (globule *Globule) saveConfig() error {
+	storageQuotasLock.RLock()
 	jsonStr, err := Utility.ToJson(globule)
+	storageQuotasLock.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -268,7 +408,7 @@ func (globule *Globule) GetRegistration() *registration.Resource {
 }
 
 /**
- * That function must be use to generate public 
+ * That function must be use to generate public
  */
 
 /**
@@ -289,120 +429,193 @@ func (globule *Globule) GetPrivateKey() crypto.PrivateKey {
 	return privateKey
 }
 
-/** That interface withe the let's encrypt DNS chanlenge. **/
+/**
+ * That interface withe the let's encrypt DNS chanlenge. The TXT record is
+ * written in every dns of the configuration, so the challenge can be
+ * validated by any of them.
+ */
 type DNSProviderGlobularDNS struct {
-	apiAuthToken string
 }
 
-func NewDNSProviderGlobularDNS(apiAuthToken string) (*DNSProviderGlobularDNS, error) {
-	return &DNSProviderGlobularDNS{apiAuthToken: apiAuthToken}, nil
+func NewDNSProviderGlobularDNS() (*DNSProviderGlobularDNS, error) {
+	if len(globule.DNS) == 0 {
+		return nil, errors.New("no dns is configured to answer the dns-01 challenge")
+	}
+
+	return &DNSProviderGlobularDNS{}, nil
 }
 
-func (d *DNSProviderGlobularDNS) Present(domain, token, keyAuth string) error {
-	key, value := dns01.GetRecord(domain, keyAuth)
-	log.Println("try to set key:",key, "with value:", value)
+/**
+ * Set or remove the TXT record on each dns.
+ */
+func (d *DNSProviderGlobularDNS) setText(key string, value string, remove bool) error {
+	errs := make([]string, 0)
+	for i := 0; i < len(globule.DNS); i++ {
+		address := Utility.ToString(globule.DNS[i])
+		err := func() error {
+			dns_client_, err := dns_client.NewDnsService_Client(address, "dns.DnsService")
+			if err != nil {
+				return err
+			}
+			defer dns_client_.Close()
+
+			token, err := globule.getLocalToken(address)
+			if err != nil {
+				return err
+			}
+
+			if remove {
+				return dns_client_.RemoveText(token, key)
+			}
+
+			return dns_client_.SetText(token, key, []string{value}, 30)
+		}()
 
-	if len(globule.DNS) > 0 {
-		dns_client_, err := dns_client.NewDnsService_Client(globule.DNS[0].(string), "dns.DnsService")
-		if err != nil {
-			return err
-		}
-		token, err := globule.getLocalToken(globule.DNS[0].(string))
-		if err != nil {
-			return err
-		}
-		err = dns_client_.SetText(token,key, []string{ value}, 30)
 		if err != nil {
-			log.Println("fail to set let's encrypt dns chalenge key with error ", err)
-			return err
+			log.Println("fail to update let's encrypt dns chalenge key on", address, "with error ", err)
+			errs = append(errs, address+": "+err.Error())
 		}
+	}
 
-		// make API request to set a TXT record on fqdn with value and TTL
-		log.Println("dns key was set in the server ", globule.DNS[0])
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
 	}
 
 	return nil
 }
 
+func (d *DNSProviderGlobularDNS) Present(domain, token, keyAuth string) error {
+	key, value := dns01.GetRecord(domain, keyAuth)
+	log.Println("try to set key:", key, "with value:", value)
+	return d.setText(key, value, false)
+}
+
 func (d *DNSProviderGlobularDNS) CleanUp(domain, token, keyAuth string) error {
 	// clean up any state you created in Present, like removing the TXT record
-	
 	key, value := dns01.GetRecord(domain, keyAuth)
 	log.Println("clean up value key:", key, "value: ", value)
+	return d.setText(key, value, true)
+}
 
-	if len(globule.DNS) > 0 {
-		dns_client_, err := dns_client.NewDnsService_Client(globule.DNS[0].(string), "dns.DnsService")
-		if err != nil {
-			return err
-		}
+/**
+ * The time to wait for the record propagation.
+ */
+func (d *DNSProviderGlobularDNS) Timeout() (timeout, interval time.Duration) {
+	return dnsPropagationTimeout, dnsPropagationInterval
+}
 
-		token, err := globule.getLocalToken(globule.DNS[0].(string))
+/**
+ * Test if the TXT record can be read from each dns before the ACME server
+ * is ask to validate the challenge.
+ */
+func (d *DNSProviderGlobularDNS) checkPropagation(domain, fqdn, value string, check dns01.PreCheckFunc) (bool, error) {
+	for i := 0; i < len(globule.DNS); i++ {
+		address := Utility.ToString(globule.DNS[i])
+		host, _, err := net.SplitHostPort(address)
 		if err != nil {
-			return err
+			host = address
 		}
 
-		err = dns_client_.RemoveText(token, key)
-		if err != nil {
-			log.Println("fail to remove challenge key with error ", err)
-			return err
+		found, err := hasTxtRecord(net.JoinHostPort(host, "53"), fqdn, value)
+		if err != nil || !found {
+			log.Println("the TXT record", fqdn, "is not yet propagated to", host)
+			return false, nil
 		}
+	}
+
+	return true, nil
+}
 
-		// make API request to set a TXT record on fqdn with value and TTL
-		log.Println("dns key was remove from the server ", globule.DNS[0])
+/**
+ * Test if a name server return a given TXT record value.
+ */
+func hasTxtRecord(nameserver string, fqdn string, value string) (bool, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
+
+	client := &dns.Client{Timeout: 10 * time.Second}
+	rsp, _, err := client.Exchange(msg, nameserver)
+	if err != nil {
+		return false, err
 	}
-	return nil
+
+	for _, rr := range rsp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
 
 /**
- * That function work correctly, but the DNS fail time to time to give the
- * IP address that result in a fail request... The DNS must be fix!
+ * Create a new ACME client that answer the challenges of a given type and
+ * the account registration.
  */
-func (globule *Globule) obtainCertificateForCsr() error {
+func (globule *Globule) getAcmeClient(challengeType challenge.Type) (*lego.Client, error) {
 	config := lego.NewConfig(globule)
 	config.Certificate.KeyType = certcrypto.RSA2048
+	if len(globule.AcmeDirectoryURL) > 0 {
+		config.CADirURL = globule.AcmeDirectoryURL
+	}
 
 	client, err := lego.NewClient(config)
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil, err
 	}
-	// Dns registration will be use in case dns service are available.
-	if len(globule.DNS) > 0 {
 
-		// Get the local token.
-		token, err := globule.getLocalToken(globule.DNS[0].(string))
+	switch challengeType {
+	case challenge.DNS01:
+		// Dns registration will be use in case dns service are available.
+		globularDNS, err := NewDNSProviderGlobularDNS()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		globularDNS, err := NewDNSProviderGlobularDNS(token)
+		err = client.Challenge.SetDNS01Provider(globularDNS, dns01.WrapPreCheck(globularDNS.checkPropagation))
 		if err != nil {
-			log.Println(err)
-			return err
+			return nil, err
 		}
-
-		client.Challenge.SetDNS01Provider(globularDNS)
-
-	} else {
-		err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", strconv.Itoa(globule.PortHttp)))
+	case challenge.HTTP01:
+		// The challenge is answer by the http server itself so it can be
+		// done while the server is running.
+		err = client.Challenge.SetHTTP01Provider(globule.http01Provider)
 		if err != nil {
-			log.Println(err)
-			log.Fatal(err)
+			return nil, err
+		}
+	case challenge.TLSALPN01:
+		// The challenge is answer by the https server if it's running,
+		// otherwise by a temporary server on the https port.
+		var provider challenge.Provider = globule.tlsAlpn01Provider
+		if globule.certificateStore == nil {
+			provider = tlsalpn01.NewProviderServer("", strconv.Itoa(globule.PortHttps))
 		}
-	}
 
-	if err != nil {
-		log.Println(err)
-		return err
+		err = client.Challenge.SetTLSALPN01Provider(provider)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("no provider exist for challenge " + challengeType.String())
 	}
 
 	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
 	globule.registration = reg
 	if err != nil {
 		log.Println(err)
-		return err
+		return nil, err
 	}
 
+	return client, nil
+}
+
+/**
+ * That function work correctly, but the DNS fail time to time to give the
+ * IP address that result in a fail request... The DNS must be fix!
+ */
+func (globule *Globule) obtainCertificateForCsr() error {
+
 	csrPem, err := ioutil.ReadFile(globule.creds + "/server.csr")
 	if err != nil {
 		log.Println(err)
@@ -415,75 +628,48 @@ func (globule *Globule) obtainCertificateForCsr() error {
 		log.Println(err)
 		return err
 	}
-	
-	resource, err := client.Certificate.ObtainForCSR(*rqstForCsr, true)
+
+	domains := append([]string{rqstForCsr.Subject.CommonName}, rqstForCsr.DNSNames...)
+	resource, err := globule.acmeRequest(domains, func(client *lego.Client) (*certificate.Resource, error) {
+		return client.Certificate.ObtainForCSR(*rqstForCsr, true)
+	})
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	// Keep certificates url in the config.
-	globule.CertURL = resource.CertURL
-	globule.CertStableURL = resource.CertStableURL
+	return globule.saveCertificateResource(resource)
+}
 
-	// Set the certificates paths...
-	globule.Certificate = globule.getDomain() + ".crt"
-	globule.CertificateAuthorityBundle = globule.getDomain() + ".issuer.crt"
+/**
+ * Return the certificate authority use to sign client certificates.
+ */
+func (globule *Globule) getCertificateAuthority() (*CertificateAuthority, error) {
+	ca, err := NewCertificateAuthority(globule.creds, globule.CertPassword)
+	if err != nil {
+		return nil, err
+	}
 
-	// Save the certificate in the cerst folder.
-	ioutil.WriteFile(globule.creds+"/"+globule.Certificate, resource.Certificate, 0400)
-	ioutil.WriteFile(globule.creds+"/"+globule.CertificateAuthorityBundle, resource.IssuerCertificate, 0400)
+	// Tell clients where to validate their certificates.
+	ca.CrlURL = globule.getUrl() + "/get_ca_crl"
+	ca.OcspURL = globule.getUrl() + "/ocsp"
 
-	// save the config with the values.
-	return globule.saveConfig()
+	return ca, nil
 }
 
-func (globule *Globule) signCertificate(client_csr string) (string, error) {
-
-	// first of all I will save the incomming file into a temporary file...
-	client_csr_path := os.TempDir() + "/" + Utility.RandomUUID()
-	err := ioutil.WriteFile(client_csr_path, []byte(client_csr), 0644)
-	if err != nil {
-		return "", err
-
-	}
+/**
+ * Sign a client certificate request with the server certificate authority.
+ * The request must respect the certificate policy and it's written in the
+ * audit log.
+ */
+func (globule *Globule) signCertificate(client_csr string, audit *CertificateAudit) (string, error) {
 
-	client_crt_path := os.TempDir() + "/" + Utility.RandomUUID()
-
-	cmd := "openssl"
-	args := make([]string, 0)
-	args = append(args, "x509")
-	args = append(args, "-req")
-	args = append(args, "-passin")
-	args = append(args, "pass:"+globule.CertPassword)
-	args = append(args, "-days")
-	args = append(args, Utility.ToString(globule.CertExpirationDelay))
-	args = append(args, "-in")
-	args = append(args, client_csr_path)
-	args = append(args, "-CA")
-	args = append(args, globule.creds+"/ca.crt") // use certificate
-	args = append(args, "-CAkey")
-	args = append(args, globule.creds+"/ca.key") // and private key to sign the incommin csr
-	args = append(args, "-set_serial")
-	args = append(args, "01")
-	args = append(args, "-out")
-	args = append(args, client_crt_path)
-	args = append(args, "-extfile")
-	args = append(args, globule.creds+"/san.conf")
-	args = append(args, "-extensions")
-	args = append(args, "v3_req")
-	err = exec.Command(cmd, args...).Run()
+	ca, err := globule.getCertificateAuthority()
 	if err != nil {
 		return "", err
 	}
 
-	// I will read back the crt file.
-	client_crt, err := ioutil.ReadFile(client_crt_path)
-
-	// remove the tow temporary files.
-	defer os.Remove(client_crt_path)
-	defer os.Remove(client_csr_path)
-
+	client_crt, err := ca.SignCertificateRequest([]byte(client_csr), globule.CertExpirationDelay, globule.getCertificatePolicy(), audit)
 	if err != nil {
 		return "", err
 	}
@@ -499,6 +685,13 @@ func (globule *Globule) initDirectories() error {
 	// DNS info.
 	globule.DNS = make([]interface{}, 0)
 	globule.DnsUpdateIpInfos = make([]interface{}, 0)
+	globule.SinglePageApplications = make([]interface{}, 0)
+	globule.HeaderPolicies = make([]*HeaderPolicy, 0)
+	globule.AllowedOrigins = make([]string, 0)
+	globule.ProxyRoutes = make([]*ProxyRoute, 0)
+	globule.AllowedUploadExtensions = make([]string, 0)
+	globule.DeniedUploadExtensions = make([]string, 0)
+	globule.StorageQuotas = make([]*StorageQuota, 0)
 
 	// Set the list of discorvery service avalaible...
 	globule.Discoveries = make([]string, 0)
@@ -570,11 +763,6 @@ func (globule *Globule) initDirectories() error {
 		</html>`), 0644)
 	}
 
-	// Convert video file if there some to be convert.
-	go func() {
-		convertVideo() // call once and at each minutes....
-	}()
-
 	// Process templates..
 	//initHtmlFiles(globule.templates)
 
@@ -594,6 +782,9 @@ func (globule *Globule) startServices() error {
 	}
 
 	// So here here I will set tls info...
+	if globule.Protocol == "https" {
+		globule.startRevocationListRefresh()
+	}
 
 	// I will try to get the services manager configuration from the
 	// services configurations list.
@@ -607,6 +798,11 @@ func (globule *Globule) startServices() error {
 			services[i]["CertFile"] = globule.creds + "/client.crt"
 			services[i]["CertAuthorityTrust"] = globule.creds + "/ca.crt"
 
+			// The revoked certificates, the file is kept up to date by
+			// startRevocationListRefresh and it's also served at /get_ca_crl.
+			services[i]["CertificateRevocationList"] = globule.creds + "/ca.crl"
+			services[i]["CertificateRevocationListUrl"] = globule.getUrl() + "/get_ca_crl"
+
 			if services[i]["CertificateAuthorityBundle"] != nil {
 				services[i]["CertificateAuthorityBundle"] = globule.CertificateAuthorityBundle
 			}
@@ -626,9 +822,12 @@ func (globule *Globule) startServices() error {
 		// Create the service process.
 		err = process.StartServiceProcess(services[i], globule.PortsRange)
 		if err == nil {
-			err = process.StartServiceProxyProcess(services[i], globule.CertificateAuthorityBundle, globule.Certificate, globule.PortsRange)
-			if err != nil {
-				log.Println("fail to start proxy for service ", services[i]["Name"])
+			// The proxy is not needed by clients that use the http server.
+			if globule.ServiceProxies {
+				err = process.StartServiceProxyProcess(services[i], globule.CertificateAuthorityBundle, globule.Certificate, globule.PortsRange)
+				if err != nil {
+					log.Println("fail to start proxy for service ", services[i]["Name"])
+				}
 			}
 		} else {
 			log.Println("fail to start service ", services[i]["Name"])
@@ -647,7 +846,7 @@ func (globule *Globule) startServices() error {
 
 	// recreate a new local token.
 	log.Println("services are started")
-	
+
 	return nil
 }
 
@@ -671,18 +870,43 @@ func (globule *Globule) startRefreshLocalTokens() {
 	}()
 }
 
+/**
+ * Tell every loop that listen to the exit channel to stop. The channel is
+ * closed so all listeners receive it, it can be call more than once. It's
+ * the only place where the exit channel is closed.
+ */
+func (globule *Globule) closeExit() {
+	globule.exitOnce.Do(func() {
+		globule.exit_ = true
+		close(globule.exit)
+	})
+}
+
 /**
  * Stop all services.
  */
 func (globule *Globule) stopServices() error {
+	// Stop the background loops.
+	globule.closeExit()
+
+	globule.grpcWebGateway.Close()
+
+	// The watcher and the media jobs write in the index and the catalog, they
+	// must be stopped before the databases are closed.
+	if globule.fileWatcher != nil {
+		globule.fileWatcher.Close()
+	}
+	if globule.mediaQueue != nil {
+		globule.mediaQueue.Close()
+	}
+	closeFileIndex()
+	closeMediaCatalog()
+
 	services, err := config.GetServicesConfigurations()
 	if err != nil {
 		return err
 	}
 
-	// exit channel.
-	globule.exit <- true
-
 	for i := 0; i < len(services); i++ {
 		process.KillServiceProcess(services[i])
 	}
@@ -698,6 +922,21 @@ func (globule *Globule) Serve() error {
 	// Initialyse directories.
 	globule.initDirectories()
 
+	// The storage used by the accounts and applications, it's computed
+	// again by the files reconciliation.
+	globule.loadStorageUsage()
+
+	// Convert video file if there some to be convert.
+	if err := globule.startMediaQueue(); err != nil {
+		log.Println("fail to start the media queue with error ", err)
+	}
+
+	// Index and process the files when they change.
+	globule.startFileWatcher()
+
+	// Remove the resumable uploads that are abandoned.
+	globule.startTusUploadsCleanup()
+
 	// Start microservice manager.
 	globule.startServices()
 
@@ -713,19 +952,7 @@ func (globule *Globule) Serve() error {
 		return err
 	}
 
-	url := globule.Protocol + "://" + globule.getDomain()
-
-	if globule.Protocol == "https" {
-		if globule.PortHttps != 443 {
-			url += ":" + Utility.ToString(globule.PortHttps)
-		}
-	} else if globule.Protocol == "http" {
-		if globule.PortHttp != 80 {
-			url += ":" + Utility.ToString(globule.PortHttp)
-		}
-	}
-
-	log.Println("globular version " + globule.Version + " build " + Utility.ToString(globule.Build) + " listen at address " + url)
+	log.Println("globular version " + globule.Version + " build " + Utility.ToString(globule.Build) + " listen at address " + globule.getUrl())
 
 	if err != nil {
 		return err
@@ -749,108 +976,84 @@ func (globule *Globule) getDomain() string {
 }
 
 /**
- * Set the ip for a given domain or sub-domain
+ * Return the url of the server.
  */
-func (globule *Globule) registerIpToDns() error {
-
-	// Globular DNS is use to create sub-domain.
-	// ex: globular1.globular.io here globular.io is the domain and globular1 is
-	// the sub-domain. Domain must be manage by dns provider directly, by using
-	// the DnsSetA (set ip api call)... see the next part of that function
-	// for more information.
-	if globule.DNS != nil {
-		if len(globule.DNS) > 0 {
-			for i := 0; i < len(globule.DNS); i++ {
-				log.Println("get ressource client")
-
-				dns_client_, err := dns_client.NewDnsService_Client(globule.DNS[i].(string), "dns.DnsService")
-				if err != nil {
-					return err
-				}
-
-				// Here the token must be generated for the dns server...
-
-				// That peer must be register on the dns to be able to generate a valid token.
-				token, err := interceptors.GenerateToken(time.Duration(globule.SessionTimeout), dns_client_.GetMac(), globule.Name, "", globule.AdminEmail)
-				
-				if err != nil {
-					fmt.Println(err)
-					return err
-				}
-
-				// The domain is the parent domain and getDomain the sub-domain
-				_, err = dns_client_.SetA(token, globule.Domain, globule.getDomain(), Utility.MyIP(), 60)
-
-				if err != nil {
-					// return the setA error
-					fmt.Println(err)
-					return err
-				}
-
-				log.Println("address was set to ", dns_client_.GetDomain(), "for", globule.getDomain(), "with value",Utility.MyIP() )
+func (globule *Globule) getUrl() string {
+	url := globule.Protocol + "://" + globule.getDomain()
 
-				// TODO also register the ipv6 here...
-				dns_client_.Close()
-			}
+	if globule.Protocol == "https" {
+		if globule.PortHttps != 443 {
+			url += ":" + Utility.ToString(globule.PortHttps)
+		}
+	} else if globule.Protocol == "http" {
+		if globule.PortHttp != 80 {
+			url += ":" + Utility.ToString(globule.PortHttp)
 		}
 	}
 
-	// Here If the DNS provides has api to update the ip address I will use it.
-	for i := 0; i < len(globule.DnsUpdateIpInfos); i++ {
-
-		// the api call "https://api.godaddy.com/v1/domains/globular.io/records/A/@"
-		setA := globule.DnsUpdateIpInfos[i].(map[string]interface{})["SetA"].(string)
-		key := globule.DnsUpdateIpInfos[i].(map[string]interface{})["Key"].(string)
-		secret := globule.DnsUpdateIpInfos[i].(map[string]interface{})["Secret"].(string)
+	return url
+}
 
-		// set the data to the actual ip address.
-		data := `[{"data":"` + Utility.MyIP() + `"}]`
+/**
+ * Set the ip addresses for a given domain or sub-domain
+ */
+func (globule *Globule) registerIpToDns(addresses *IpAddresses) error {
 
-		// initialize http client
-		client := &http.Client{}
+	// The globular dns providers are use to create sub-domain and the others
+	// providers (godaddy, cloudflare...) to set the domain address directly.
+	providers, err := globule.getDnsProviders()
+	if err != nil {
+		return err
+	}
 
-		// set the HTTP method, url, and request body
-		req, err := http.NewRequest(http.MethodPut, setA, bytes.NewBuffer([]byte(data)))
+	for i := 0; i < len(providers); i++ {
+		err := providers[i].SetA(addresses.Public)
 		if err != nil {
+			log.Println("fail to set ip address with error ", err)
 			return err
 		}
 
-		// set the request header Content-Type for json
-		req.Header.Set("Content-Type", "application/json; charset=utf-8")
-		req.Header.Set("Authorization", "sso-key "+key+":"+secret)
-
-		// execute the request.
-		_, err = client.Do(req)
-		if err != nil {
-			return (err)
+		// Dual stack computer are also reachable by their ip v6 address.
+		if len(addresses.PublicV6) > 0 {
+			err := providers[i].SetAAAA(addresses.PublicV6)
+			if err != nil {
+				log.Println("fail to set ip v6 address with error ", err)
+				return err
+			}
 		}
-
 	}
+
 	domains := globule.AlternateDomains
 
+	ips := []string{addresses.Public}
+	if len(addresses.PublicV6) > 0 {
+		ips = append(ips, addresses.PublicV6)
+	}
+
 	for i := 0; i < len(domains); i++ {
-		if !testDomainIp(domains[i].(string), Utility.MyIP(), 3) {
-			return errors.New("The domain " + domains[i].(string) + "is not associated with ip " + Utility.MyIP())
+		if !testDomainIp(domains[i].(string), ips, 3) {
+			return errors.New("The domain " + domains[i].(string) + "is not associated with ip " + strings.Join(ips, " or "))
 		}
 	}
 
 	return nil
 }
 
-// Test if a domain is asscociated with a given ip.
-func testDomainIp(domain string, ip string, try int) bool {
+// Test if a domain is asscociated with one of the given ips (v4 or v6).
+func testDomainIp(domain string, ips []string, try int) bool {
 	if try == 0 {
 		return false
 	}
 
-	if Utility.DomainHasIp(domain, Utility.MyIP()) {
-		return true
-	} else {
-		time.Sleep(5 * time.Second)
-		try--
-		return testDomainIp(domain, ip, try)
+	for i := 0; i < len(ips); i++ {
+		if Utility.DomainHasIp(domain, ips[i]) {
+			return true
+		}
 	}
 
+	time.Sleep(5 * time.Second)
+	try--
+	return testDomainIp(domain, ips, try)
 }
 
 /**
@@ -989,27 +1192,90 @@ func logListener(evt *eventpb.Event) {
 	}
 }
 
+/**
+ * Listen on a port of the ip v4 and the ip v6 addresses. The ip v6 listener
+ * is not created if ip v6 is not available.
+ */
+func listenDualStack(port int) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0)
+
+	l, err := net.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	listeners = append(listeners, l)
+
+	// tcp6 listener accept ip v6 connections only.
+	l, err = net.Listen("tcp6", "[::]:"+strconv.Itoa(port))
+	if err != nil {
+		log.Println("fail to listen on ip v6 port", port, "with error", err)
+	} else {
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+/**
+ * Serve http request from each listeners.
+ */
+func serve(server *http.Server, listeners []net.Listener, secure bool) {
+	for i := 0; i < len(listeners); i++ {
+		go func(l net.Listener) {
+			var err error
+			if secure {
+				err = server.ServeTLS(l, "", "")
+			} else {
+				err = server.Serve(l)
+			}
+
+			if err != nil && err != http.ErrServerClosed {
+				log.Println("fail to serve on", l.Addr(), "with error", err)
+			}
+		}(listeners[i])
+	}
+}
+
+/**
+ * Send the grpc-web requests to the services and the others requests to the
+ * http handlers.
+ */
+func (globule *Globule) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if globule.grpcWebGateway.IsGrpcWebRequest(r) {
+		globule.grpcWebGateway.ServeHTTP(w, r)
+		return
+	}
+
+	if route := globule.getProxyRoute(r); route != nil {
+		globule.serveProxyRoute(w, r, route)
+		return
+	}
+
+	http.DefaultServeMux.ServeHTTP(w, r)
+}
+
 /**
  * Listen for new connection.
  */
 func (globule *Globule) Listen() error {
 
-	var err error
-
 	// Must be started before other services.
-	go func() {
-		// local - non secure connection.
-		globule.http_server = &http.Server{
-			Addr: ":" + strconv.Itoa(globule.PortHttp),
-		}
-		err = globule.http_server.ListenAndServe()
-	}()
+	// local - non secure connection.
+	globule.http_server = &http.Server{
+		Addr:    ":" + strconv.Itoa(globule.PortHttp),
+		Handler: http.HandlerFunc(globule.serveHTTP),
+	}
+
+	listeners, err := listenDualStack(globule.PortHttp)
+	if err != nil {
+		return err
+	}
+	serve(globule.http_server, listeners, false)
 
 	// if no certificates are specified I will try to get one from let's encrypts.
 	// Start https server.
 	if len(globule.Certificate) == 0 && globule.Protocol == "https" {
 
-
 		// Here is the command to be execute in order to ge the certificates.
 		// ./lego --email="admin@globular.app" --accept-tos --key-type=rsa4096 --path=../config/http_tls --http --csr=../config/tls/server.csr run
 		// I need to remove the gRPC certificate and recreate it.
@@ -1025,7 +1291,12 @@ func (globule *Globule) Listen() error {
 		}
 
 		// Register that peer with the dns.
-		err := globule.registerIpToDns()
+		addresses, err := globule.lookupIp()
+		if err != nil {
+			return err
+		}
+
+		err = globule.registerIpToDns(addresses)
 		if err != nil {
 			return err
 		}
@@ -1036,23 +1307,37 @@ func (globule *Globule) Listen() error {
 		}
 	}
 
-
-
-
 	// Start the http server.
 	if globule.Protocol == "https" {
 
+		// The certificate is keep in memory and reload when the files change.
+		globule.certificateStore, err = NewCertificateStore(globule.creds+"/"+globule.Certificate, globule.creds+"/server.pem")
+		if err != nil {
+			return err
+		}
+
+		err = globule.certificateStore.Watch(globule.creds, globule.exit)
+		if err != nil {
+			log.Println("fail to watch certificates directory with error ", err)
+		}
+
 		globule.https_server = &http.Server{
-			Addr: ":" + strconv.Itoa(globule.PortHttps),
+			Addr:    ":" + strconv.Itoa(globule.PortHttps),
+			Handler: http.HandlerFunc(globule.serveHTTP),
 			TLSConfig: &tls.Config{
-				ServerName: globule.getDomain(),
+				ServerName:         globule.getDomain(),
+				GetCertificate:     globule.certificateStore.GetCertificate,
+				GetConfigForClient: globule.tlsAlpn01Provider.GetConfigForClient,
 			},
 		}
 
-		// get the value from the configuration files.
-		go func() {
-			err = globule.https_server.ListenAndServeTLS(globule.creds+"/"+globule.Certificate, globule.creds+"/server.pem")
-		}()
+		listeners, err := listenDualStack(globule.PortHttps)
+		if err != nil {
+			return err
+		}
+
+		// The certificate is given by the store.
+		serve(globule.https_server, listeners, true)
 	}
 
 	//////////////////////////////////////////////////////////
@@ -1063,6 +1348,15 @@ func (globule *Globule) Listen() error {
 	// Keep globular up to date subscription.
 	globule.watchForUpdate()
 
+	// Renew the let's encrypt certificate before it expire.
+	globule.startCertificateRenewal()
+
+	// Keep the dns up to date when the ip address change.
+	globule.startIpWatcher()
+
+	// Remove the unreachable upstreams of the proxy routes.
+	globule.startProxyHealthChecks()
+
 	return err
 }
 
@@ -1074,7 +1368,7 @@ var (
 	resource_client_       *resource_client.Resource_Client
 )
 
-//////////////////////// Resource Client ////////////////////////////////////////////
+// ////////////////////// Resource Client ////////////////////////////////////////////
 func GetResourceClient(domain string) (*resource_client.Resource_Client, error) {
 	var err error
 	if resource_client_ == nil {
@@ -1134,7 +1428,7 @@ func (globule *Globule) validateAccess(subject string, subjectType rbacpb.Subjec
 	return rbac_client_.ValidateAccess(subject, subjectType, name, path)
 }
 
-///////////////////// event service functions ////////////////////////////////////
+// /////////////////// event service functions ////////////////////////////////////
 func (globule *Globule) getEventClient() (*event_client.Event_Client, error) {
 	var err error
 	if event_client_ != nil {
@@ -1148,7 +1442,16 @@ func (globule *Globule) getEventClient() (*event_client.Event_Client, error) {
 	return event_client_, nil
 }
 
+/**
+ * Publish an event with its data.
+ */
+type Publisher func(event string, data []byte) error
+
 func (globule *Globule) publish(event string, data []byte) error {
+	if globule.publisher != nil {
+		return globule.publisher(event, data)
+	}
+
 	eventClient, err := globule.getEventClient()
 	if err != nil {
 		return err
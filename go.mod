@@ -8,6 +8,7 @@ replace github.com/davecourtois/Utility => ../../../github.com/davecourtois/Util
 
 require (
 	github.com/antlr/antlr4/runtime/Go/antlr v0.0.0-20210521184019-c5ad59b459ec
+	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
 	github.com/davecourtois/Utility v0.0.0-20210515191918-3118f6f72191
 	github.com/globulario/services/golang v0.0.0-20210506013013-d8ee75e6a528
 	github.com/go-acme/lego v2.7.2+incompatible
@@ -15,9 +16,13 @@ require (
 	github.com/golang/snappy v0.0.3 // indirect
 	github.com/gookit/color v1.4.2
 	github.com/kardianos/service v1.2.0
-	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf // indirect
+	github.com/miekg/dns v1.1.42
+	github.com/syndtr/goleveldb v1.0.0
+	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf
 	golang.org/x/image v0.0.0-20210504121937-7319ad40d33e // indirect
 	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
 	golang.org/x/sys v0.0.0-20210507161434-a76c4d0a0096 // indirect
+	google.golang.org/grpc v1.38.0
+	gopkg.in/fsnotify.v1 v1.4.7
 	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
 )
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"github.com/globulario/services/golang/config"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The delay during which the services configurations are reused.
+var grpcWebServicesRefreshDelay = 5 * time.Second
+
+// The maximum size of a message received from a client.
+const grpcWebMaxMessageSize = 64 * 1024 * 1024
+
+// The flag of the trailers frame.
+const grpcWebTrailersFlag = 0x80
+
+// Request headers that are not forwarded to the services.
+var grpcWebIgnoredHeaders = map[string]bool{
+	"connection": true, "content-length": true, "content-type": true, "host": true, "origin": true,
+	"referer": true, "user-agent": true, "accept": true, "accept-encoding": true, "accept-language": true,
+	"te": true, "upgrade": true, "x-grpc-web": true, "x-user-agent": true, "grpc-timeout": true,
+	"sec-websocket-key": true, "sec-websocket-version": true, "sec-websocket-protocol": true, "sec-websocket-extensions": true,
+}
+
+/**
+ * A codec that keep the messages as bytes, the gateway don't need to know
+ * the messages types.
+ */
+type grpcWebCodec struct{}
+
+func (grpcWebCodec) Marshal(v interface{}) ([]byte, error) {
+	return *(v.(*[]byte)), nil
+}
+
+func (grpcWebCodec) Unmarshal(data []byte, v interface{}) error {
+	*(v.(*[]byte)) = append([]byte(nil), data...)
+	return nil
+}
+
+func (grpcWebCodec) Name() string {
+	return "proto"
+}
+
+/**
+ * Serve the gRPC-Web requests of browsers directly from the http server. The
+ * request /<service.Name>/<Method> is sent to the service with gRPC, so the
+ * browsers don't need a proxy for each service. Streams from client are
+ * supported with the websocket transport (grpc-websockets protocol).
+ */
+type GrpcWebGateway struct {
+	mutex       sync.Mutex
+	connections map[string]*grpc.ClientConn // address -> connection
+	services    []map[string]interface{}
+	lastRefresh time.Time
+}
+
+func NewGrpcWebGateway() *GrpcWebGateway {
+	return &GrpcWebGateway{connections: make(map[string]*grpc.ClientConn)}
+}
+
+/**
+ * Return true if the request is a gRPC-Web request (or it cors preflight).
+ */
+func (gateway *GrpcWebGateway) IsGrpcWebRequest(r *http.Request) bool {
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web") {
+		return true
+	}
+
+	if r.Method == http.MethodOptions && strings.Contains(strings.ToLower(r.Header.Get("Access-Control-Request-Headers")), "x-grpc-web") {
+		return true
+	}
+
+	return r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(r.Header.Get("Sec-Websocket-Protocol"), "grpc-websockets")
+}
+
+/**
+ * Return the configuration of the service of a method path
+ * (/<service.Name>/<Method>), nil if no service exist with that name.
+ */
+func (gateway *GrpcWebGateway) getServiceConfiguration(method string) map[string]interface{} {
+	values := strings.Split(strings.TrimPrefix(method, "/"), "/")
+	if len(values) != 2 {
+		return nil
+	}
+
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+
+	if gateway.services == nil || time.Since(gateway.lastRefresh) > grpcWebServicesRefreshDelay {
+		services, err := config.GetServicesConfigurations()
+		if err == nil {
+			gateway.services = services
+			gateway.lastRefresh = time.Now()
+		}
+	}
+
+	for _, s := range gateway.services {
+		if Utility.ToString(s["Name"]) == values[0] {
+			return s
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Return the connection to a service, the connections are kept open.
+ */
+func (gateway *GrpcWebGateway) getConnection(s map[string]interface{}) (*grpc.ClientConn, error) {
+	address := "127.0.0.1:" + Utility.ToString(Utility.ToInt(s["Port"]))
+	secure := s["TLS"] != nil && s["TLS"].(bool)
+	key := address + ":" + strconv.FormatBool(secure)
+
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+
+	if conn, ok := gateway.connections[key]; ok {
+		return conn, nil
+	}
+
+	opts := []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcWebCodec{}), grpc.MaxCallRecvMsgSize(grpcWebMaxMessageSize))}
+	if secure {
+		// The gateway use the client certificate of the server.
+		certificate, err := tls.LoadX509KeyPair(globule.creds+"/client.crt", globule.creds+"/client.pem")
+		if err != nil {
+			return nil, err
+		}
+
+		ca, err := ioutil.ReadFile(globule.creds + "/ca.crt")
+		if err != nil {
+			return nil, err
+		}
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("fail to append ca certificate")
+		}
+
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			ServerName:   globule.getDomain(),
+			Certificates: []tls.Certificate{certificate},
+			RootCAs:      certPool,
+		})))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	conn, err := grpc.Dial(address, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	gateway.connections[key] = conn
+	return conn, nil
+}
+
+/**
+ * Close the connections to the services.
+ */
+func (gateway *GrpcWebGateway) Close() {
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+
+	for key, conn := range gateway.connections {
+		conn.Close()
+		delete(gateway.connections, key)
+	}
+}
+
+/**
+ * Return the outgoing context of a request, the headers are sent as metadata.
+ * The grpc- headers are reserved to the protocol and are never sent.
+ */
+func getGrpcWebContext(ctx context.Context, headers http.Header) (context.Context, context.CancelFunc) {
+	md := metadata.MD{}
+	for key, values := range headers {
+		key = strings.ToLower(key)
+		if grpcWebIgnoredHeaders[key] || strings.HasPrefix(key, "access-control-") || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+		md.Append(key, values...)
+	}
+
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	if timeout, ok := parseGrpcTimeout(headers.Get("grpc-timeout")); ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+/**
+ * Parse the grpc-timeout header value, ex: 10S or 100m.
+ */
+func parseGrpcTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+/**
+ * Read a message frame: the compression flag, the length and the message.
+ */
+func readGrpcWebFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0] != 0 {
+		return nil, status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcWebMaxMessageSize {
+		return nil, status.Error(codes.ResourceExhausted, "the message is too large")
+	}
+
+	msg := make([]byte, length)
+	_, err = io.ReadFull(reader, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+/**
+ * Create a frame with a given flag.
+ */
+func createGrpcWebFrame(flag byte, data []byte) []byte {
+	frame := make([]byte, 5+len(data))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+	return frame
+}
+
+/**
+ * Percent encode the grpc-message value as asked by the gRPC protocol, only
+ * the printable ascii characters other than % are kept as is.
+ */
+func encodeGrpcMessage(msg string) string {
+	const hex = "0123456789ABCDEF"
+
+	var buffer strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			buffer.WriteByte(c)
+		} else {
+			buffer.WriteByte('%')
+			buffer.WriteByte(hex[c>>4])
+			buffer.WriteByte(hex[c&0xf])
+		}
+	}
+
+	return buffer.String()
+}
+
+/**
+ * Return the value of a metadata as a header value: the binary values (-bin
+ * keys) are base64 encoded and the line breaks of the others are removed, a
+ * value can't create another header.
+ */
+func getGrpcWebHeaderValue(key string, value string) string {
+	if strings.HasSuffix(strings.ToLower(key), "-bin") {
+		return base64.RawStdEncoding.EncodeToString([]byte(value))
+	}
+
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+/**
+ * Write metadata as the header lines of a frame.
+ */
+func writeGrpcWebMetadata(buffer *bytes.Buffer, md metadata.MD) {
+	for key, values := range md {
+		key = strings.ToLower(key)
+		if strings.ContainsAny(key, "\r\n: ") {
+			continue
+		}
+
+		for _, value := range values {
+			buffer.WriteString(key + ": " + getGrpcWebHeaderValue(key, value) + "\r\n")
+		}
+	}
+}
+
+/**
+ * Create the trailers frame from the status of the call and the trailers
+ * metadata.
+ */
+func createGrpcWebTrailers(err error, trailer metadata.MD) []byte {
+	st, _ := status.FromError(err)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("grpc-status: " + strconv.Itoa(int(st.Code())) + "\r\n")
+	if len(st.Message()) > 0 {
+		buffer.WriteString("grpc-message: " + encodeGrpcMessage(st.Message()) + "\r\n")
+	}
+
+	writeGrpcWebMetadata(&buffer, trailer)
+
+	return createGrpcWebFrame(grpcWebTrailersFlag, buffer.Bytes())
+}
+
+/**
+ * Write the status of a call as a trailers only response.
+ */
+func writeGrpcWebError(w http.ResponseWriter, contentType string, err error) {
+	st, _ := status.FromError(err)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("grpc-status", strconv.Itoa(int(st.Code())))
+	w.Header().Set("grpc-message", encodeGrpcMessage(st.Message()))
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+ * Answer a gRPC-Web request.
+ */
+func (gateway *GrpcWebGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+	w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		gateway.serveWebsocket(w, r)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+	if text {
+		contentType = "application/grpc-web-text+proto"
+	} else {
+		contentType = "application/grpc-web+proto"
+	}
+
+	s := gateway.getServiceConfiguration(r.URL.Path)
+	if s == nil {
+		writeGrpcWebError(w, contentType, status.Error(codes.Unimplemented, "no service found for "+r.URL.Path))
+		return
+	}
+
+	conn, err := gateway.getConnection(s)
+	if err != nil {
+		writeGrpcWebError(w, contentType, status.Error(codes.Unavailable, err.Error()))
+		return
+	}
+
+	var body io.Reader = r.Body
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, r.Body)
+	}
+
+	// gRPC-Web clients send only one message (unary or server stream call).
+	msg, err := readGrpcWebFrame(body)
+	if err != nil {
+		writeGrpcWebError(w, contentType, status.Error(codes.InvalidArgument, "invalid request message"))
+		return
+	}
+
+	ctx, cancel := getGrpcWebContext(r.Context(), r.Header)
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, r.URL.Path)
+	if err == nil {
+		err = stream.SendMsg(&msg)
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+
+	var header metadata.MD
+	if err == nil {
+		header, err = stream.Header()
+	}
+
+	if err != nil {
+		writeGrpcWebError(w, contentType, err)
+		return
+	}
+
+	for key, values := range header {
+		for _, value := range values {
+			w.Header().Add(key, getGrpcWebHeaderValue(key, value))
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+
+	write := func(frame []byte) {
+		if text {
+			frame = []byte(base64.StdEncoding.EncodeToString(frame))
+		}
+		w.Write(frame)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	for {
+		var rsp []byte
+		err = stream.RecvMsg(&rsp)
+		if err != nil {
+			break
+		}
+		write(createGrpcWebFrame(0, rsp))
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	write(createGrpcWebTrailers(err, stream.Trailer()))
+}
+
+/**
+ * Answer a gRPC call over websocket (grpc-websockets protocol). The first
+ * message contain the request headers, the next messages are the frames of
+ * the request prefixed by 0, or 1 when the client stop sending.
+ */
+func (gateway *GrpcWebGateway) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			// The origin is validated by the cors policy.
+			origin := r.Header.Get("Origin")
+			if len(origin) > 0 && !globule.isAllowedOrigin(origin) {
+				return errors.New("origin " + origin + " is not allowed")
+			}
+			config.Protocol = []string{"grpc-websockets"}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			ws.PayloadType = websocket.BinaryFrame
+			err := gateway.handleWebsocket(ws, r)
+			if err != nil {
+				websocket.Message.Send(ws, createGrpcWebTrailers(err, nil))
+			}
+		},
+	}
+
+	server.ServeHTTP(w, r)
+}
+
+func (gateway *GrpcWebGateway) handleWebsocket(ws *websocket.Conn, r *http.Request) error {
+	// The request headers.
+	var data []byte
+	err := websocket.Message.Receive(ws, &data)
+	if err != nil {
+		return err
+	}
+
+	headers, err := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("\r\n\r\n")))).ReadMIMEHeader()
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid request headers")
+	}
+
+	s := gateway.getServiceConfiguration(r.URL.Path)
+	if s == nil {
+		return status.Error(codes.Unimplemented, "no service found for "+r.URL.Path)
+	}
+
+	conn, err := gateway.getConnection(s)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	ctx, cancel := getGrpcWebContext(r.Context(), http.Header(headers))
+	defer cancel()
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, r.URL.Path)
+	if err != nil {
+		return err
+	}
+
+	// Send the client messages to the service.
+	go func() {
+		var buffer bytes.Buffer
+		for {
+			var data []byte
+			err := websocket.Message.Receive(ws, &data)
+			if err != nil || len(data) == 0 {
+				cancel()
+				return
+			}
+
+			if data[0] == 1 {
+				stream.CloseSend()
+				return
+			}
+
+			buffer.Write(data[1:])
+			for buffer.Len() >= 5 {
+				length := int(binary.BigEndian.Uint32(buffer.Bytes()[1:5]))
+				if buffer.Len() < 5+length {
+					break
+				}
+
+				msg, err := readGrpcWebFrame(&buffer)
+				if err == nil {
+					err = stream.SendMsg(&msg)
+				}
+				if err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	header, err := stream.Header()
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	writeGrpcWebMetadata(&buffer, header)
+
+	err = websocket.Message.Send(ws, createGrpcWebFrame(grpcWebTrailersFlag, buffer.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	for {
+		var rsp []byte
+		err = stream.RecvMsg(&rsp)
+		if err != nil {
+			break
+		}
+
+		err = websocket.Message.Send(ws, createGrpcWebFrame(0, rsp))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+
+	return websocket.Message.Send(ws, createGrpcWebTrailers(err, stream.Trailer()))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/davecourtois/Utility"
+)
+
+/**
+ * A set of response headers applied to the files matching the rule. Empty
+ * criteria match everything. A header with an empty value is removed.
+ */
+type HeaderPolicy struct {
+	Host       string            // The host of the request, without the port.
+	PathPrefix string            // The prefix of the request path.
+	MimeType   string            // The mime type (or mime type prefix ex. image/) of the file.
+	Pattern    string            // A regular expression the file name must match.
+	Headers    map[string]string // The headers to set.
+}
+
+// The compiled policy patterns.
+var headerPolicyPatterns = struct {
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}{patterns: make(map[string]*regexp.Regexp)}
+
+func getHeaderPolicyPattern(pattern string) (*regexp.Regexp, error) {
+	headerPolicyPatterns.Lock()
+	defer headerPolicyPatterns.Unlock()
+
+	if compiled, ok := headerPolicyPatterns.patterns[pattern]; ok {
+		return compiled, nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	headerPolicyPatterns.patterns[pattern] = compiled
+	return compiled, nil
+}
+
+/**
+ * Return true if the policy apply to a file.
+ */
+func (policy *HeaderPolicy) match(host string, rqst_path string, name string, mimeType string) bool {
+	if len(policy.Host) > 0 && !strings.EqualFold(policy.Host, host) {
+		return false
+	}
+
+	if len(policy.PathPrefix) > 0 && !strings.HasPrefix(rqst_path, policy.PathPrefix) {
+		return false
+	}
+
+	if len(policy.MimeType) > 0 && !strings.HasPrefix(mimeType, policy.MimeType) {
+		return false
+	}
+
+	if len(policy.Pattern) > 0 {
+		pattern, err := getHeaderPolicyPattern(policy.Pattern)
+		if err != nil || !pattern.MatchString(path.Base(name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * Return the policies applied before the one of the configuration.
+ */
+func (globule *Globule) getDefaultHeaderPolicies() []*HeaderPolicy {
+	policies := []*HeaderPolicy{
+		{
+			Headers: map[string]string{
+				"X-Content-Type-Options":  "nosniff",
+				"Referrer-Policy":         "strict-origin-when-cross-origin",
+				"Content-Security-Policy": "frame-ancestors 'self'",
+			},
+		},
+		// The application entry point must always be validated.
+		{
+			Pattern: `^index\.html?$`,
+			Headers: map[string]string{"Cache-Control": "no-cache"},
+		},
+		// Assets with a content hash in their name never change.
+		{
+			Pattern: `[.-][0-9a-fA-F]{8,}\.(js|mjs|css|woff2?|ttf|svg|png|jpe?g|gif|webp|ico|wasm)$`,
+			Headers: map[string]string{"Cache-Control": "public, max-age=31536000, immutable"},
+		},
+	}
+
+	if globule.Protocol == "https" {
+		policies = append(policies, &HeaderPolicy{
+			Headers: map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+		})
+	}
+
+	return policies
+}
+
+/**
+ * Set the headers of the policies that match a file. The name is the path of
+ * the file on the disk, it can be empty if the response is not a file.
+ */
+func (globule *Globule) applyHeaderPolicies(w http.ResponseWriter, r *http.Request, name string, mimeType string) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	rqst_path := path.Clean(r.URL.Path)
+	policies := append(globule.getDefaultHeaderPolicies(), globule.HeaderPolicies...)
+	for _, policy := range policies {
+		if len(name) == 0 && (len(policy.Pattern) > 0 || len(policy.MimeType) > 0) {
+			continue
+		}
+
+		if !policy.match(host, rqst_path, name, mimeType) {
+			continue
+		}
+
+		for key, value := range policy.Headers {
+			if len(value) == 0 {
+				w.Header().Del(key)
+			} else {
+				w.Header().Set(key, value)
+			}
+		}
+	}
+}
+
+/**
+ * Return true if a cross origin request is allowed from a given origin. If no
+ * origins are configured only the globule domains are allowed.
+ */
+func (globule *Globule) isAllowedOrigin(origin string) bool {
+	if len(globule.AllowedOrigins) > 0 {
+		for _, allowed := range globule.AllowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	host := u.Hostname()
+	if host == "localhost" || host == "127.0.0.1" || host == "::1" || host == globule.getDomain() || host == globule.Domain {
+		return true
+	}
+
+	for i := 0; i < len(globule.AlternateDomains); i++ {
+		if strings.EqualFold(Utility.ToString(globule.AlternateDomains[i]), host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/davecourtois/Utility"
+)
+
+// The kind of media job that create the hls streams of a video.
+const MediaJobHls = "hls"
+
+// The duration in seconds of the hls segments.
+const hlsSegmentDuration = 6
+
+/**
+ * A quality of the hls stream.
+ */
+type hlsRendition struct {
+	height       int
+	videoBitrate int // kbit/s
+	audioBitrate int // kbit/s
+}
+
+// The renditions of the hls streams, the renditions bigger than the video
+// are not created.
+var hlsRenditions = []hlsRendition{
+	{1080, 5000, 192},
+	{720, 2800, 128},
+	{480, 1400, 128},
+	{360, 800, 96},
+}
+
+/**
+ * Return the directory of the hls streams of a video.
+ */
+func getVideoHlsDir(path_ string) string {
+	name_ := strings.TrimSuffix(filepath.Base(path_), filepath.Ext(path_))
+	return filepath.ToSlash(filepath.Dir(path_)) + "/.hidden/" + name_ + "/hls"
+}
+
+/**
+ * Return the width and the height of a video.
+ */
+func getVideoSize(path_ string) (int, int, error) {
+	// ffprobe -v quiet -select_streams v:0 -show_entries stream=width,height -of csv=s=x:p=0 video.mp4
+	cmd := exec.Command("ffprobe", "-v", "quiet", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=s=x:p=0", path_)
+	cmd.Dir = os.TempDir()
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	values := strings.Split(strings.TrimSpace(out.String()), "x")
+	if len(values) < 2 {
+		return 0, 0, errors.New("fail to read the size of the video " + path_)
+	}
+
+	width, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	height, err := strconv.Atoi(values[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return width, height, nil
+}
+
+/**
+ * Return the renditions of a video of a given height, the smallest rendition
+ * is always created.
+ */
+func getHlsRenditions(height int) []hlsRendition {
+	renditions := make([]hlsRendition, 0)
+	for _, rendition := range hlsRenditions {
+		if rendition.height <= height {
+			renditions = append(renditions, rendition)
+		}
+	}
+
+	if len(renditions) == 0 {
+		renditions = append(renditions, hlsRenditions[len(hlsRenditions)-1])
+	}
+
+	return renditions
+}
+
+/**
+ * Create the hls streams of a video, a stream is created for each rendition
+ * and the master playlist (master.m3u8) reference them.
+ */
+func createVideoHls(ctx context.Context, job *MediaJob, progress func(float64)) error {
+	path_ := job.Path
+	if !Utility.Exists(path_) {
+		return errors.New("the file " + path_ + " does not exist")
+	}
+
+	output := getVideoHlsDir(path_)
+	if Utility.Exists(output + "/master.m3u8") {
+		return nil
+	}
+
+	duration := getVideoDuration(path_)
+	if duration == 0 {
+		return errors.New("the video lenght is 0 sec")
+	}
+
+	width, height, err := getVideoSize(path_)
+	if err != nil {
+		return err
+	}
+
+	// The streams are created in a temporary directory, so the streams are
+	// never served before they are all created.
+	tmp := output + ".tmp"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+
+	renditions := getHlsRenditions(height)
+	master := "#EXTM3U\n#EXT-X-VERSION:3\n"
+	for i, rendition := range renditions {
+		name := strconv.Itoa(rendition.height) + "p"
+		dir := tmp + "/" + name
+		err := Utility.CreateDirIfNotExist(dir)
+		if err != nil {
+			return err
+		}
+
+		// The width must be even for libx264.
+		width_ := (width*rendition.height/height + 1) / 2 * 2
+		bitrate := strconv.Itoa(rendition.videoBitrate)
+
+		// A key frame at the start of each segment whatever the frame rate.
+		keyFrames := "expr:gte(t,n_forced*" + strconv.Itoa(hlsSegmentDuration) + ")"
+
+		// ffmpeg -i video.mp4 -vf scale=-2:720 -c:v libx264 -b:v 2800k ... -hls_time 6 -hls_playlist_type vod index.m3u8
+		err = runFfmpeg(ctx, duration, func(p float64) {
+			progress((float64(i) + p) / float64(len(renditions)))
+		}, "-y", "-i", path_,
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-vf", "scale=-2:"+strconv.Itoa(rendition.height),
+			"-c:v", "libx264", "-preset", "veryfast", "-profile:v", "main",
+			"-b:v", bitrate+"k", "-maxrate", strconv.Itoa(rendition.videoBitrate*107/100)+"k", "-bufsize", strconv.Itoa(rendition.videoBitrate*3/2)+"k",
+			"-force_key_frames", keyFrames, "-sc_threshold", "0",
+			"-c:a", "aac", "-b:a", strconv.Itoa(rendition.audioBitrate)+"k", "-ac", "2",
+			"-hls_time", strconv.Itoa(hlsSegmentDuration), "-hls_playlist_type", "vod",
+			"-hls_segment_filename", dir+"/segment_%04d.ts",
+			dir+"/index.m3u8")
+		if err != nil {
+			return err
+		}
+
+		bandwidth := (rendition.videoBitrate + rendition.audioBitrate) * 1000
+		master += "#EXT-X-STREAM-INF:BANDWIDTH=" + strconv.Itoa(bandwidth) + ",RESOLUTION=" + strconv.Itoa(width_) + "x" + strconv.Itoa(rendition.height) + "\n"
+		master += name + "/index.m3u8\n"
+	}
+
+	err = ioutil.WriteFile(tmp+"/master.m3u8", []byte(master), 0644)
+	if err != nil {
+		return err
+	}
+
+	os.RemoveAll(output)
+	err = os.Rename(tmp, output)
+	if err != nil {
+		return err
+	}
+
+	path_ = strings.ReplaceAll(path_, globule.data+"/files", "")
+	globule.publish("reload_dir_event", []byte(path.Dir(path_)))
+
+	return nil
+}
+
+/**
+ * Return the path of the file that a generated file (in .hidden/<name>/) was
+ * created from, the access to generated files is the access to their source.
+ * The path is return as is if it's not a generated file or if the source is
+ * not found.
+ */
+func getMediaSourcePath(dir string, rqst_path string) string {
+	index := strings.Index(rqst_path, "/.hidden/")
+	if index < 0 {
+		return rqst_path
+	}
+
+	parent := rqst_path[:index]
+	name := strings.SplitN(rqst_path[index+len("/.hidden/"):], "/", 2)[0]
+
+	files, err := ioutil.ReadDir(path.Join(dir, parent))
+	if err != nil {
+		return rqst_path
+	}
+
+	source := ""
+	for _, f := range files {
+		if f.IsDir() || strings.TrimSuffix(f.Name(), filepath.Ext(f.Name())) != name {
+			continue
+		}
+
+		// The converted video is the one used.
+		if len(source) == 0 || strings.HasSuffix(f.Name(), ".mp4") {
+			source = path.Join(parent, f.Name())
+		}
+	}
+
+	if len(source) == 0 {
+		return rqst_path
+	}
+
+	return source
+}
+
+/**
+ * Return the mime type of a generated streaming file, an empty string if the
+ * file is not one.
+ */
+func getStreamingMimeType(rqst_path string) string {
+	if !strings.Contains(rqst_path, "/.hidden/") {
+		return ""
+	}
+
+	switch path.Ext(rqst_path) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	}
+
+	return ""
+}
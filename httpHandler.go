@@ -1,20 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
-	//"log"
-	"github.com/davecourtois/Utility"
-	"github.com/globulario/services/golang/interceptors"
-	"github.com/globulario/services/golang/rbac/rbacpb"
 	"io"
 	"io/ioutil"
+	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -22,6 +22,11 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/davecourtois/Utility"
+	"github.com/globulario/services/golang/interceptors"
+	"github.com/globulario/services/golang/rbac/rbacpb"
+	"golang.org/x/crypto/ocsp"
 )
 
 func getChecksumHanldler(w http.ResponseWriter, r *http.Request) {
@@ -92,301 +97,508 @@ func getSanConfigurationHandler(w http.ResponseWriter, r *http.Request) {
  * Setup allow Cors policies.
  */
 func setupResponse(w *http.ResponseWriter, req *http.Request) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, domain, application, token")
+	origin := req.Header.Get("Origin")
+	if len(origin) > 0 && globule.isAllowedOrigin(origin) {
+		(*w).Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	(*w).Header().Add("Vary", "Origin")
+	(*w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE, PATCH, HEAD")
+	(*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, domain, application, token, enrollment-secret, x-grpc-web, x-user-agent, grpc-timeout, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Checksum")
 }
 
 /**
- * Sign ca certificate request and return a certificate.
+ * Sign ca certificate request and return a certificate. The request (pem or
+ * base64 encoded pem) is the body of a POST request. The requester must give a
+ * valid token or an enrollment secret created by the server.
  */
 func signCaCertificateHandler(w http.ResponseWriter, r *http.Request) {
 
 	//add prefix and clean
-	w.Header().Set("Content-Type", "application/text")
 	setupResponse(&w, r)
 
-	w.WriteHeader(http.StatusCreated)
-	// sign the certificate.
-	csr_str := r.URL.Query().Get("csr") // the csr in base64
-	csr, err := base64.StdEncoding.DecodeString(csr_str)
+	if r.Method != http.MethodPost {
+		http.Error(w, "the certificate request must be the body of a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	audit := &CertificateAudit{Time: time.Now(), Address: r.RemoteAddr}
+
+	if len(r.Header.Get("token")) > 0 {
+		id, err := validateRequestToken(r, "/ca.CertificateAuthority/SignCertificate")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		audit.Requester = "account:" + id
+	} else if len(r.Header.Get("enrollment-secret")) > 0 {
+		id, err := globule.consumeEnrollmentSecret(r.Header.Get("enrollment-secret"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		audit.Requester = "enrollment:" + id
+	} else {
+		http.Error(w, "a token or an enrollment secret is required to sign a certificate", http.StatusUnauthorized)
+		return
+	}
 
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
 	if err != nil {
-		http.Error(w, "Fail to decode csr base64 string", http.StatusBadRequest)
+		http.Error(w, "Fail to read the certificate request", http.StatusBadRequest)
 		return
 	}
 
+	// the csr can be in base64
+	csr := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(csr, "-----BEGIN") {
+		decoded, err := base64.StdEncoding.DecodeString(csr)
+		if err != nil {
+			http.Error(w, "Fail to decode csr base64 string", http.StatusBadRequest)
+			return
+		}
+		csr = string(decoded)
+	}
+
 	// Now I will sign the certificate.
-	crt, err := globule.signCertificate(string(csr))
+	crt, err := globule.signCertificate(csr, audit)
 	if err != nil {
-		http.Error(w, "fail to sign certificate!", http.StatusBadRequest)
+		http.Error(w, "fail to sign certificate! "+err.Error(), http.StatusForbidden)
 		return
 	}
 
 	// Return the result as text string.
+	w.Header().Set("Content-Type", "application/text")
+	w.WriteHeader(http.StatusCreated)
 	fmt.Fprint(w, crt)
 }
 
 /**
- * This code is use to upload a file into the tmp directory of the server
- * via http request.
+ * Create a one time secret that a client can use to get it certificate
+ * without token. The secret is valid for "delay" minutes (60 by default).
  */
-func FileUploadHandler(w http.ResponseWriter, r *http.Request) {
-
+func createEnrollmentSecretHandler(w http.ResponseWriter, r *http.Request) {
 	setupResponse(&w, r)
 
-	// I will
-	err := r.ParseMultipartForm(200000) // grab the multipart form
+	if r.Method != http.MethodPost {
+		http.Error(w, "the secret must be created with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := validateRequestToken(r, "/ca.CertificateAuthority/CreateEnrollmentSecret")
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	formdata := r.MultipartForm // ok, no problem so far, read the Form data
+	delay := 60
+	if len(r.FormValue("delay")) > 0 {
+		delay, err = strconv.Atoi(r.FormValue("delay"))
+		if err != nil || delay <= 0 {
+			http.Error(w, "invalid delay "+r.FormValue("delay"), http.StatusBadRequest)
+			return
+		}
+	}
 
-	//get the *fileheaders
-	files := formdata.File["multiplefiles"] // grab the filenames
+	secretId, secret, expires, err := globule.createEnrollmentSecret(id, time.Duration(delay)*time.Minute)
+	if err != nil {
+		http.Error(w, "fail to create enrollment secret!", http.StatusInternalServerError)
+		return
+	}
 
-	// Get the path where to upload the file.
-	path := r.FormValue("path")
-	// If application is defined.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": secretId, "secret": secret, "expires": expires.Unix()})
+}
+
+/**
+ * Validate the token given in the request header and test if it owner can
+ * execute the given action. Return the account id.
+ */
+func validateRequestToken(r *http.Request, method string) (string, error) {
 	token := r.Header.Get("token")
-	application := r.Header.Get("application")
-	hasAccess := true //TODO set it back to false when the
-	hasAccessDenied := false
-	user := ""
-	infos := []*rbacpb.ResourceInfos{}
+	if len(token) == 0 {
+		return "", errors.New("no token was given")
+	}
 
-	// Here I will validate applications...
-	if len(application) != 0 {
-		// Test if the requester has the permission to do the upload...
-		// Here I will named the methode /file.FileService/FileUploadHandler
-		// I will be threaded like a file service methode.
-		hasAccess, err = globule.validateAction("/file.FileService/FileUploadHandler", application, rbacpb.SubjectType_APPLICATION, infos)
-		if err != nil || !hasAccess {
+	id, _, _, expiresAt, err := interceptors.ValidateToken(token)
+	if err != nil {
+		return "", err
+	}
 
-			http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-			return
-		}
+	if time.Now().After(time.Unix(expiresAt, 0)) {
+		return "", errors.New("the token is expired")
+	}
 
-		// validate ressource access...
-		hasAccess, hasAccessDenied, err = globule.validateAccess(application, rbacpb.SubjectType_APPLICATION, "write", path)
-		if !hasAccess || hasAccessDenied || err != nil {
-			http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-		}
+	hasAccess, err := globule.validateAction(method, id, rbacpb.SubjectType_ACCOUNT, []*rbacpb.ResourceInfos{})
+	if err != nil {
+		return "", err
 	}
 
-	// domain := r.Header.Get("domain")
-	if len(token) != 0 && !hasAccess {
-		id, username, _, expiresAt, err := interceptors.ValidateToken(token)
-		user = username
-		if err != nil || time.Now().Before(time.Unix(expiresAt, 0)) {
-			http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-		} else {
-			hasAccess, err = globule.validateAction("/file.FileService/FileUploadHandler", id, rbacpb.SubjectType_ACCOUNT, infos)
-			if err != nil || !hasAccess {
-				http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-			}
-			hasAccess, hasAccessDenied, err = globule.validateAccess(id, rbacpb.SubjectType_ACCOUNT, "write", path)
-			if !hasAccess || hasAccessDenied || err != nil {
-				http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-				return
-			}
-		}
+	if !hasAccess {
+		return "", errors.New("the account " + id + " cannot execute " + method)
 	}
 
-	// Here the path dosent exist.
-	if !Utility.Exists(globule.webRoot + path) {
-		// TODO validate ressource access here
-		Utility.CreateDirIfNotExist(globule.webRoot + path)
+	return id, nil
+}
+
+/**
+ * Return the list of certificates issued by the server certificate authority.
+ */
+func getIssuedCertificatesHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	_, err := validateRequestToken(r, "/ca.CertificateAuthority/GetIssuedCertificates")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
 	}
 
-	for _, f := range files { // loop through the files one by one
-		file, err := f.Open()
-		if err != nil {
-			return
-		}
+	ca, err := globule.getCertificateAuthority()
+	if err != nil {
+		http.Error(w, "fail to load certificate authority!", http.StatusInternalServerError)
+		return
+	}
 
-		// Here I will set the ressource owner.
-		if len(user) > 0 {
-			globule.addResourceOwner(path+"/"+f.Filename, user, rbacpb.SubjectType_ACCOUNT)
-		} else if len(application) > 0 {
-			globule.addResourceOwner(path+"/"+f.Filename, application, rbacpb.SubjectType_APPLICATION)
-		}
+	certificates, err := ca.GetIssuedCertificates()
+	if err != nil {
+		http.Error(w, "fail to read issued certificates!", http.StatusInternalServerError)
+		return
+	}
 
-		// Create the file depending if the path is users, applications or something else...
-		path_ := path + "/" + f.Filename
-		if strings.HasPrefix(path, "/users") || strings.HasPrefix(path, "/applications") {
-			path_ = strings.ReplaceAll(globule.data+"/files"+path_, "\\", "/")
-		} else {
-			path_ = strings.ReplaceAll(globule.webRoot+path_, "\\", "/")
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(certificates)
+}
 
-		out, err := os.Create(path_)
-		if err != nil {
-			file.Close()
-			return
-		}
+/**
+ * Revoke a certificate signed by the server certificate authority. The serial
+ * number (hexadecimal) and the reason code are given as form values.
+ */
+func revokeCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
 
-		defer out.Close()
+	if r.Method != http.MethodPost {
+		http.Error(w, "the certificate must be revoke with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
 
+	id, err := validateRequestToken(r, "/ca.CertificateAuthority/RevokeCertificate")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	serialNumber := r.FormValue("serial")
+	reason := 0
+	if len(r.FormValue("reason")) > 0 {
+		reason, err = strconv.Atoi(r.FormValue("reason"))
 		if err != nil {
-			file.Close()
-			http.Error(w, "Unable to create the file for writing. Check your write access privilege", http.StatusUnauthorized)
-			return
-		}
-		_, err = io.Copy(out, file) // file not files[i] !
-		if err != nil {
-			file.Close()
+			http.Error(w, "invalid revocation reason "+r.FormValue("reason"), http.StatusBadRequest)
 			return
 		}
-		file.Close()
-
-		// Now from the file extension i will retreive it mime type.
-		fileExtension := path_[strings.LastIndex(path_, "."):]
-		fileType := mime.TypeByExtension(fileExtension)
-		path_ = strings.ReplaceAll(path_, "\\", "/")
-		if len(fileType) > 0 {
-			if strings.HasPrefix(fileType, "text/") {
-				indexFile(path_, fileType)
-			} else if strings.HasPrefix(fileType, "video/") {
-				// Here I will call convert video...
-				go func() {
-					convertVideo()
-				}()
-			}
-		}
 	}
-}
 
-func visit(files *[]string) filepath.WalkFunc {
+	ca, err := globule.getCertificateAuthority()
+	if err != nil {
+		http.Error(w, "fail to load certificate authority!", http.StatusInternalServerError)
+		return
+	}
 
-	return func(path string, info os.FileInfo, err error) error {
-		path = strings.ReplaceAll(path, "\\", "/")
-		if err != nil {
-			return nil
-		}
+	err = ca.RevokeCertificate(serialNumber, reason)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		if err != nil {
-			return nil
+	log.Println("certificate", serialNumber, "was revoked by", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+ * Return the certificate revocation list of the server certificate authority.
+ * The list is in der format or pem if format=pem is given.
+ */
+func getCaCrlHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	// The list is kept up to date by startRevocationListRefresh and when a
+	// certificate is revoked, it's only created here if it does not exist.
+	crl, err := ioutil.ReadFile(globule.creds + "/ca.crl")
+	if os.IsNotExist(err) {
+		var ca *CertificateAuthority
+		ca, err = globule.getCertificateAuthority()
+		if err == nil {
+			err = ca.WriteRevocationList()
 		}
-		mimeType := ""
-		if strings.Contains(info.Name(), ".") {
-			fileExtension := info.Name()[strings.LastIndex(info.Name(), "."):]
-			mimeType = mime.TypeByExtension(fileExtension)
-		} else {
-			f_, err := os.Open(path)
-			if err != nil {
-				f_.Close()
-				return nil
-			}
-			mimeType, _ = Utility.GetFileContentType(f_)
-			f_.Close()
+		if err == nil {
+			crl, err = ioutil.ReadFile(globule.creds + "/ca.crl")
 		}
+	}
 
-		if strings.HasPrefix(mimeType, "video/") && !strings.HasSuffix(info.Name(), ".mp4") {
-			*files = append(*files, path)
-		} else if strings.HasPrefix(mimeType, "video/") && strings.HasSuffix(info.Name(), ".mp4") {
-			//log.Println("create video preview " + info.Name())
-			createVideoPreview(path, 20, 128)
-		}
-		return nil
+	if err != nil {
+		http.Error(w, "fail to read certificate revocation list!", http.StatusInternalServerError)
+		return
 	}
+
+	if r.URL.Query().Get("format") == "pem" {
+		w.Header().Set("Content-Type", "application/text")
+		pem.Encode(w, &pem.Block{Type: "X509 CRL", Bytes: crl})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
 }
 
-func convertVideo() {
+/**
+ * The ocsp responder of the server certificate authority. The request is the
+ * body of a POST request or the base64 encoded path of a GET request
+ * (rfc 6960 appendix A).
+ */
+func ocspHandler(w http.ResponseWriter, r *http.Request) {
+	var request []byte
+	var err error
 
-	pids, err := Utility.GetProcessIdsByName("ffmpeg")
-	if err == nil {
-		if len(pids) > 0 {
-			return // already running...
+	if r.Method == http.MethodPost {
+		request, err = ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	} else if r.Method == http.MethodGet {
+		var encoded string
+		encoded, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/ocsp/"))
+		if err == nil {
+			request, err = base64.StdEncoding.DecodeString(encoded)
 		}
+	} else {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	var files []string
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if err != nil {
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
 
-	err = filepath.Walk(globule.data+"/files", visit(&files))
+	ca, err := globule.getCertificateAuthority()
 	if err != nil {
+		w.Write(ocsp.InternalErrorErrorResponse)
 		return
 	}
-	for _, file := range files {
-		file = strings.ReplaceAll(file, "\\", "/")
-		createVideoStream(file)
+
+	response, err := ca.GetOcspResponse(request)
+	if err != nil {
+		log.Println("fail to create ocsp response with error ", err)
 	}
 
-	// sleep a minute...
-	time.Sleep(1 * time.Minute)
-	convertVideo()
+	w.Write(response)
 }
 
-// Set file indexation to be able to search text file on the server.
-func indexFile(path string, fileType string) error {
-	return nil
+/**
+ * Upload files with a multipart form, the files (multiplefiles) are written
+ * in the directory given by the path value. The result of each file is
+ * return in json, the status is 201 if all files are uploaded, 207 if some
+ * files fail, or the status of the error if all fail.
+ */
+func FileUploadHandler(w http.ResponseWriter, r *http.Request) {
+
+	setupResponse(&w, r)
+
+	// Set the security headers of the response.
+	globule.applyHeaderPolicies(w, r, "", "")
+
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "the files must be sent with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The files bigger than 32MB are kept in temporary files.
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		http.Error(w, "fail to read the files with error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	//get the *fileheaders
+	files := r.MultipartForm.File["multiplefiles"] // grab the filenames
+
+	// Get the path where to upload the file.
+	dir := cleanUploadPath(r.FormValue("path"))
+	application := r.Header.Get("application")
+
+	// Validate the access before anything is written.
+	owner, ownerType, hasAccess := globule.validateFileAccess(r, application, "/file.FileService/FileUploadHandler", "write", dir)
+	if !hasAccess {
+		http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
+		return
+	}
+
+	results := make([]*UploadResult, 0, len(files))
+	uploaded := 0
+	for _, f := range files { // loop through the files one by one
+		result := &UploadResult{Name: f.Filename, Size: f.Size, Status: http.StatusCreated}
+		results = append(results, result)
+
+		path_, err := globule.uploadFile(f, dir, owner, ownerType)
+		if err != nil {
+			result.Status = getUploadErrorStatus(err)
+			result.Error = err.Error()
+			continue
+		}
+
+		result.Path = path_
+		uploaded++
+	}
+
+	status := http.StatusCreated
+	if len(results) == 0 {
+		status = http.StatusBadRequest
+	} else if uploaded == 0 {
+		status = results[0].Status
+	} else if uploaded < len(results) {
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"Files": results})
 }
 
 /**
- * Convert all kind of video to mp4 so all browser will be able to read it.
+ * Write an uploaded file in a directory and return it path.
  */
-func createVideoStream(path string) error {
+func (globule *Globule) uploadFile(f *multipart.FileHeader, dir string, owner string, ownerType rbacpb.SubjectType) (string, error) {
+	filename, err := cleanUploadFilename(f.Filename)
+	if err != nil {
+		return "", err
+	}
 
-	path_ := path[0:strings.LastIndex(path, "/")]
-	name_ := path[strings.LastIndex(path, "/"):strings.LastIndex(path, ".")]
-	output := path_ + "/" + name_ + ".mp4"
+	err = globule.validateUpload(filename, f.Size)
+	if err != nil {
+		return "", err
+	}
 
-	defer os.RemoveAll(path)
+	// Create the file depending if the path is users, applications or something else...
+	path_ := path.Join(dir, filename)
+	name, err := getUploadFilePath(path_)
+	if err != nil {
+		return "", err
+	}
 
-	// ffmpeg -i input.mkv -c:v libx264 -c:a aac output.mp4
-	cmd := exec.Command("ffmpeg", "-i", path, "-c:v", "libx264", "-c:a", "aac", output)
+	reserved, err := globule.reserveStorageQuota(path_, f.Size)
+	if err != nil {
+		return "", err
+	}
+	defer releaseStorageQuota(path_, reserved)
 
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	// The size of the file replaced.
+	var previousSize int64
+	if info, err := os.Stat(name); err == nil {
+		previousSize = info.Size()
+	}
+
+	err = Utility.CreateDirIfNotExist(filepath.Dir(name))
 	if err != nil {
-		fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		return err
+		return "", err
+	}
+
+	file, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+
+	size, err := writeFileAtomic(name, file, globule.MaxUploadSize)
+	file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	globule.updateStorageUsage(path_, size-previousSize)
+
+	// Here I will set the ressource owner.
+	if len(owner) > 0 {
+		globule.addResourceOwner(path_, owner, ownerType)
+	}
+
+	processUploadedFile(name)
+
+	return path_, nil
+}
+
+/**
+ * Process a file once it's uploaded, text files are indexed and videos are
+ * converted.
+ */
+func processUploadedFile(path_ string) {
+	path_ = strings.ReplaceAll(path_, "\\", "/")
+
+	// The files watched are processed by the files pipeline.
+	if globule.fileWatcher != nil && globule.fileWatcher.Contains(path_) {
+		globule.fileWatcher.Notify(FileCreated, path_)
+		return
 	}
 
-	// Create a video preview
-	return createVideoPreview(output, 20, 128)
+	go globule.processFile(path_)
+}
+
+/**
+ * Return the directory of the preview images of a video.
+ */
+func getVideoPreviewDir(path string) string {
+	name_ := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return filepath.ToSlash(filepath.Dir(path)) + "/.hidden/" + name_ + "/__preview__"
 }
 
 // Here I will create video
-func createVideoPreview(path string, nb int, height int) error {
+func createVideoPreview(ctx context.Context, path string, nb int, height int) error {
 
 	duration := getVideoDuration(path)
 	if duration == 0 {
 		return errors.New("the video lenght is 0 sec")
 	}
 
-	path_ := path[0:strings.LastIndex(path, "/")]
-	name_ := path[strings.LastIndex(path, "/")+1 : strings.LastIndex(path, ".")]
-	output := path_ + "/.hidden/" + name_ + "/__preview__"
+	output := getVideoPreviewDir(path)
 
 	if Utility.Exists(output) {
 		return nil
 	}
 
-	Utility.CreateDirIfNotExist(output)
+	// The images are created in a temporary directory, so a partial preview
+	// is never taken as done.
+	tmp := output + ".tmp"
+	os.RemoveAll(tmp)
+	defer os.RemoveAll(tmp)
+
+	err := Utility.CreateDirIfNotExist(tmp)
+	if err != nil {
+		return err
+	}
 
 	// ffmpeg -i bob_ross_img-0-Animated.mp4 -ss 15 -t 16 -f image2 preview_%05d.jpg
 	start := .1 * duration
 	laps := 120 // 1 minutes
 
-	cmd := exec.Command("ffmpeg", "-i", path, "-ss", Utility.ToString(start), "-t", Utility.ToString(laps), "-vf", "scale="+Utility.ToString(height)+":-1,fps=.250", "preview_%05d.jpg")
-	cmd.Dir = output // the output directory...
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", path, "-ss", Utility.ToString(start), "-t", Utility.ToString(laps), "-vf", "scale="+Utility.ToString(height)+":-1,fps=.250", "preview_%05d.jpg")
+	cmd.Dir = tmp // the output directory...
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
 		return err
 	}
 
-	path_ = strings.ReplaceAll(path, globule.data+"/files", "")
+	err = os.Rename(tmp, output)
+	if err != nil {
+		return err
+	}
+
+	path_ := strings.ReplaceAll(path, globule.data+"/files", "")
 	path_ = path_[0:strings.LastIndex(path_, "/")]
 
 	globule.publish("reload_dir_event", []byte(path_))
@@ -396,6 +608,11 @@ func createVideoPreview(path string, nb int, height int) error {
 
 func getVideoDuration(path string) float64 {
 
+	// The duration is known if the metadata of the video were extracted.
+	if metadata := readMediaMetadata(path); metadata != nil && metadata.Duration > 0 {
+		return metadata.Duration
+	}
+
 	// ffprobe -v quiet -print_format compact=print_section=0:nokey=1:escape=csv -show_entries format=duration bob_ross_img-0-Animated.mp4
 	cmd := exec.Command("ffprobe", `-v`, `quiet`, `-print_format`, `compact=print_section=0:nokey=1:escape=csv`, `-show_entries`, `format=duration`, path)
 
@@ -471,6 +688,99 @@ func resolveImportPath(path string, importPath string) (string, error) {
 	return importPath_, nil
 }
 
+/**
+ * Validate the access of the application (or the account of the token if no
+ * application is given) to a given resource path. The action is validated
+ * with the rbac service, then the permission on the path. The subject that
+ * was validated is return, it's the owner of the resources it create.
+ */
+func (globule *Globule) validateFileAccess(r *http.Request, application string, action string, permission string, rqst_path string) (string, rbacpb.SubjectType, bool) {
+	token := r.Header.Get("token")
+	subjectType := rbacpb.SubjectType_APPLICATION
+
+	// domain := r.Header.Get("domain")
+	infos := []*rbacpb.ResourceInfos{}
+
+	// The access is given to the application or to the account of the token,
+	// the request is refused if none of them has the access.
+	if len(application) != 0 {
+		// Test if the requester has the permission to do the action...
+		// The file server is threaded like a file service methode.
+		hasAccess, err := globule.validateAction(action, application, rbacpb.SubjectType_APPLICATION, infos)
+		if err == nil && hasAccess {
+			// validate ressource access...
+			hasAccess, hasAccessDenied, err := globule.validateAccess(application, rbacpb.SubjectType_APPLICATION, permission, rqst_path)
+			if err == nil && hasAccess && !hasAccessDenied {
+				return application, subjectType, true
+			}
+		}
+	}
+
+	if len(token) != 0 {
+		id, username, _, expiresAt, err := interceptors.ValidateToken(token)
+		if err != nil || time.Now().After(time.Unix(expiresAt, 0)) {
+			return "", subjectType, false
+		}
+
+		hasAccess, err := globule.validateAction(action, id, rbacpb.SubjectType_ACCOUNT, infos)
+		if err != nil || !hasAccess {
+			return "", subjectType, false
+		}
+
+		hasAccess, hasAccessDenied, err := globule.validateAccess(id, rbacpb.SubjectType_ACCOUNT, permission, rqst_path)
+		if err != nil || !hasAccess || hasAccessDenied {
+			return "", subjectType, false
+		}
+
+		return username, rbacpb.SubjectType_ACCOUNT, true
+	}
+
+	return "", subjectType, false
+}
+
+/**
+ * Return a function that validate the access to resource paths for a given
+ * action. The action is validated once for the application and the account of
+ * the token, only the permission is validated for each path. It's used to
+ * filter a list of files (ex. search results).
+ */
+func (globule *Globule) getFileAccessValidator(r *http.Request, application string, action string, permission string) func(string) bool {
+	type subject struct {
+		id          string
+		subjectType rbacpb.SubjectType
+	}
+
+	subjects := make([]subject, 0, 2)
+	infos := []*rbacpb.ResourceInfos{}
+
+	if len(application) != 0 {
+		hasAccess, err := globule.validateAction(action, application, rbacpb.SubjectType_APPLICATION, infos)
+		if err == nil && hasAccess {
+			subjects = append(subjects, subject{application, rbacpb.SubjectType_APPLICATION})
+		}
+	}
+
+	if token := r.Header.Get("token"); len(token) != 0 {
+		id, _, _, expiresAt, err := interceptors.ValidateToken(token)
+		if err == nil && !time.Now().After(time.Unix(expiresAt, 0)) {
+			hasAccess, err := globule.validateAction(action, id, rbacpb.SubjectType_ACCOUNT, infos)
+			if err == nil && hasAccess {
+				subjects = append(subjects, subject{id, rbacpb.SubjectType_ACCOUNT})
+			}
+		}
+	}
+
+	return func(rqst_path string) bool {
+		for _, subject := range subjects {
+			hasAccess, hasAccessDenied, err := globule.validateAccess(subject.id, subject.subjectType, permission, rqst_path)
+			if err == nil && hasAccess && !hasAccessDenied {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // Custom file server implementation.
 func ServeFileHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -487,6 +797,13 @@ func ServeFileHandler(w http.ResponseWriter, r *http.Request) {
 		dir += "/" + r.Host
 	}
 
+	// The directory of the applications and the error pages.
+	root := dir
+
+	// Set the security headers, the headers of the file are set when the
+	// file is found.
+	globule.applyHeaderPolicies(w, r, "", "")
+
 	//add prefix and clean
 	rqst_path := path.Clean(r.URL.Path)
 
@@ -530,89 +847,64 @@ func ServeFileHandler(w http.ResponseWriter, r *http.Request) {
 		name = globule.creds + rqst_path
 	}
 
-	token := r.Header.Get("token")
-
-	// domain := r.Header.Get("domain")
-	hasAccess := true // TODO set it back to false when permission system will be completed.
-	hasAccessDenied := false
-	var err error
-	infos := []*rbacpb.ResourceInfos{}
-
-	if len(application) != 0 {
-		// Test if the requester has the permission to do the upload...
-		// Here I will named the methode /file.FileService/FileUploadHandler
-		// I will be threaded like a file service methode.
-		hasAccess, err = globule.validateAction("/file.FileService/ServeFileHandler", application, rbacpb.SubjectType_APPLICATION, infos)
-		if err != nil || !hasAccess {
-			http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-			return
-		}
-
-		// validate ressource access...
-		hasAccess, hasAccessDenied, err = globule.validateAccess(application, rbacpb.SubjectType_APPLICATION, "read", rqst_path)
-		if !hasAccess || hasAccessDenied || err != nil {
-			http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
+	// The requests without application or token are served as they always
+	// were, the elements (img, video...) of a page can't send the token header.
+	// The access to a generated file (preview, streams...) is the access to the
+	// file it was created from.
+	if len(application) != 0 || len(r.Header.Get("token")) != 0 {
+		if _, _, hasAccess := globule.validateFileAccess(r, application, "/file.FileService/ServeFileHandler", "read", getMediaSourcePath(dir, rqst_path)); !hasAccess {
+			http.Error(w, "unable to read the file. Check your access privilege", http.StatusUnauthorized)
 			return
 		}
 	}
 
-	// domain := r.Header.Get("domain")
-	if len(token) != 0 && !hasAccess {
-		id /*username*/, _, _, expiresAt, err := interceptors.ValidateToken(token)
-		if err != nil || time.Now().Before(time.Unix(expiresAt, 0)) {
-			http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-			return
-		} else {
-			hasAccess, err = globule.validateAction("/file.FileService/ServeFileHandler", id, rbacpb.SubjectType_ACCOUNT, infos)
-			if err != nil || !hasAccess {
-				http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-			}
-
-			hasAccess, hasAccessDenied, err = globule.validateAccess(id, rbacpb.SubjectType_ACCOUNT, "read", rqst_path)
-			if !hasAccess || hasAccessDenied || err != nil {
-				http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
-				return
-			}
-		}
-	}
-
 	// if the file dosent exist... I will try to get it from the index application...
 	if !Utility.Exists(name) && len(globule.IndexApplication) > 0 {
 		name = path.Join(dir, globule.IndexApplication+"/"+rqst_path)
 	}
 
-	var code string
-	// If the file is a javascript file...
-	hasChange := false
-
 	//check if file exists
 	f, err := os.Open(name)
+	if err != nil && os.IsNotExist(err) && dir == root {
+		// The path can be a client side route of a single page application.
+		if index := globule.getSinglePageApplicationIndex(root, rqst_path); len(index) > 0 {
+			name = index
+			f, err = os.Open(name)
+		}
+	}
+
 	if err != nil {
 		if os.IsNotExist(err) {
-			http.Error(w, "File "+rqst_path+" not found!", http.StatusNoContent)
-			return
+			globule.serveErrorPage(w, r, root, rqst_path, http.StatusNotFound, "File "+rqst_path+" not found!")
+		} else {
+			globule.serveErrorPage(w, r, root, rqst_path, http.StatusInternalServerError, "Fail to open file "+rqst_path)
 		}
+		return
 	}
 
 	defer f.Close()
 
+	// An image can be ask with an other width or format (?w=320&format=webp).
+	variant, err := getRequestedImage(r, name)
+	if err != nil {
+		http.Error(w, err.Error(), getUploadErrorStatus(err))
+		return
+	}
+	name = variant
+
+	// Set the cache and security headers of the file.
+	globule.applyHeaderPolicies(w, r, name, mime.TypeByExtension(path.Ext(name)))
+
 	if strings.HasSuffix(name, ".js") {
 		w.Header().Add("Content-Type", "application/javascript")
 		if err == nil {
-			//hasChange = true
-			scanner := bufio.NewScanner(f)
-			for scanner.Scan() {
-				line := scanner.Text()
-				if strings.HasPrefix(line, "import") {
-					if strings.Contains(line, `'@`) {
-						path_, err := resolveImportPath(rqst_path, line)
-						if err == nil {
-							line = line[0:strings.Index(line, `'@`)] + `'` + path_ + `'`
-							hasChange = true
-						}
-					}
-				}
-				code += line + "\n"
+			// The '@...' imports are rewritten, the result is kept in memory
+			// until the file change.
+			script, err := getRewrittenScript(f, name, rqst_path)
+			if err == nil && script.code != nil {
+				w.Header().Set("ETag", script.etag)
+				serveContent(w, r, name+":"+rqst_path, name, script.modTime, script.code)
+				return
 			}
 		}
 
@@ -621,12 +913,11 @@ func ServeFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	} else if strings.HasSuffix(name, ".html") || strings.HasSuffix(name, ".htm") {
 		w.Header().Add("Content-Type", "text/html")
-	}
 
-	// if the file has change...
-	if !hasChange {
-		http.ServeFile(w, r, name)
-	} else {
-		http.ServeContent(w, r, name, time.Now(), strings.NewReader(code))
+	} else if mimeType := getStreamingMimeType(rqst_path); len(mimeType) > 0 {
+		w.Header().Set("Content-Type", mimeType)
 	}
+
+	// The file is compressed if the client accept it.
+	serveFile(w, r, name)
 }
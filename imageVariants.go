@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/davecourtois/Utility"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// The kind of media job that create the thumbnail and variants of an image.
+const MediaJobImage = "image"
+
+// The widths of the variants of the images, a requested width is rounded to
+// the next one so only a few variants are kept. The variants bigger than the
+// image are not created.
+var imageVariantWidths = []int{320, 640, 1280, 1920}
+
+// The size of the box the thumbnails fit in.
+const imageThumbnailSize = 256
+
+// The images with more pixels are not processed.
+const maxImagePixels = 100 * 1000 * 1000
+
+// The quality of the jpeg and webp variants.
+const imageVariantQuality = 85
+
+// The number of images the requests decode at the same time, a decoded image
+// can take hundreds of megabytes. The jobs are limited by the media workers.
+var imageDecodes = make(chan bool, runtime.NumCPU())
+
+// The variants of an image are created by one request or job at time, the
+// lock of an image is removed when no one use it.
+var imageVariantsLocks = struct {
+	sync.Mutex
+	images map[string]*imageVariantsLock
+}{images: make(map[string]*imageVariantsLock)}
+
+type imageVariantsLock struct {
+	sync.Mutex
+	count int // The number of users of the lock.
+}
+
+/**
+ * Lock the variants of an image, the returned function unlock them.
+ */
+func lockImageVariants(path_ string) func() {
+	imageVariantsLocks.Lock()
+	lock, ok := imageVariantsLocks.images[path_]
+	if !ok {
+		lock = new(imageVariantsLock)
+		imageVariantsLocks.images[path_] = lock
+	}
+	lock.count++
+	imageVariantsLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		imageVariantsLocks.Lock()
+		lock.count--
+		if lock.count == 0 {
+			delete(imageVariantsLocks.images, path_)
+		}
+		imageVariantsLocks.Unlock()
+	}
+}
+
+// Set to 1 when webp can't be encoded (ffmpeg or its webp encoder is
+// missing), the jpeg or png variants are then used.
+var webpUnavailable int32
+
+/**
+ * Return true if the type of a file is one of the images variants can be
+ * created of.
+ */
+func isImageMimeType(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+
+	return false
+}
+
+/**
+ * Return the directory of the thumbnail and variants of an image.
+ */
+func getImageVariantsDir(path_ string) string {
+	return getGeneratedFilesDir(path_) + "/__variants__"
+}
+
+/**
+ * Return the extension of an image without the dot (jpg, png, gif or webp).
+ */
+func getImageExtension(path_ string) string {
+	extension := strings.TrimPrefix(strings.ToLower(filepath.Ext(path_)), ".")
+	if extension == "jpeg" {
+		return "jpg"
+	}
+
+	return extension
+}
+
+/**
+ * Return the format of a variant of an image. The variants are jpeg for the
+ * jpeg images and png for the others, unless an other format is asked.
+ */
+func getImageFormat(path_ string, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "":
+		if getImageExtension(path_) == "jpg" {
+			return "jpg", nil
+		}
+		return "png", nil
+	case "jpg", "jpeg":
+		return "jpg", nil
+	case "png":
+		return "png", nil
+	case "webp":
+		if atomic.LoadInt32(&webpUnavailable) == 1 {
+			return getImageFormat(path_, "")
+		}
+		return "webp", nil
+	}
+
+	return "", errors.New("unsupported image format " + format)
+}
+
+/**
+ * Decode an image, the exif orientation is applied.
+ */
+func decodeImage(path_ string) (image.Image, error) {
+	data, err := ioutil.ReadFile(path_)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return nil, errors.New("the image " + path_ + " is too big")
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return orientImage(img, getImageOrientation(data)), nil
+}
+
+/**
+ * Return the width of an image as it's displayed (with its exif orientation).
+ */
+func getImageWidth(path_ string) (int, error) {
+	f, err := os.Open(path_)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, err
+	}
+
+	// The exif data are at the beginning of the file.
+	header := make([]byte, 128*1024)
+	n, _ := f.ReadAt(header, 0)
+	if getImageOrientation(header[:n]) >= 5 {
+		return config.Height, nil
+	}
+
+	return config.Width, nil
+}
+
+/**
+ * Turn and flip an image as its exif orientation tell.
+ */
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := bounds.Dx(), bounds.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	}
+
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // flipped horizontally.
+				sx, sy = w-1-x, y
+			case 3: // turned 180°.
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped vertically.
+				sx, sy = x, h-1-y
+			case 5: // transposed.
+				sx, sy = y, x
+			case 6: // turned 90° clockwise.
+				sx, sy = y, h-1-x
+			case 7: // transversed.
+				sx, sy = w-1-y, h-1-x
+			case 8: // turned 90° counterclockwise.
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+
+	return dst
+}
+
+/**
+ * Resize an image to fit in a box, the image is never enlarged.
+ */
+func resizeImage(img image.Image, width int, height int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if (width <= 0 || w <= width) && (height <= 0 || h <= height) {
+		return img
+	}
+
+	// Keep the ratio of the image.
+	if width <= 0 || (height > 0 && h*width > w*height) {
+		width = w * height / h
+	} else {
+		height = h * width / w
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, xdraw.Src, nil)
+
+	return dst
+}
+
+/**
+ * Write an image in a given format (jpg, png or webp), the file is written
+ * atomically. The image is written without its metadata.
+ */
+func writeImage(img image.Image, name string, format string) error {
+	var data bytes.Buffer
+	var err error
+	switch format {
+	case "jpg":
+		err = jpeg.Encode(&data, img, &jpeg.Options{Quality: imageVariantQuality})
+	case "png":
+		err = png.Encode(&data, img)
+	case "webp":
+		// There is no webp encoder in go, ffmpeg is used to convert the png.
+		err = png.Encode(&data, img)
+		if err == nil {
+			var webp []byte
+			webp, err = encodeWebp(data.Bytes())
+			data.Reset()
+			data.Write(webp)
+		}
+	default:
+		err = errors.New("unsupported image format " + format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFileAtomic(name, &data, 0)
+	return err
+}
+
+/**
+ * Convert a png image to webp with ffmpeg.
+ */
+func encodeWebp(data []byte) ([]byte, error) {
+	// ffmpeg -f png_pipe -i pipe:0 -c:v libwebp -quality 85 -f webp pipe:1
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error", "-f", "png_pipe", "-i", "pipe:0", "-c:v", "libwebp", "-quality", strconv.Itoa(imageVariantQuality), "-f", "webp", "pipe:1")
+	cmd.Dir = os.TempDir()
+	cmd.Stdin = bytes.NewReader(data)
+
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, errors.New("fail to encode webp image: " + strings.TrimSpace(stderr.String()) + " " + err.Error())
+	}
+
+	if out.Len() == 0 {
+		return nil, errors.New("fail to encode webp image")
+	}
+
+	return out.Bytes(), nil
+}
+
+/**
+ * Create the thumbnail and the variants of an image. The thumbnail fit in a
+ * box of 256 pixels and the variants have the widths of the variants smaller
+ * than the image, they have the format of the image.
+ */
+func createImageVariants(ctx context.Context, job *MediaJob, progress func(float64)) error {
+	path_ := job.Path
+	if !Utility.Exists(path_) {
+		return errors.New("the file " + path_ + " does not exist")
+	}
+
+	format, err := getImageFormat(path_, "")
+	if err != nil {
+		return err
+	}
+
+	unlock := lockImageVariants(path_)
+	defer unlock()
+
+	img, err := decodeImage(path_)
+	if err != nil {
+		return err
+	}
+
+	dir := getImageVariantsDir(path_)
+	err = Utility.CreateDirIfNotExist(dir)
+	if err != nil {
+		return err
+	}
+
+	widths := make([]int, 0)
+	for _, width := range imageVariantWidths {
+		if width < img.Bounds().Dx() {
+			widths = append(widths, width)
+		}
+	}
+
+	for i, width := range widths {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		name := dir + "/" + strconv.Itoa(width) + "." + format
+		if !Utility.Exists(name) {
+			_, err := writeImageVariant(resizeImage(img, width, 0), name, format)
+			if err != nil {
+				return err
+			}
+		}
+		progress(float64(i+1) / float64(len(widths)+1))
+	}
+
+	// The thumbnail is created last, a missing thumbnail mean the variants
+	// must be created.
+	_, err = writeImageVariant(resizeImage(img, imageThumbnailSize, imageThumbnailSize), dir+"/thumbnail."+format, format)
+	if err != nil {
+		return err
+	}
+
+	path_ = strings.ReplaceAll(path_, globule.data+"/files", "")
+	globule.publish("reload_dir_event", []byte(path.Dir(path_)))
+
+	return nil
+}
+
+/**
+ * Write a variant and return its name, the webp variants are written in png
+ * when webp can't be encoded.
+ */
+func writeImageVariant(img image.Image, name string, format string) (string, error) {
+	if format == "webp" {
+		err := writeImage(img, name, format)
+		if err == nil {
+			return name, nil
+		}
+
+		log.Println(err, ", the png images are used instead of webp")
+		atomic.StoreInt32(&webpUnavailable, 1)
+		name, format = strings.TrimSuffix(name, ".webp")+".png", "png"
+	}
+
+	return name, writeImage(img, name, format)
+}
+
+/**
+ * Return the file of an image to serve for a request. The width (w) is
+ * rounded to the next variant width and the format (jpg, png or webp) can
+ * be changed, the variant is created the first time it's asked. The exif and
+ * xmp gps data can be removed (strip=gps), the variants never contain metadata.
+ * The image itself is return if no variant is asked.
+ */
+func getRequestedImage(r *http.Request, path_ string) (string, error) {
+	width_, format_, strip := r.URL.Query().Get("w"), r.URL.Query().Get("format"), r.URL.Query().Get("strip")
+	if len(width_)+len(format_)+len(strip) == 0 || !isImageMimeType(getFileMimeType(path_)) {
+		return path_, nil
+	}
+
+	info, err := os.Stat(path_)
+	if err != nil {
+		return "", err
+	}
+
+	if len(strip) > 0 && strip != "gps" {
+		return "", newUploadError(http.StatusBadRequest, "only the gps data can be stripped")
+	}
+
+	imageWidth, err := getImageWidth(path_)
+	if err != nil {
+		return "", err
+	}
+
+	width := imageWidth
+	if len(width_) > 0 {
+		width, err = strconv.Atoi(width_)
+		if err != nil || width <= 0 {
+			return "", newUploadError(http.StatusBadRequest, "invalid image width "+width_)
+		}
+
+		// The closest variant not smaller than the width, or the image
+		// itself if the width is larger than all variants.
+		requested := width
+		width = imageWidth
+		for _, variantWidth := range imageVariantWidths {
+			if variantWidth >= requested {
+				width = variantWidth
+				break
+			}
+		}
+		if width > imageWidth {
+			width = imageWidth
+		}
+	}
+
+	format, err := getImageFormat(path_, format_)
+	if err != nil {
+		return "", newUploadError(http.StatusBadRequest, err.Error())
+	}
+
+	dir := getImageVariantsDir(path_)
+	name := dir + "/" + strconv.Itoa(width) + "." + format
+	if width == imageWidth && format == getImageExtension(path_) {
+		// The image itself is only copied to remove its gps data.
+		if len(strip) == 0 {
+			return path_, nil
+		}
+		name = dir + "/stripped." + format
+	}
+
+	// The variants are created again when the image change.
+	if variant, err := os.Stat(name); err == nil && !variant.ModTime().Before(info.ModTime()) {
+		return name, nil
+	}
+
+	unlock := lockImageVariants(path_)
+	defer unlock()
+
+	// The variant can be created by another request while waiting.
+	if variant, err := os.Stat(name); err == nil && !variant.ModTime().Before(info.ModTime()) {
+		return name, nil
+	}
+
+	// Wait for a decode slot, the request can be canceled while waiting.
+	select {
+	case imageDecodes <- true:
+		defer func() { <-imageDecodes }()
+	case <-r.Context().Done():
+		return "", r.Context().Err()
+	}
+
+	err = Utility.CreateDirIfNotExist(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(filepath.Base(name), "stripped.") {
+		data, err := ioutil.ReadFile(path_)
+		if err != nil {
+			return "", err
+		}
+		_, err = writeFileAtomic(name, bytes.NewReader(stripImageGps(data)), 0)
+		return name, err
+	}
+
+	img, err := decodeImage(path_)
+	if err != nil {
+		return "", err
+	}
+
+	return writeImageVariant(resizeImage(img, width, 0), name, format)
+}
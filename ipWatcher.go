@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/davecourtois/Utility"
+)
+
+/**
+ * The addresses of the computer.
+ */
+type IpAddresses struct {
+	Public   string // the public ip v4 address
+	PublicV6 string // the global ip v6 address, empty if the computer has none
+	Local    string // the local ip v4 address
+}
+
+/**
+ * Return the addresses of the computer.
+ */
+type IpLookup func() (*IpAddresses, error)
+
+/**
+ * Get the addresses from the network, the public address is ask to an
+ * external service.
+ */
+func defaultIpLookup() (*IpAddresses, error) {
+	publicIp := Utility.MyIP()
+	if len(publicIp) == 0 {
+		return nil, errors.New("fail to get the public ip address")
+	}
+
+	return &IpAddresses{Public: publicIp, PublicV6: myIPv6(), Local: Utility.MyLocalIP()}, nil
+}
+
+/**
+ * Return the global unicast ip v6 address of the computer. Link local and
+ * unique local (fc00::/7) addresses are not reachable from internet and are
+ * ignored.
+ */
+func myIPv6() string {
+	_, uniqueLocal, _ := net.ParseCIDR("fc00::/7")
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+
+		if ipNet.IP.IsGlobalUnicast() && !uniqueLocal.Contains(ipNet.IP) {
+			return ipNet.IP.String()
+		}
+	}
+
+	return ""
+}
+
+/**
+ * Return the addresses with the ip lookup of the globule.
+ */
+func (globule *Globule) lookupIp() (*IpAddresses, error) {
+	if globule.ipLookup != nil {
+		return globule.ipLookup()
+	}
+	return defaultIpLookup()
+}
+
+/**
+ * Return true if the globule address is register on a dns or a registrar.
+ */
+func (globule *Globule) hasDnsProviders() bool {
+	return len(globule.DNS) > 0 || len(globule.DnsUpdateIpInfos) > 0
+}
+
+/**
+ * Look for a change of the public or the local ip addresses. When a public
+ * address change the globule is registered again on the dns. The ip_changed
+ * event is published for any change.
+ */
+func (globule *Globule) checkIpChange(previous *IpAddresses) *IpAddresses {
+	addresses, err := globule.lookupIp()
+	if err != nil {
+		log.Println("fail to get ip address with error ", err)
+		return previous
+	}
+
+	if *addresses == *previous {
+		return previous // nothing to do.
+	}
+
+	log.Println("ip address has change from", previous, "to", addresses)
+
+	infos := map[string]interface{}{
+		"domain":               globule.getDomain(),
+		"previous_public_ip":   previous.Public,
+		"public_ip":            addresses.Public,
+		"previous_public_ipv6": previous.PublicV6,
+		"public_ipv6":          addresses.PublicV6,
+		"previous_local_ip":    previous.Local,
+		"local_ip":             addresses.Local,
+	}
+
+	if (addresses.Public != previous.Public || addresses.PublicV6 != previous.PublicV6) && globule.hasDnsProviders() {
+		err := globule.registerIpToDns(addresses)
+		if err != nil {
+			log.Println("fail to register ip address with error ", err)
+			infos["error"] = err.Error()
+		}
+	}
+
+	data, _ := json.Marshal(infos)
+	globule.publish("ip_changed", data)
+
+	return addresses
+}
+
+/**
+ * Watch the ip address until the server exit. The addresses are check every
+ * WatchIpDelay seconds, a delay of 0 disable the watch.
+ */
+func (globule *Globule) startIpWatcher() {
+	if globule.WatchIpDelay <= 0 {
+		return
+	}
+
+	go func() {
+		// The address at start time, the dns registration is made by Listen.
+		addresses, err := globule.lookupIp()
+		if err != nil {
+			log.Println("fail to get ip address with error ", err)
+			addresses = new(IpAddresses)
+		}
+
+		ticker := time.NewTicker(time.Duration(globule.WatchIpDelay) * time.Second)
+		for {
+			select {
+			case <-ticker.C:
+				addresses = globule.checkIpChange(addresses)
+			case <-globule.exit:
+				ticker.Stop()
+				return // exit from the loop when the service exit.
+			}
+		}
+	}()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+/**
+ * Return a globule registered on a fake dns, its addresses are given by the
+ *  returned function. The lookups and the events published by the globule are
+ * kept by the returned recorder.
+ */
+func newTestIpGlobule(name string) (*Globule, func(addresses *IpAddresses, err error), *ipTestRecorder) {
+	var current *IpAddresses
+	var lookupErr error
+	recorder := new(ipTestRecorder)
+
+	g := new(Globule)
+	g.DnsUpdateIpInfos = []interface{}{map[string]interface{}{"Type": "fake", "Name": name}}
+	g.publisher = recorder.publish
+	g.ipLookup = func() (*IpAddresses, error) {
+		recorder.lookups++
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		addresses := *current
+		return &addresses, nil
+	}
+
+	return g, func(addresses *IpAddresses, err error) {
+		current, lookupErr = addresses, err
+	}, recorder
+}
+
+/**
+ * Keep the ip lookups and the published events of a test globule.
+ */
+type ipTestRecorder struct {
+	events  []string
+	data    []map[string]interface{}
+	lookups int
+}
+
+func (recorder *ipTestRecorder) publish(event string, data []byte) error {
+	infos := make(map[string]interface{})
+	json.Unmarshal(data, &infos)
+	recorder.events = append(recorder.events, event)
+	recorder.data = append(recorder.data, infos)
+	return nil
+}
+
+func TestCheckIpChange(t *testing.T) {
+	g, setIp, recorder := newTestIpGlobule("TestCheckIpChange")
+	previous := &IpAddresses{Public: "1.2.3.4", Local: "192.168.0.2"}
+
+	// Nothing change, nothing is registered.
+	setIp(&IpAddresses{Public: "1.2.3.4", Local: "192.168.0.2"}, nil)
+	addresses := g.checkIpChange(previous)
+	if addresses != previous {
+		t.Fatalf("expected the previous addresses, got %v", addresses)
+	}
+	if GetFakeDnsProvider("TestCheckIpChange") != nil {
+		t.Fatal("the dns was updated without ip change")
+	}
+	if len(recorder.events) != 0 {
+		t.Fatalf("unexpected events %v", recorder.events)
+	}
+
+	// The public address change, the globule is registered again.
+	setIp(&IpAddresses{Public: "5.6.7.8", PublicV6: "2001:db8::1", Local: "192.168.0.2"}, nil)
+	addresses = g.checkIpChange(previous)
+	if addresses.Public != "5.6.7.8" {
+		t.Fatalf("expected the new addresses, got %v", addresses)
+	}
+
+	provider := GetFakeDnsProvider("TestCheckIpChange")
+	if provider == nil || provider.GetRecord("A") != "5.6.7.8" || provider.GetRecord("AAAA") != "2001:db8::1" {
+		t.Fatal("the new address was not registered")
+	}
+
+	// The registration use the addresses of the check.
+	if recorder.lookups != 2 {
+		t.Fatalf("expected one lookup by check, got %d lookups", recorder.lookups)
+	}
+	if len(recorder.events) != 1 || recorder.events[0] != "ip_changed" || recorder.data[0]["public_ip"] != "5.6.7.8" || recorder.data[0]["previous_public_ip"] != "1.2.3.4" {
+		t.Fatalf("expected the ip_changed event, got %v %v", recorder.events, recorder.data)
+	}
+
+	// Only the local address change, the dns is not updated.
+	setIp(&IpAddresses{Public: "5.6.7.8", PublicV6: "2001:db8::1", Local: "192.168.0.3"}, nil)
+	addresses = g.checkIpChange(addresses)
+	if addresses.Local != "192.168.0.3" {
+		t.Fatalf("expected the new local address, got %v", addresses)
+	}
+	if len(provider.Records["A"]) != 1 {
+		t.Fatalf("the dns was updated for a local address change %v", provider.Records)
+	}
+	if len(recorder.events) != 2 || recorder.data[1]["local_ip"] != "192.168.0.3" {
+		t.Fatalf("expected the ip_changed event of the local address, got %v", recorder.data)
+	}
+
+	// The lookup fail, the addresses are kept.
+	setIp(nil, errors.New("network unreachable"))
+	if g.checkIpChange(addresses) != addresses {
+		t.Fatal("expected the previous addresses when the lookup fail")
+	}
+}
+
+func TestCheckIpChangeRegistrationError(t *testing.T) {
+	g, setIp, recorder := newTestIpGlobule("TestCheckIpChangeRegistrationError")
+	g.DnsUpdateIpInfos = []interface{}{map[string]interface{}{"Type": "fake", "Name": "TestCheckIpChangeRegistrationError", "Error": "unavailable"}}
+
+	// The new addresses are kept even if the dns can't be updated.
+	setIp(&IpAddresses{Public: "5.6.7.8"}, nil)
+	addresses := g.checkIpChange(&IpAddresses{Public: "1.2.3.4"})
+	if addresses.Public != "5.6.7.8" {
+		t.Fatalf("expected the new addresses, got %v", addresses)
+	}
+
+	// The error is published with the change.
+	if len(recorder.data) != 1 || recorder.data[0]["error"] != "unavailable" {
+		t.Fatalf("expected the registration error in the event, got %v", recorder.data)
+	}
+}
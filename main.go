@@ -60,10 +60,8 @@ func (g *Globule) run() error {
 func (g *Globule) Stop(s service.Service) error {
 	// Any work in Stop should be quick, usually a few seconds at most.
 	logger.Info("Globular is stopping!")
-	g.exit_ = true
 	g.stopServices()
-
-	close(g.exit)
+	g.closeExit()
 	return nil
 }
 
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The status of a media job.
+const (
+	MediaJobPending  = "pending"
+	MediaJobRunning  = "running"
+	MediaJobDone     = "done"
+	MediaJobFailed   = "failed"
+	MediaJobCanceled = "canceled"
+)
+
+// The kind of media job.
+const (
+	MediaJobConvert = "convert" // Convert a video to mp4.
+	MediaJobPreview = "preview" // Create the preview images of a video.
+)
+
+// The delay before the first retry of a failed job, the delay is doubled at
+// each attempt.
+var mediaJobRetryDelay = 30 * time.Second
+
+// The maximum delay between two attempts.
+var mediaJobMaxRetryDelay = time.Hour
+
+// The progress of a running job is saved at most once per interval.
+const mediaJobSaveInterval = 5 * time.Second
+
+/**
+ * A media processing job, the path is the path of the file on the disk.
+ */
+type MediaJob struct {
+	Id       string
+	Type     string
+	Path     string
+	Status   string
+	Progress float64 // From 0 to 1.
+	Attempts int
+	Error    string
+	Created  time.Time
+	Updated  time.Time
+	NextRun  time.Time // A failed job is retried after that time.
+}
+
+/**
+ * The function that process a kind of job, the progress function can be
+ * called with the progress from 0 to 1.
+ */
+type MediaJobHandler func(ctx context.Context, job *MediaJob, progress func(float64)) error
+
+/**
+ * The queue of the media jobs, the jobs are kept in a leveldb database so
+ * they survive a restart.
+ */
+type MediaQueue struct {
+	sync.Mutex
+	db       *leveldb.DB
+	jobs     map[string]*MediaJob
+	cancels  map[string]context.CancelFunc
+	handlers map[string]MediaJobHandler
+	wakeup   chan bool
+	done     chan bool
+	workers  sync.WaitGroup
+}
+
+/**
+ * Open the media queue, the jobs interrupted by a stop are run again.
+ */
+func NewMediaQueue(path string) (*MediaQueue, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		db, err = leveldb.RecoverFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	queue := &MediaQueue{
+		db:       db,
+		jobs:     make(map[string]*MediaJob),
+		cancels:  make(map[string]context.CancelFunc),
+		handlers: make(map[string]MediaJobHandler),
+		wakeup:   make(chan bool, 1),
+		done:     make(chan bool),
+	}
+
+	iterator := db.NewIterator(util.BytesPrefix([]byte("job:")), nil)
+	for iterator.Next() {
+		job := new(MediaJob)
+		if json.Unmarshal(iterator.Value(), job) != nil {
+			continue
+		}
+
+		if job.Status == MediaJobRunning {
+			job.Status = MediaJobPending
+			job.Progress = 0
+		}
+		queue.jobs[job.Id] = job
+	}
+	iterator.Release()
+
+	return queue, iterator.Error()
+}
+
+/**
+ * Set the function that process a kind of job.
+ */
+func (queue *MediaQueue) Handle(jobType string, handler MediaJobHandler) {
+	queue.Lock()
+	defer queue.Unlock()
+	queue.handlers[jobType] = handler
+}
+
+/**
+ * Save a job, must be called with the queue locked.
+ */
+func (queue *MediaQueue) save(job *MediaJob) error {
+	job.Updated = time.Now()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return queue.db.Put([]byte("job:"+job.Id), data, nil)
+}
+
+/**
+ * Wake up a worker.
+ */
+func (queue *MediaQueue) notify() {
+	select {
+	case queue.wakeup <- true:
+	default:
+	}
+}
+
+/**
+ * Add a job to the queue. If the same job is already pending or running the
+ * existing job is return.
+ */
+func (queue *MediaQueue) Add(jobType string, path string) (*MediaJob, error) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for _, job := range queue.jobs {
+		if job.Type == jobType && job.Path == path && (job.Status == MediaJobPending || job.Status == MediaJobRunning) {
+			return job, nil
+		}
+	}
+
+	job := &MediaJob{Id: Utility.RandomUUID(), Type: jobType, Path: path, Status: MediaJobPending, Created: time.Now()}
+	err := queue.save(job)
+	if err != nil {
+		return nil, err
+	}
+
+	queue.jobs[job.Id] = job
+	queue.notify()
+
+	return job, nil
+}
+
+/**
+ * Cancel a pending or running job.
+ */
+func (queue *MediaQueue) Cancel(id string) error {
+	queue.Lock()
+	defer queue.Unlock()
+
+	job, ok := queue.jobs[id]
+	if !ok {
+		return errors.New("no job found with id " + id)
+	}
+
+	if job.Status != MediaJobPending && job.Status != MediaJobRunning {
+		return errors.New("the job " + id + " is " + job.Status)
+	}
+
+	if cancel, ok := queue.cancels[id]; ok {
+		// The worker set the status when the job stop.
+		cancel()
+		return nil
+	}
+
+	job.Status = MediaJobCanceled
+	return queue.save(job)
+}
+
+/**
+ * Cancel the pending and running jobs of a file, or of the files of a
+ * directory.
+ */
+func (queue *MediaQueue) CancelPath(path string) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for id, job := range queue.jobs {
+		if job.Path != path && !strings.HasPrefix(job.Path, path+"/") {
+			continue
+		}
+
+		if job.Status != MediaJobPending && job.Status != MediaJobRunning {
+			continue
+		}
+
+		if cancel, ok := queue.cancels[id]; ok {
+			// The worker set the status when the job stop.
+			cancel()
+			continue
+		}
+
+		job.Status = MediaJobCanceled
+		queue.save(job)
+	}
+}
+
+/**
+ * Return a copy of the jobs, the oldest first. Only the jobs with a given
+ * status are return if the status is not empty.
+ */
+func (queue *MediaQueue) List(status string) []*MediaJob {
+	queue.Lock()
+	defer queue.Unlock()
+
+	jobs := make([]*MediaJob, 0, len(queue.jobs))
+	for _, job := range queue.jobs {
+		if len(status) == 0 || job.Status == status {
+			job_ := *job
+			jobs = append(jobs, &job_)
+		}
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+
+	return jobs
+}
+
+/**
+ * Remove the jobs that are finished since a given delay.
+ */
+func (queue *MediaQueue) Purge(delay time.Duration) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for id, job := range queue.jobs {
+		if job.Status != MediaJobPending && job.Status != MediaJobRunning && time.Since(job.Updated) > delay {
+			queue.db.Delete([]byte("job:"+id), nil)
+			delete(queue.jobs, id)
+		}
+	}
+}
+
+/**
+ * Take the oldest job ready to run, nil if there is none.
+ */
+func (queue *MediaQueue) next() (*MediaJob, context.Context) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	if queue.isClosed() {
+		return nil, nil
+	}
+
+	var next *MediaJob
+	now := time.Now()
+	for _, job := range queue.jobs {
+		if job.Status != MediaJobPending || job.NextRun.After(now) {
+			continue
+		}
+		if next == nil || job.Created.Before(next.Created) {
+			next = job
+		}
+	}
+
+	if next == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue.cancels[next.Id] = cancel
+	next.Status = MediaJobRunning
+	next.Progress = 0
+	next.Attempts++
+	next.Error = ""
+	queue.save(next)
+
+	return next, ctx
+}
+
+/**
+ * Run a job and set its status.
+ */
+func (queue *MediaQueue) run(ctx context.Context, job *MediaJob, maxAttempts int) {
+	queue.Lock()
+	handler, ok := queue.handlers[job.Type]
+	path := job.Path
+	queue.Unlock()
+
+	var err error
+	if !ok {
+		err = errors.New("no handler for job " + job.Type)
+	} else {
+		lastSave := time.Now()
+		err = handler(ctx, &MediaJob{Id: job.Id, Type: job.Type, Path: path}, func(progress float64) {
+			queue.Lock()
+			defer queue.Unlock()
+			job.Progress = math.Max(0, math.Min(progress, 1))
+			if time.Since(lastSave) > mediaJobSaveInterval {
+				queue.save(job)
+				lastSave = time.Now()
+			}
+		})
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+
+	canceled := ctx.Err() != nil
+	if cancel, ok := queue.cancels[job.Id]; ok {
+		cancel()
+		delete(queue.cancels, job.Id)
+	}
+
+	if canceled && queue.isClosed() {
+		// The job will run again when the queue is open.
+		job.Status = MediaJobPending
+		job.Progress = 0
+		job.Attempts--
+	} else if canceled {
+		job.Status = MediaJobCanceled
+		job.Error = "the job was canceled"
+	} else if err == nil {
+		job.Status = MediaJobDone
+		job.Progress = 1
+	} else {
+		job.Error = err.Error()
+		if job.Attempts < maxAttempts {
+			// Retry later, the delay is doubled at each attempt.
+			delay := mediaJobRetryDelay * time.Duration(1<<uint(job.Attempts-1))
+			if delay > mediaJobMaxRetryDelay || delay <= 0 {
+				delay = mediaJobMaxRetryDelay
+			}
+			job.Status = MediaJobPending
+			job.NextRun = time.Now().Add(delay)
+		} else {
+			job.Status = MediaJobFailed
+		}
+		log.Println("media job", job.Type, job.Path, "fail with error", err)
+	}
+
+	queue.save(job)
+}
+
+/**
+ * Start the workers, at most workers jobs are run at the same time.
+ */
+func (queue *MediaQueue) Start(workers int, maxAttempts int) {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		queue.workers.Add(1)
+		go func() {
+			defer queue.workers.Done()
+
+			// The failed jobs are retried when their delay is over.
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+
+			for {
+				job, ctx := queue.next()
+				if job != nil {
+					queue.run(ctx, job, maxAttempts)
+					continue
+				}
+
+				select {
+				case <-queue.wakeup:
+				case <-ticker.C:
+				case <-queue.done:
+					return // exit from the loop when the queue is closed.
+				}
+			}
+		}()
+	}
+}
+
+/**
+ * Return true if the queue is closed.
+ */
+func (queue *MediaQueue) isClosed() bool {
+	select {
+	case <-queue.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * Stop the workers, the running jobs are stopped and will run again when
+ * the queue is open. Closing a closed queue does nothing.
+ */
+func (queue *MediaQueue) Close() {
+	queue.Lock()
+	select {
+	case <-queue.done:
+		queue.Unlock()
+		return
+	default:
+	}
+	close(queue.done)
+	for _, cancel := range queue.cancels {
+		cancel()
+	}
+	queue.Unlock()
+
+	queue.workers.Wait()
+	queue.db.Close()
+}
+
+/**
+ * Run ffmpeg and report its progress, the duration of the input is needed to
+ * compute the progress.
+ */
+func runFfmpeg(ctx context.Context, duration float64, progress func(float64), args ...string) error {
+	args = append([]string{"-hide_banner", "-nostats", "-progress", "pipe:1"}, args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// The progress is a list of key=value, out_time_us is the position in
+	// the output in microseconds.
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		values := strings.SplitN(scanner.Text(), "=", 2)
+		if len(values) != 2 || duration <= 0 {
+			continue
+		}
+
+		if values[0] == "out_time_us" || values[0] == "out_time_ms" {
+			// out_time_ms is also in microseconds.
+			position, err := strconv.ParseFloat(values[1], 64)
+			if err == nil {
+				progress(position / 1000000 / duration)
+			}
+		}
+	}
+	io.Copy(io.Discard, stdout)
+
+	err = cmd.Wait()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// Keep the end of the output, the error is there.
+		msg := stderr.String()
+		if len(msg) > 1024 {
+			msg = msg[len(msg)-1024:]
+		}
+		return errors.New(err.Error() + ": " + strings.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+/**
+ * Return true if a converted video is readable and as long as the original.
+ */
+func isSameVideoDuration(converted float64, duration float64) bool {
+	return converted > 0 && (duration <= 0 || math.Abs(converted-duration) <= math.Max(1, duration*0.01))
+}
+
+/**
+ * Convert all kind of video to mp4 so all browser will be able to read it.
+ * The original is removed only once the mp4 is verified.
+ */
+func createVideoStream(ctx context.Context, job *MediaJob, progress func(float64)) error {
+	path := job.Path
+	if !Utility.Exists(path) {
+		return errors.New("the file " + path + " does not exist")
+	}
+
+	duration := getVideoDuration(path)
+
+	// The mp4 exist if the server was stopped before the original was
+	// removed, the conversion is then done. An other video with the same
+	// name is kept and the video is converted with a number in its name.
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	output := base + ".mp4"
+	for i := 1; Utility.Exists(output); i++ {
+		if duration > 0 && isSameVideoDuration(getVideoDuration(output), duration) {
+			return globule.completeVideoStream(path, output)
+		}
+		output = base + " (" + strconv.Itoa(i) + ").mp4"
+	}
+
+	// The video is written in a temporary file so a partial file is never
+	// served.
+	tmp := filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".tmp.mp4")
+	defer os.Remove(tmp)
+
+	// ffmpeg -i input.mkv -c:v libx264 -c:a aac output.mp4
+	err := runFfmpeg(ctx, duration, progress, "-y", "-i", path, "-c:v", "libx264", "-c:a", "aac", tmp)
+	if err != nil {
+		return err
+	}
+
+	// The converted video must be readable and as long as the original.
+	converted := getVideoDuration(tmp)
+	if !isSameVideoDuration(converted, duration) {
+		return errors.New("the converted video " + output + " is " + Utility.ToString(converted) + " sec instead of " + Utility.ToString(duration) + " sec")
+	}
+
+	err = os.Rename(tmp, output)
+	if err != nil {
+		return err
+	}
+
+	return globule.completeVideoStream(path, output)
+}
+
+/**
+ * Remove the original of a converted video and process the mp4.
+ */
+func (globule *Globule) completeVideoStream(path string, output string) error {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(output); err == nil {
+		globule.updateStorageUsage(strings.TrimPrefix(output, globule.data+"/files"), info.Size()-size)
+	}
+
+	// Create a video preview and the streams.
+	globule.addMediaJobs(output, "video/mp4")
+
+	return nil
+}
+
+/**
+ * Create the preview images of a video.
+ */
+func createVideoPreviewJob(ctx context.Context, job *MediaJob, progress func(float64)) error {
+	return createVideoPreview(ctx, job.Path, 20, 128)
+}
+
+/**
+ * Add the jobs needed for a file, the videos are converted to mp4 and the
+ * previews of the mp4 are created, the thumbnail and variants of the images
+ * are created and the metadata of the media files are extracted.
+ */
+func (globule *Globule) addMediaJobs(path string, mimeType string) {
+	if globule.mediaQueue == nil {
+		return
+	}
+
+	for _, jobType := range globule.getMediaJobTypes(path, mimeType) {
+		_, err := globule.mediaQueue.Add(jobType, path)
+		if err != nil {
+			log.Println("fail to add media job for", path, "with error", err)
+		}
+	}
+}
+
+/**
+ * Return the kinds of jobs a file need, the jobs already done are not
+ * return.
+ */
+func (globule *Globule) getMediaJobTypes(path string, mimeType string) []string {
+	jobTypes := make([]string, 0)
+
+	// The metadata of the videos are extracted once they are converted.
+	if isMediaMimeType(mimeType) && (!strings.HasPrefix(mimeType, "video/") || strings.ToLower(filepath.Ext(path)) == ".mp4") && readMediaMetadata(path) == nil {
+		jobTypes = append(jobTypes, MediaJobMetadata)
+	}
+
+	if isImageMimeType(mimeType) {
+		format, _ := getImageFormat(path, "")
+		if !Utility.Exists(getImageVariantsDir(path) + "/thumbnail." + format) {
+			jobTypes = append(jobTypes, MediaJobImage)
+		}
+		return jobTypes
+	} else if !strings.HasPrefix(mimeType, "video/") {
+		return jobTypes
+	}
+
+	if strings.ToLower(filepath.Ext(path)) != ".mp4" {
+		jobTypes = append(jobTypes, MediaJobConvert)
+	} else {
+		if !Utility.Exists(getVideoPreviewDir(path)) {
+			jobTypes = append(jobTypes, MediaJobPreview)
+		}
+		if globule.HlsStreaming && !Utility.Exists(getVideoHlsDir(path)+"/master.m3u8") {
+			jobTypes = append(jobTypes, MediaJobHls)
+		}
+	}
+
+	return jobTypes
+}
+
+/**
+ * Open the media queue and start its workers.
+ */
+func (globule *Globule) startMediaQueue() error {
+	queue, err := NewMediaQueue(globule.data + "/jobs")
+	if err != nil {
+		return err
+	}
+
+	queue.Handle(MediaJobConvert, createVideoStream)
+	queue.Handle(MediaJobPreview, createVideoPreviewJob)
+	queue.Handle(MediaJobHls, createVideoHls)
+	queue.Handle(MediaJobImage, createImageVariants)
+	queue.Handle(MediaJobMetadata, createMediaMetadata)
+
+	// The finished jobs are kept a week.
+	queue.Purge(7 * 24 * time.Hour)
+
+	globule.mediaQueue = queue
+	queue.Start(globule.MediaWorkers, globule.MediaJobAttempts)
+
+	return nil
+}
+
+/**
+ * Return the media jobs, a status can be given to return only the jobs with
+ * that status.
+ */
+func getMediaJobsHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	_, err := validateRequestToken(r, "/admin.AdminService/GetMediaJobs")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if globule.mediaQueue == nil {
+		http.Error(w, "the media queue is not started", http.StatusServiceUnavailable)
+		return
+	}
+
+	jobs := globule.mediaQueue.List(r.FormValue("status"))
+
+	// Return the path of the resource and not the one on the disk.
+	for _, job := range jobs {
+		if path, err := globule.getResourcePath(job.Path); err == nil {
+			job.Path = path
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+/**
+ * Cancel a media job, the id of the job is given as form value.
+ */
+func cancelMediaJobHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "the job must be canceled with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := validateRequestToken(r, "/admin.AdminService/CancelMediaJob")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if globule.mediaQueue == nil {
+		http.Error(w, "the media queue is not started", http.StatusServiceUnavailable)
+		return
+	}
+
+	err = globule.mediaQueue.Cancel(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Println("media job", r.FormValue("id"), "was canceled by", id)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The kind of media job that extract the metadata of a media file.
+const MediaJobMetadata = "metadata"
+
+// The key of the metadata of a file in the catalog, followed by the path of
+// the file.
+const mediaCatalogKey = "m:"
+
+/**
+ * The metadata of a video, an audio file or an image. The metadata are kept
+ * in a sidecar file (.hidden/<name>/metadata.json) and in the catalog.
+ */
+type MediaMetadata struct {
+	Path     string // The path of the resource (ex. /users/bob/song.mp3)
+	Name     string `json:"-"` // The path of the file on the disk, never sent to the clients.
+	MimeType string
+	Size     int64
+	ModTime  time.Time
+
+	Format     string  // The container of the videos and audio files, the format of the images.
+	Duration   float64 // seconds
+	Bitrate    int64   // bit/s
+	Width      int     // The size of the video or image as it's displayed.
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	FrameRate  float64
+	SampleRate int
+	Channels   int
+
+	// The tags of the audio and video files (ID3, Vorbis comments...), the
+	// names are in lower case (title, artist, album...).
+	Tags map[string]string
+
+	// The exif data of the images.
+	Exif map[string]interface{}
+}
+
+/**
+ * A catalog of the metadata of the media files kept in a leveldb database,
+ * the sidecar files are the reference the catalog is made from.
+ */
+type MediaCatalog struct {
+	db *leveldb.DB
+}
+
+var (
+	mediaCatalog_     *MediaCatalog
+	mediaCatalogMutex sync.Mutex
+)
+
+// The types of audio and video files the system may not know.
+var mediaMimeTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/opus",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wav",
+	".aac":  "audio/aac",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".avi":  "video/x-msvideo",
+	".mov":  "video/quicktime",
+	".webp": "image/webp",
+}
+
+/**
+ * Return true if the metadata of a file can be extracted.
+ */
+func isMediaMimeType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/") || isImageMimeType(mimeType)
+}
+
+/**
+ * Return the path of the metadata sidecar of a file.
+ */
+func getMediaMetadataPath(path_ string) string {
+	return getGeneratedFilesDir(path_) + "/metadata.json"
+}
+
+/**
+ * Return the catalog of the media files, it's open the first time it's
+ * needed.
+ */
+func (globule *Globule) getMediaCatalog() (*MediaCatalog, error) {
+	mediaCatalogMutex.Lock()
+	defer mediaCatalogMutex.Unlock()
+
+	if mediaCatalog_ != nil {
+		return mediaCatalog_, nil
+	}
+
+	path := globule.data + "/search/media"
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		// The catalog can be rebuild from the sidecars.
+		db, err = leveldb.RecoverFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mediaCatalog_ = &MediaCatalog{db: db}
+	return mediaCatalog_, nil
+}
+
+/**
+ * Close the catalog of the media files.
+ */
+func closeMediaCatalog() {
+	mediaCatalogMutex.Lock()
+	defer mediaCatalogMutex.Unlock()
+
+	if mediaCatalog_ != nil {
+		mediaCatalog_.db.Close()
+		mediaCatalog_ = nil
+	}
+}
+
+/**
+ * A file of the catalog, the path of the file on the disk is kept apart from
+ * the metadata that are sent to the clients.
+ */
+type mediaCatalogEntry struct {
+	Name     string
+	Metadata *MediaMetadata
+}
+
+/**
+ * Read an entry of the catalog, nil if it can't be read.
+ */
+func decodeMediaCatalogEntry(data []byte) *MediaMetadata {
+	entry := new(mediaCatalogEntry)
+	if json.Unmarshal(data, entry) != nil || entry.Metadata == nil {
+		return nil
+	}
+
+	entry.Metadata.Name = entry.Name
+	return entry.Metadata
+}
+
+/**
+ * Return the metadata of a file, nil if the file is not in the catalog.
+ */
+func (catalog *MediaCatalog) get(path string) *MediaMetadata {
+	data, err := catalog.db.Get([]byte(mediaCatalogKey+path), nil)
+	if err != nil {
+		return nil
+	}
+
+	return decodeMediaCatalogEntry(data)
+}
+
+/**
+ * Set the metadata of a file.
+ */
+func (catalog *MediaCatalog) put(metadata *MediaMetadata) error {
+	data, err := json.Marshal(&mediaCatalogEntry{Name: metadata.Name, Metadata: metadata})
+	if err != nil {
+		return err
+	}
+
+	return catalog.db.Put([]byte(mediaCatalogKey+metadata.Path), data, nil)
+}
+
+/**
+ * Remove a file, and the files of a directory, from the catalog.
+ */
+func (catalog *MediaCatalog) remove(path string) error {
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(mediaCatalogKey + path))
+
+	it := catalog.db.NewIterator(util.BytesPrefix([]byte(mediaCatalogKey+strings.TrimSuffix(path, "/")+"/")), nil)
+	for it.Next() {
+		batch.Delete(append([]byte{}, it.Key()...))
+	}
+	it.Release()
+
+	if it.Error() != nil {
+		return it.Error()
+	}
+
+	return catalog.db.Write(batch, nil)
+}
+
+/**
+ * Call a function with the metadata of the files of a directory, or all
+ * files if the directory is empty. The files are in the order of their path.
+ */
+func (catalog *MediaCatalog) forEach(dir string, fn func(metadata *MediaMetadata)) error {
+	prefix := mediaCatalogKey
+	if len(dir) > 0 && dir != "/" {
+		prefix += strings.TrimSuffix(dir, "/") + "/"
+	}
+
+	it := catalog.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer it.Release()
+
+	for it.Next() {
+		if metadata := decodeMediaCatalogEntry(it.Value()); metadata != nil {
+			fn(metadata)
+		}
+	}
+
+	return it.Error()
+}
+
+/**
+ * Return the string value of a field of ffprobe output.
+ */
+func getProbeString(values map[string]interface{}, key string) string {
+	if value, ok := values[key]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+
+	return ""
+}
+
+/**
+ * Extract the metadata of an audio or a video file with ffprobe.
+ */
+func probeMediaFile(ctx context.Context, path_ string, metadata *MediaMetadata) error {
+	// ffprobe -v quiet -print_format json -show_format -show_streams song.mp3
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", path_)
+	cmd.Dir = os.TempDir()
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if err != nil {
+		return errors.New("fail to probe " + path_ + " with error " + err.Error())
+	}
+
+	probe := make(map[string]interface{})
+	err = json.Unmarshal(out.Bytes(), &probe)
+	if err != nil {
+		return err
+	}
+
+	metadata.Tags = make(map[string]string)
+	addTags := func(values map[string]interface{}) {
+		tags, _ := values["tags"].(map[string]interface{})
+		for name, value := range tags {
+			// The tags of the container are kept over the tags of the streams.
+			name = strings.ToLower(name)
+			if _, ok := metadata.Tags[name]; !ok {
+				metadata.Tags[name] = fmt.Sprint(value)
+			}
+		}
+	}
+
+	if format, ok := probe["format"].(map[string]interface{}); ok {
+		metadata.Format = getProbeString(format, "format_name")
+		metadata.Duration, _ = strconv.ParseFloat(getProbeString(format, "duration"), 64)
+		metadata.Bitrate, _ = strconv.ParseInt(getProbeString(format, "bit_rate"), 10, 64)
+		addTags(format)
+	}
+
+	streams, _ := probe["streams"].([]interface{})
+	for _, stream := range streams {
+		stream, ok := stream.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		// The covers of the audio files are video streams.
+		disposition, _ := stream["disposition"].(map[string]interface{})
+		if getProbeString(disposition, "attached_pic") == "1" {
+			continue
+		}
+
+		switch getProbeString(stream, "codec_type") {
+		case "video":
+			if len(metadata.VideoCodec) > 0 {
+				continue
+			}
+			metadata.VideoCodec = getProbeString(stream, "codec_name")
+			metadata.Width, _ = strconv.Atoi(getProbeString(stream, "width"))
+			metadata.Height, _ = strconv.Atoi(getProbeString(stream, "height"))
+
+			// The frame rate is a fraction (ex. 30000/1001).
+			rate := strings.Split(getProbeString(stream, "avg_frame_rate"), "/")
+			if len(rate) == 2 {
+				numerator, _ := strconv.ParseFloat(rate[0], 64)
+				denominator, _ := strconv.ParseFloat(rate[1], 64)
+				if denominator > 0 {
+					metadata.FrameRate = numerator / denominator
+				}
+			}
+		case "audio":
+			if len(metadata.AudioCodec) > 0 {
+				continue
+			}
+			metadata.AudioCodec = getProbeString(stream, "codec_name")
+			metadata.SampleRate, _ = strconv.Atoi(getProbeString(stream, "sample_rate"))
+			metadata.Channels, _ = strconv.Atoi(getProbeString(stream, "channels"))
+		default:
+			continue
+		}
+
+		// The Vorbis comments of the ogg files are in the audio stream.
+		addTags(stream)
+	}
+
+	return nil
+}
+
+/**
+ * Extract the metadata of an image, its size and its exif data.
+ */
+func readImageMetadata(path_ string, metadata *MediaMetadata) error {
+	f, err := os.Open(path_)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+
+	metadata.Format = format
+	metadata.Width = config.Width
+	metadata.Height = config.Height
+
+	// The exif data are at the beginning of the file.
+	header := make([]byte, 256*1024)
+	n, _ := f.ReadAt(header, 0)
+	if exif := readExif(header[:n]); exif != nil {
+		metadata.Exif = exif.tags()
+
+		// The position of the images is private unless configured otherwise.
+		if !globule.MediaGpsMetadata {
+			for tag := range metadata.Exif {
+				if strings.HasPrefix(tag, "GPS") {
+					delete(metadata.Exif, tag)
+				}
+			}
+		}
+
+		if exif.orientation() >= 5 {
+			metadata.Width, metadata.Height = metadata.Height, metadata.Width
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Extract the metadata of a media file.
+ */
+func extractMediaMetadata(ctx context.Context, path_ string) (*MediaMetadata, error) {
+	info, err := os.Stat(path_)
+	if err != nil {
+		return nil, err
+	}
+
+	resource, err := globule.getResourcePath(path_)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &MediaMetadata{Path: resource, Name: filepath.ToSlash(path_), MimeType: getFileMimeType(path_), Size: info.Size(), ModTime: info.ModTime()}
+	if isImageMimeType(metadata.MimeType) {
+		err = readImageMetadata(path_, metadata)
+	} else {
+		err = probeMediaFile(ctx, path_, metadata)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+/**
+ * Return the metadata of a file from its sidecar, nil if the metadata were
+ * not extracted or were extracted from a previous version of the file.
+ */
+func readMediaMetadata(path_ string) *MediaMetadata {
+	info, err := os.Stat(path_)
+	if err != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(getMediaMetadataPath(path_))
+	if err != nil {
+		return nil
+	}
+
+	metadata := new(MediaMetadata)
+	if json.Unmarshal(data, metadata) != nil || metadata.Size != info.Size() || !metadata.ModTime.Equal(info.ModTime()) {
+		return nil
+	}
+
+	return metadata
+}
+
+/**
+ * Set the metadata of a file in the catalog from its sidecar. The file can
+ * be moved with its sidecar so its path is set again.
+ */
+func (globule *Globule) catalogMediaFile(path_ string) error {
+	metadata := readMediaMetadata(path_)
+	if metadata == nil {
+		return errors.New("no metadata found for " + path_)
+	}
+
+	resource, err := globule.getResourcePath(path_)
+	if err != nil {
+		return err
+	}
+
+	metadata.Path = resource
+	metadata.Name = filepath.ToSlash(path_)
+
+	catalog, err := globule.getMediaCatalog()
+	if err != nil {
+		return err
+	}
+
+	return catalog.put(metadata)
+}
+
+/**
+ * Remove a file, or the files of a directory, from the catalog.
+ */
+func (globule *Globule) removeMediaCatalog(path_ string) error {
+	resource, err := globule.getResourcePath(path_)
+	if err != nil {
+		return err
+	}
+
+	catalog, err := globule.getMediaCatalog()
+	if err != nil {
+		return err
+	}
+
+	return catalog.remove(resource)
+}
+
+/**
+ * Extract the metadata of a media file, the metadata are written in the
+ * sidecar of the file and set in the catalog.
+ */
+func createMediaMetadata(ctx context.Context, job *MediaJob, progress func(float64)) error {
+	path_ := job.Path
+	if !Utility.Exists(path_) {
+		return errors.New("the file " + path_ + " does not exist")
+	}
+
+	metadata, err := extractMediaMetadata(ctx, path_)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := getMediaMetadataPath(path_)
+	err = Utility.CreateDirIfNotExist(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFileAtomic(name, bytes.NewReader(data), 0)
+	if err != nil {
+		return err
+	}
+
+	return globule.catalogMediaFile(path_)
+}
+
+/**
+ * Return true if the metadata of a file match the filters of a request.
+ */
+func matchMediaMetadata(metadata *MediaMetadata, filters map[string][]string) bool {
+	for key, values := range filters {
+		value := values[0]
+		if len(value) == 0 {
+			continue
+		}
+
+		switch {
+		case key == "type":
+			if !strings.HasPrefix(metadata.MimeType, value+"/") {
+				return false
+			}
+		case key == "codec":
+			if !strings.EqualFold(metadata.VideoCodec, value) && !strings.EqualFold(metadata.AudioCodec, value) {
+				return false
+			}
+		case key == "q":
+			// The text is search in the name and the tags of the file.
+			text := strings.ToLower(filepath.Base(metadata.Path))
+			for _, tag := range metadata.Tags {
+				text += "\n" + strings.ToLower(tag)
+			}
+			if !strings.Contains(text, strings.ToLower(value)) {
+				return false
+			}
+		case strings.HasPrefix(key, "tag."):
+			if !strings.EqualFold(metadata.Tags[strings.ToLower(strings.TrimPrefix(key, "tag."))], value) {
+				return false
+			}
+		case strings.HasPrefix(key, "exif."):
+			exif, ok := metadata.Exif[strings.TrimPrefix(key, "exif.")]
+			if !ok || !strings.EqualFold(fmt.Sprint(exif), value) {
+				return false
+			}
+		case key == "min_duration" || key == "max_duration" || key == "min_width" || key == "max_width" || key == "min_height" || key == "max_height":
+			limit, _ := strconv.ParseFloat(value, 64)
+			field := metadata.Duration
+			if strings.HasSuffix(key, "_width") {
+				field = float64(metadata.Width)
+			} else if strings.HasSuffix(key, "_height") {
+				field = float64(metadata.Height)
+			}
+			if (strings.HasPrefix(key, "min_") && field < limit) || (strings.HasPrefix(key, "max_") && field > limit) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+/**
+ * Search the catalog of the media files. The search can be limited to a
+ * directory (path) and the files are filtered with:
+ *   type: audio, video or image
+ *   q: a text in the name or the tags of the files
+ *   codec: the video or audio codec
+ *   tag.<name>: the value of a tag (ex. tag.artist=...)
+ *   exif.<name>: the value of an exif tag (ex. exif.Model=...)
+ *   min_duration, max_duration, min_width, max_width, min_height, max_height
+ * The files are sorted (sort) by path, name, duration, size, modtime or a tag
+ * (ex. tag.track), a '-' before the field sort them in reverse order. The
+ * results are paginated with offset and limit, More is true if there is a next
+ * page. Only the files the requester can read are return.
+ */
+func searchMediaHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir := ""
+	if len(r.Form.Get("path")) > 0 {
+		dir = cleanUploadPath(r.Form.Get("path"))
+	}
+
+	offset, _ := strconv.Atoi(r.Form.Get("offset"))
+	limit, err := strconv.Atoi(r.Form.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	catalog, err := globule.getMediaCatalog()
+	if err != nil {
+		http.Error(w, "fail to open the media catalog with error "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	matches := make([]*MediaMetadata, 0)
+	err = catalog.forEach(dir, func(metadata *MediaMetadata) {
+		if matchMediaMetadata(metadata, r.Form) {
+			matches = append(matches, metadata)
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A single file can be asked.
+	if metadata := catalog.get(dir); metadata != nil && matchMediaMetadata(metadata, r.Form) {
+		matches = append(matches, metadata)
+	}
+
+	sortMediaMetadata(matches, r.Form.Get("sort"))
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	// The access is validated in the order of the results until the page
+	// and the first result of the next page are found.
+	hasAccess := globule.getFileAccessValidator(r, r.Header.Get("application"), "/file.FileService/ServeFileHandler", "read")
+	results := make([]*MediaMetadata, 0, limit+1)
+	found := 0
+	for _, metadata := range matches {
+		if found > offset+limit {
+			break
+		}
+
+		if !hasAccess(metadata.Path) {
+			continue
+		}
+
+		// The file can be deleted by another process.
+		if !Utility.Exists(metadata.Name) {
+			catalog.db.Delete([]byte(mediaCatalogKey+metadata.Path), nil)
+			continue
+		}
+
+		if found >= offset {
+			results = append(results, metadata)
+		}
+		found++
+	}
+
+	more := len(results) > limit
+	if more {
+		results = results[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"More": more, "Results": results})
+}
+
+/**
+ * Sort the metadata of files by a field, the files are in the order of their
+ * path if the field is unknown.
+ */
+func sortMediaMetadata(results []*MediaMetadata, field string) {
+	reverse := strings.HasPrefix(field, "-")
+	field = strings.TrimPrefix(field, "-")
+
+	less := func(a, b *MediaMetadata) bool {
+		switch {
+		case field == "name":
+			return strings.ToLower(filepath.Base(a.Path)) < strings.ToLower(filepath.Base(b.Path))
+		case field == "duration":
+			return a.Duration < b.Duration
+		case field == "size":
+			return a.Size < b.Size
+		case field == "modtime":
+			return a.ModTime.Before(b.ModTime)
+		case strings.HasPrefix(field, "tag."):
+			// The numbers (ex. track, year) are compare as numbers.
+			tag := strings.TrimPrefix(field, "tag.")
+			x, errX := strconv.Atoi(strings.Split(a.Tags[tag], "/")[0])
+			y, errY := strconv.Atoi(strings.Split(b.Tags[tag], "/")[0])
+			if errX == nil && errY == nil {
+				return x < y
+			}
+			return strings.ToLower(a.Tags[tag]) < strings.ToLower(b.Tags[tag])
+		}
+		return a.Path < b.Path
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if reverse {
+			return less(results[j], results[i])
+		}
+		return less(results[i], results[j])
+	})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default delay in seconds between two health checks of an upstream.
+const defaultHealthCheckInterval = 10
+
+/**
+ * A route of the http server to one or more http backends. The requests are
+ * distributed to the healthy upstreams in round robin. A header with an empty
+ * value is removed.
+ */
+type ProxyRoute struct {
+	Host                string            // The host of the request, without the port, empty match any host.
+	PathPrefix          string            // The prefix of the request path.
+	Upstreams           []string          // The backends urls ex. http://localhost:8080
+	StripPrefix         bool              // Remove the path prefix before sending the request.
+	RequestHeaders      map[string]string // The headers to set on the request sent to the upstream.
+	ResponseHeaders     map[string]string // The headers to set on the response sent to the client.
+	HealthCheckPath     string            // The path to get to test the upstream, a tcp connection is made if empty.
+	HealthCheckInterval int               // The delay in seconds between two health checks.
+	Public              bool              // The route can be used without application or token.
+}
+
+/**
+ * Return true if the route apply to a request.
+ */
+func (route *ProxyRoute) match(host string, rqst_path string) bool {
+	if len(route.Host) > 0 && !strings.EqualFold(route.Host, host) {
+		return false
+	}
+
+	prefix := strings.TrimSuffix(route.PathPrefix, "/")
+	return len(prefix) == 0 || rqst_path == prefix || strings.HasPrefix(rqst_path, prefix+"/")
+}
+
+/**
+ * A backend of a route.
+ */
+type proxyUpstream struct {
+	target    *url.URL
+	proxy     *httputil.ReverseProxy
+	healthy   bool
+	lastCheck time.Time
+}
+
+/**
+ * The runtime of a route, it's created the first time the route is used and
+ * kept as long as the route configuration is the same.
+ */
+type proxyRouteState struct {
+	route     *ProxyRoute
+	upstreams []*proxyUpstream
+	next      int
+}
+
+/**
+ * The reverse proxy of the http server.
+ */
+type ReverseProxy struct {
+	sync.Mutex
+	states map[*ProxyRoute]*proxyRouteState
+}
+
+/**
+ * Create the reverse proxy.
+ */
+func NewReverseProxy() *ReverseProxy {
+	return &ReverseProxy{states: make(map[*ProxyRoute]*proxyRouteState)}
+}
+
+/**
+ * Return the route of a request, the one with the longest path prefix is
+ * taken if more than one route match.
+ */
+func (globule *Globule) getProxyRoute(r *http.Request) *ProxyRoute {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	rqst_path := path.Clean(r.URL.Path)
+
+	var route *ProxyRoute
+	for _, route_ := range globule.ProxyRoutes {
+		if len(route_.Upstreams) == 0 || !route_.match(host, rqst_path) {
+			continue
+		}
+
+		if route == nil || len(route_.PathPrefix) > len(route.PathPrefix) {
+			route = route_
+		}
+	}
+
+	return route
+}
+
+/**
+ * Set or remove headers, a header with an empty value is removed.
+ */
+func rewriteHeaders(header http.Header, values map[string]string) {
+	for key, value := range values {
+		if len(value) == 0 {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+}
+
+/**
+ * Create the proxy of an upstream of a route.
+ */
+func newProxyUpstream(route *ProxyRoute, target *url.URL) *proxyUpstream {
+	upstream := &proxyUpstream{target: target, healthy: true}
+
+	upstream.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			rqst_path := r.URL.Path
+			if route.StripPrefix {
+				rqst_path = strings.TrimPrefix(rqst_path, strings.TrimSuffix(route.PathPrefix, "/"))
+				if !strings.HasPrefix(rqst_path, "/") {
+					rqst_path = "/" + rqst_path
+				}
+			}
+
+			r.URL.Scheme = target.Scheme
+			r.URL.Host = target.Host
+			r.URL.Path = strings.TrimSuffix(target.Path, "/") + rqst_path
+			r.URL.RawPath = ""
+			if len(target.RawQuery) > 0 {
+				if len(r.URL.RawQuery) > 0 {
+					r.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+				} else {
+					r.URL.RawQuery = target.RawQuery
+				}
+			}
+
+			r.Header.Set("X-Forwarded-Host", r.Host)
+			if r.TLS != nil {
+				r.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				r.Header.Set("X-Forwarded-Proto", "http")
+			}
+
+			// The token is for the globule and not for the backend.
+			r.Header.Del("token")
+
+			rewriteHeaders(r.Header, route.RequestHeaders)
+		},
+		ModifyResponse: func(rsp *http.Response) error {
+			rewriteHeaders(rsp.Header, route.ResponseHeaders)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("fail to reach upstream ", target.String(), " with error ", err)
+
+			// A request canceled by the client say nothing about the upstream.
+			if r.Context().Err() == nil && isUpstreamError(err) {
+				upstream.setHealthy(false)
+			}
+			http.Error(w, "the upstream server is unreachable", http.StatusBadGateway)
+		},
+	}
+
+	return upstream
+}
+
+/**
+ * Return true if the error come from the connection to the upstream, the
+ * upstream is then considered down until its next health check.
+ */
+func isUpstreamError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+var proxyUpstreamsLock sync.RWMutex
+
+func (upstream *proxyUpstream) isHealthy() bool {
+	proxyUpstreamsLock.RLock()
+	defer proxyUpstreamsLock.RUnlock()
+	return upstream.healthy
+}
+
+func (upstream *proxyUpstream) setHealthy(healthy bool) {
+	proxyUpstreamsLock.Lock()
+	defer proxyUpstreamsLock.Unlock()
+	upstream.healthy = healthy
+}
+
+/**
+ * Return the state of a route, it's created if the route was never used.
+ */
+func (reverseProxy *ReverseProxy) getState(route *ProxyRoute) *proxyRouteState {
+	reverseProxy.Lock()
+	defer reverseProxy.Unlock()
+
+	if state, ok := reverseProxy.states[route]; ok {
+		return state
+	}
+
+	state := &proxyRouteState{route: route, upstreams: make([]*proxyUpstream, 0)}
+	for _, upstream := range route.Upstreams {
+		target, err := url.Parse(upstream)
+		if err != nil || len(target.Host) == 0 {
+			log.Println("invalid upstream ", upstream, " for route ", route.Host+route.PathPrefix)
+			continue
+		}
+		state.upstreams = append(state.upstreams, newProxyUpstream(route, target))
+	}
+
+	reverseProxy.states[route] = state
+	return state
+}
+
+/**
+ * Return the next healthy upstream of a route, nil if none is healthy.
+ */
+func (reverseProxy *ReverseProxy) nextUpstream(route *ProxyRoute) *proxyUpstream {
+	state := reverseProxy.getState(route)
+
+	reverseProxy.Lock()
+	defer reverseProxy.Unlock()
+
+	for i := 0; i < len(state.upstreams); i++ {
+		upstream := state.upstreams[(state.next+i)%len(state.upstreams)]
+		if upstream.isHealthy() {
+			state.next = (state.next + i + 1) % len(state.upstreams)
+			return upstream
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Send a request to an upstream of a route. The access to the request path is
+ * validated the same way as the files of the file server.
+ */
+func (globule *Globule) serveProxyRoute(w http.ResponseWriter, r *http.Request, route *ProxyRoute) {
+	permission := "read"
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+		permission = "write"
+	}
+
+	if !route.Public {
+		if _, _, hasAccess := globule.validateFileAccess(r, r.Header.Get("application"), "/file.FileService/ServeFileHandler", permission, path.Clean(r.URL.Path)); !hasAccess {
+			http.Error(w, "unable to access the resource. Check your access privilege", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	upstream := globule.reverseProxy.nextUpstream(route)
+	if upstream == nil {
+		http.Error(w, "no upstream server is available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Websocket upgrade are handled by the reverse proxy.
+	upstream.proxy.ServeHTTP(w, r)
+}
+
+/**
+ * Test if an upstream is reachable. A get is made to the health check path
+ * if there is one, otherwise a tcp connection is made.
+ */
+func (upstream *proxyUpstream) check(route *ProxyRoute) bool {
+	if len(route.HealthCheckPath) == 0 {
+		host := upstream.target.Host
+		if len(upstream.target.Port()) == 0 {
+			if upstream.target.Scheme == "https" || upstream.target.Scheme == "wss" {
+				host = net.JoinHostPort(upstream.target.Hostname(), "443")
+			} else {
+				host = net.JoinHostPort(upstream.target.Hostname(), "80")
+			}
+		}
+
+		conn, err := net.DialTimeout("tcp", host, 5*time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	health := *upstream.target
+	health.Path = strings.TrimSuffix(health.Path, "/") + "/" + strings.TrimPrefix(route.HealthCheckPath, "/")
+	health.RawQuery = ""
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	rsp, err := client.Get(health.String())
+	if err != nil {
+		return false
+	}
+	rsp.Body.Close()
+
+	return rsp.StatusCode < http.StatusInternalServerError
+}
+
+/**
+ * Test the upstreams of the routes whose health check interval is elapsed.
+ */
+func (globule *Globule) checkProxyUpstreams() {
+	// Remove the state of the routes removed from the configuration.
+	globule.reverseProxy.Lock()
+	for route := range globule.reverseProxy.states {
+		found := false
+		for _, route_ := range globule.ProxyRoutes {
+			found = found || route == route_
+		}
+		if !found {
+			delete(globule.reverseProxy.states, route)
+		}
+	}
+	globule.reverseProxy.Unlock()
+
+	for _, route := range globule.ProxyRoutes {
+		interval := route.HealthCheckInterval
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+
+		state := globule.reverseProxy.getState(route)
+		for _, upstream := range state.upstreams {
+			if time.Since(upstream.lastCheck) < time.Duration(interval)*time.Second {
+				continue
+			}
+			upstream.lastCheck = time.Now()
+
+			healthy := upstream.check(route)
+			if healthy != upstream.isHealthy() {
+				if healthy {
+					log.Println("upstream ", upstream.target.String(), " is back")
+				} else {
+					log.Println("upstream ", upstream.target.String(), " is unreachable")
+				}
+			}
+			upstream.setHealthy(healthy)
+		}
+	}
+}
+
+/**
+ * Start the health checks of the proxy routes upstreams.
+ */
+func (globule *Globule) startProxyHealthChecks() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for {
+			select {
+			case <-ticker.C:
+				globule.checkProxyUpstreams()
+			case <-globule.exit:
+				ticker.Stop()
+				return // exit from the loop when the service exit.
+			}
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * A javascript file with it '@...' imports rewritten as relative path.
+ */
+type rewrittenScript struct {
+	modTime time.Time // the modification time of the source file
+	size    int64     // the size of the source file
+	code    []byte    // nil if the file has no import to rewrite
+	etag    string
+}
+
+/**
+ * Keep the rewritten javascript files in memory, the key is the file path and
+ * the request path (the imports are relative to the request path). An entry
+ * is valid as long as the file modification time and size are the same.
+ */
+var scriptCache = struct {
+	sync.RWMutex
+	scripts map[string]*rewrittenScript
+}{scripts: make(map[string]*rewrittenScript)}
+
+/**
+ * Return the rewritten javascript file, the file is rewritten only if it
+ * change since the last call.
+ */
+func getRewrittenScript(f *os.File, name string, rqst_path string) (*rewrittenScript, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	key := name + ":" + rqst_path
+	scriptCache.RLock()
+	script, ok := scriptCache.scripts[key]
+	scriptCache.RUnlock()
+
+	if ok && script.modTime.Equal(info.ModTime()) && script.size == info.Size() {
+		return script, nil
+	}
+
+	script = &rewrittenScript{modTime: info.ModTime(), size: info.Size()}
+
+	var code string
+	hasChange := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "import") {
+			if strings.Contains(line, `'@`) {
+				path_, err := resolveImportPath(rqst_path, line)
+				if err == nil {
+					line = line[0:strings.Index(line, `'@`)] + `'` + path_ + `'`
+					hasChange = true
+				}
+			}
+		}
+		code += line + "\n"
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Rewind the file so it can be served as is.
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	if hasChange {
+		script.code = []byte(code)
+		hash := sha1.Sum(script.code)
+		script.etag = `"` + hex.EncodeToString(hash[:]) + `"`
+	}
+
+	scriptCache.Lock()
+	scriptCache.scripts[key] = script
+	scriptCache.Unlock()
+
+	return script, nil
+}
+
+/**
+ * Remove the rewritten versions of a javascript file from the cache.
+ */
+func invalidateRewrittenScript(name string) {
+	scriptCache.Lock()
+	defer scriptCache.Unlock()
+	for key := range scriptCache.scripts {
+		if strings.HasPrefix(key, name+":") {
+			delete(scriptCache.scripts, key)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * The storage limit of an account, an application or an organization. The
+ * usage of an organization is the sum of the usage of its accounts and
+ * applications.
+ */
+type StorageQuota struct {
+	Subject      string   // The name of the account, application or organization.
+	SubjectType  string   // account, application or organization.
+	Limit        int64    // The maximum size in bytes, 0 for no limit.
+	Accounts     []string // The accounts of an organization.
+	Applications []string // The applications of an organization.
+}
+
+/**
+ * The storage used by a subject.
+ */
+type StorageUsage struct {
+	Subject     string
+	SubjectType string
+	Used        int64
+	Limit       int64 // 0 if there is no limit.
+}
+
+/**
+ * The storage used by the accounts and applications, the key is the
+ * directory of the subject (ex. users/bob).
+ */
+var storageUsage = struct {
+	sync.Mutex
+	used     map[string]int64
+	reserved map[string]int64  // The storage reserved by the uploads in progress.
+	changes  map[string]uint64 // The number of updates of each usage since the start.
+}{used: make(map[string]int64), reserved: make(map[string]int64), changes: make(map[string]uint64)}
+
+// The scans of the storage of a subject waiting for the files changes to end.
+var storageUsageScans = struct {
+	sync.Mutex
+	timers map[string]*time.Timer
+}{timers: make(map[string]*time.Timer)}
+
+// The quotas are replaced and never changed in place, a reader can keep the
+// slice it get after the lock is released.
+var storageQuotasLock sync.RWMutex
+
+/**
+ * Return the storage quotas set on the accounts, applications and
+ * organizations.
+ */
+func (globule *Globule) getAllStorageQuotas() []*StorageQuota {
+	storageQuotasLock.RLock()
+	defer storageQuotasLock.RUnlock()
+	return globule.StorageQuotas
+}
+
+/**
+ * Return the file where the storage usage is saved.
+ */
+func (globule *Globule) getStorageUsagePath() string {
+	return globule.data + "/storage_usage.json"
+}
+
+/**
+ * Return the directory of the subject that own a path (ex. users/bob), the
+ * path is relative to the files directory. An empty string is return if the
+ * path belong to no account or application.
+ */
+func getStorageOwner(path_ string) string {
+	values := strings.Split(strings.Trim(cleanUploadPath(path_), "/"), "/")
+	if len(values) < 2 || (values[0] != "users" && values[0] != "applications") {
+		return ""
+	}
+
+	return values[0] + "/" + values[1]
+}
+
+/**
+ * Return the directory of the subject of a quota.
+ */
+func (quota *StorageQuota) getOwner() string {
+	if quota.SubjectType == "application" {
+		return "applications/" + quota.Subject
+	}
+
+	return "users/" + quota.Subject
+}
+
+/**
+ * Return the directories of the subjects counted by a quota.
+ */
+func (quota *StorageQuota) getOwners() []string {
+	if quota.SubjectType != "organization" {
+		return []string{quota.getOwner()}
+	}
+
+	owners := make([]string, 0, len(quota.Accounts)+len(quota.Applications))
+	for _, account := range quota.Accounts {
+		owners = append(owners, "users/"+account)
+	}
+	for _, application := range quota.Applications {
+		owners = append(owners, "applications/"+application)
+	}
+
+	return owners
+}
+
+/**
+ * Return the quotas that apply to the subject that own a path, the default
+ * account or application quota is used if the subject has none.
+ */
+func (globule *Globule) getStorageQuotas(owner string) []*StorageQuota {
+	quotas := make([]*StorageQuota, 0)
+	hasQuota := false
+	for _, quota := range globule.getAllStorageQuotas() {
+		for _, owner_ := range quota.getOwners() {
+			if owner_ == owner {
+				quotas = append(quotas, quota)
+				hasQuota = hasQuota || quota.SubjectType != "organization"
+			}
+		}
+	}
+
+	if !hasQuota {
+		values := strings.SplitN(owner, "/", 2)
+		if values[0] == "users" && globule.DefaultAccountQuota > 0 {
+			quotas = append(quotas, &StorageQuota{Subject: values[1], SubjectType: "account", Limit: globule.DefaultAccountQuota})
+		} else if values[0] == "applications" && globule.DefaultApplicationQuota > 0 {
+			quotas = append(quotas, &StorageQuota{Subject: values[1], SubjectType: "application", Limit: globule.DefaultApplicationQuota})
+		}
+	}
+
+	return quotas
+}
+
+/**
+ * Return the storage used and reserved by the subjects of a quota, the
+ * storage usage must be locked.
+ */
+func getQuotaUsage(quota *StorageQuota) int64 {
+	var used int64
+	for _, owner := range quota.getOwners() {
+		used += storageUsage.used[owner] + storageUsage.reserved[owner]
+	}
+
+	return used
+}
+
+/**
+ * Reserve the storage of a file of a given size that will be written at a
+ * path, an error is return if a quota would be exceeded. The size of the
+ * file replaced by the new one is not counted. The size reserved is return
+ * and must be released with releaseStorageQuota once the file is written.
+ */
+func (globule *Globule) reserveStorageQuota(path_ string, size int64) (int64, error) {
+	owner := getStorageOwner(path_)
+	if len(owner) == 0 {
+		return 0, nil
+	}
+
+	if name, err := getUploadFilePath(path_); err == nil {
+		if info, err := os.Stat(name); err == nil {
+			size -= info.Size()
+		}
+	}
+
+	if size <= 0 {
+		return 0, nil
+	}
+
+	quotas := globule.getStorageQuotas(owner)
+
+	// The check and the reservation must be done at once.
+	storageUsage.Lock()
+	defer storageUsage.Unlock()
+
+	for _, quota := range quotas {
+		if quota.Limit <= 0 {
+			continue
+		}
+
+		used := getQuotaUsage(quota)
+		if used+size > quota.Limit {
+			return 0, newUploadError(http.StatusInsufficientStorage, "the storage quota of the "+quota.SubjectType+" "+quota.Subject+" is exceeded, "+
+				strconv.FormatInt(used, 10)+" of "+strconv.FormatInt(quota.Limit, 10)+" bytes are used")
+		}
+	}
+
+	storageUsage.reserved[owner] += size
+
+	return size, nil
+}
+
+/**
+ * Release the storage reserved for a file.
+ */
+func releaseStorageQuota(path_ string, size int64) {
+	owner := getStorageOwner(path_)
+	if len(owner) == 0 || size <= 0 {
+		return
+	}
+
+	storageUsage.Lock()
+	storageUsage.reserved[owner] -= size
+	if storageUsage.reserved[owner] <= 0 {
+		delete(storageUsage.reserved, owner)
+	}
+	storageUsage.Unlock()
+}
+
+/**
+ * Add the size of a file to the storage used by the subject that own it, a
+ * negative size is removed.
+ */
+func (globule *Globule) updateStorageUsage(path_ string, size int64) {
+	owner := getStorageOwner(path_)
+	if len(owner) == 0 || size == 0 {
+		return
+	}
+
+	storageUsage.Lock()
+	storageUsage.used[owner] += size
+	if storageUsage.used[owner] < 0 {
+		storageUsage.used[owner] = 0
+	}
+	storageUsage.changes[owner]++
+	storageUsage.Unlock()
+
+	globule.saveStorageUsage()
+}
+
+/**
+ * Save the storage usage.
+ */
+func (globule *Globule) saveStorageUsage() error {
+	storageUsage.Lock()
+	data, err := json.Marshal(storageUsage.used)
+	storageUsage.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFileAtomic(globule.getStorageUsagePath(), bytes.NewReader(data), 0)
+	return err
+}
+
+/**
+ * Load the storage usage saved.
+ */
+func (globule *Globule) loadStorageUsage() error {
+	data, err := ioutil.ReadFile(globule.getStorageUsagePath())
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]int64)
+	err = json.Unmarshal(data, &used)
+	if err != nil {
+		return err
+	}
+
+	storageUsage.Lock()
+	storageUsage.used = used
+	storageUsage.Unlock()
+
+	return nil
+}
+
+/**
+ * Return the size of the files of a subject (ex. users/bob).
+ */
+func (globule *Globule) getOwnerStorageSize(owner string) int64 {
+	var size int64
+	filepath.Walk(globule.data+"/files/"+owner, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+/**
+ * Set the storage used by a subject to the size computed by a scan. The
+ * usage updated during the scan is kept as is, the scan can't tell if it
+ * counted the file updated or not. Return false if the usage is kept.
+ */
+func setScannedStorageUsage(owner string, size int64, changes uint64) bool {
+	storageUsage.Lock()
+	defer storageUsage.Unlock()
+
+	if storageUsage.changes[owner] != changes {
+		return false
+	}
+
+	if storageUsage.used[owner] != size {
+		log.Println("storage usage of", owner, "was", storageUsage.used[owner], "bytes and is", size, "bytes")
+	}
+
+	if size > 0 {
+		storageUsage.used[owner] = size
+	} else {
+		delete(storageUsage.used, owner)
+	}
+
+	return true
+}
+
+/**
+ * Return the number of updates of the usage of each subject, it's taken
+ * before a scan to find the usage updated during the scan.
+ */
+func getStorageUsageChanges() map[string]uint64 {
+	storageUsage.Lock()
+	defer storageUsage.Unlock()
+
+	changes := make(map[string]uint64, len(storageUsage.used))
+	for owner := range storageUsage.used {
+		changes[owner] = storageUsage.changes[owner]
+	}
+	for owner, count := range storageUsage.changes {
+		changes[owner] = count
+	}
+
+	return changes
+}
+
+/**
+ * Set the storage usage computed by a scan of all files, the subjects with
+ * usage and without files are set to 0.
+ */
+func (globule *Globule) setScannedStorageUsages(used map[string]int64, changes map[string]uint64) error {
+	for owner := range changes {
+		if _, ok := used[owner]; !ok {
+			setScannedStorageUsage(owner, 0, changes[owner])
+		}
+	}
+
+	for owner, size := range used {
+		setScannedStorageUsage(owner, size, changes[owner])
+	}
+
+	return globule.saveStorageUsage()
+}
+
+/**
+ * Compute the storage used by each account and application from the files
+ * on the disk, the saved usage can drift if files are changed by other
+ * processes.
+ */
+func (globule *Globule) scanStorageUsage() error {
+	changes := getStorageUsageChanges()
+	used := make(map[string]int64)
+
+	root := filepath.ToSlash(globule.data + "/files")
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			if owner := getStorageOwner(strings.TrimPrefix(filepath.ToSlash(path), root)); len(owner) > 0 {
+				used[owner] += info.Size()
+			}
+		}
+		return nil
+	})
+
+	return globule.setScannedStorageUsages(used, changes)
+}
+
+/**
+ * Compute again the storage used by the subject that own a path once the
+ * files changes end, the size of the files deleted is not known after they
+ * are deleted.
+ */
+func (globule *Globule) scheduleStorageUsageScan(path_ string) {
+	owner := getStorageOwner(path_)
+	if len(owner) == 0 {
+		return
+	}
+
+	storageUsageScans.Lock()
+	defer storageUsageScans.Unlock()
+
+	if timer, ok := storageUsageScans.timers[owner]; ok {
+		timer.Reset(fileEventDelay)
+		return
+	}
+
+	var scan func()
+	scan = func() {
+		storageUsage.Lock()
+		changes := storageUsage.changes[owner]
+		storageUsage.Unlock()
+
+		if setScannedStorageUsage(owner, globule.getOwnerStorageSize(owner), changes) {
+			storageUsageScans.Lock()
+			delete(storageUsageScans.timers, owner)
+			storageUsageScans.Unlock()
+			globule.saveStorageUsage()
+			return
+		}
+
+		// Files are written during the scan, it's done again later.
+		storageUsageScans.Lock()
+		storageUsageScans.timers[owner].Reset(fileEventDelay)
+		storageUsageScans.Unlock()
+	}
+
+	storageUsageScans.timers[owner] = time.AfterFunc(fileEventDelay, scan)
+}
+
+/**
+ * Return the storage usage of all accounts, applications and organizations
+ * with a quota, or of a single subject (subject and type form values).
+ */
+func getStorageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	_, err := validateRequestToken(r, "/admin.AdminService/GetStorageUsage")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	subject := r.FormValue("subject")
+	subjectType := r.FormValue("type")
+
+	// The subject with usage and the one with a quota.
+	quotas := make(map[string]*StorageQuota)
+	storageUsage.Lock()
+	for owner := range storageUsage.used {
+		values := strings.SplitN(owner, "/", 2)
+		quota := &StorageQuota{Subject: values[1], SubjectType: "account"}
+		if values[0] == "applications" {
+			quota.SubjectType = "application"
+		}
+		quotas[quota.SubjectType+":"+quota.Subject] = quota
+	}
+	storageUsage.Unlock()
+
+	for _, quota := range globule.getAllStorageQuotas() {
+		quotas[quota.SubjectType+":"+quota.Subject] = quota
+	}
+
+	usages := make([]*StorageUsage, 0)
+	for _, quota := range quotas {
+		if (len(subject) > 0 && subject != quota.Subject) || (len(subjectType) > 0 && subjectType != quota.SubjectType) {
+			continue
+		}
+
+		storageUsage.Lock()
+		usage := &StorageUsage{Subject: quota.Subject, SubjectType: quota.SubjectType, Used: getQuotaUsage(quota), Limit: quota.Limit}
+		storageUsage.Unlock()
+		if quota.SubjectType != "organization" {
+			// The limit of the quota or the default limit.
+			for _, quota_ := range globule.getStorageQuotas(quota.getOwner()) {
+				if quota_.SubjectType == quota.SubjectType {
+					usage.Limit = quota_.Limit
+				}
+			}
+		}
+		usages = append(usages, usage)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usages)
+}
+
+/**
+ * Set the storage quota of an account, an application or an organization.
+ * The subject, type (account, application or organization) and limit (in
+ * bytes, 0 for no limit) are given as form values, the accounts and
+ * applications of an organization are comma separated lists.
+ */
+func setStorageQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "the quota must be set with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := validateRequestToken(r, "/admin.AdminService/SetStorageQuota")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	quota := &StorageQuota{Subject: r.FormValue("subject"), SubjectType: r.FormValue("type"), Accounts: make([]string, 0), Applications: make([]string, 0)}
+	if len(quota.Subject) == 0 || strings.ContainsAny(quota.Subject, `/\`) {
+		http.Error(w, "invalid subject "+quota.Subject, http.StatusBadRequest)
+		return
+	}
+
+	if quota.SubjectType != "account" && quota.SubjectType != "application" && quota.SubjectType != "organization" {
+		http.Error(w, "the type must be account, application or organization", http.StatusBadRequest)
+		return
+	}
+
+	quota.Limit, err = strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil || quota.Limit < 0 {
+		http.Error(w, "invalid limit "+r.FormValue("limit"), http.StatusBadRequest)
+		return
+	}
+
+	if quota.SubjectType == "organization" {
+		for _, account := range strings.Split(r.FormValue("accounts"), ",") {
+			if account = strings.TrimSpace(account); len(account) > 0 {
+				quota.Accounts = append(quota.Accounts, account)
+			}
+		}
+		for _, application := range strings.Split(r.FormValue("applications"), ",") {
+			if application = strings.TrimSpace(application); len(application) > 0 {
+				quota.Applications = append(quota.Applications, application)
+			}
+		}
+	}
+
+	storageQuotasLock.Lock()
+	quotas := make([]*StorageQuota, 0, len(globule.StorageQuotas)+1)
+	for _, quota_ := range globule.StorageQuotas {
+		if quota_.Subject != quota.Subject || quota_.SubjectType != quota.SubjectType {
+			quotas = append(quotas, quota_)
+		}
+	}
+	globule.StorageQuotas = append(quotas, quota)
+	storageQuotasLock.Unlock()
+
+	err = globule.saveConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("storage quota of the", quota.SubjectType, quota.Subject, "was set to", quota.Limit, "bytes by", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+ * Rebuild the storage usage from the files on the disk.
+ */
+func scanStorageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	setupResponse(&w, r)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "the scan must be started with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, err := validateRequestToken(r, "/admin.AdminService/ScanStorageUsage")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	err = globule.scanStorageUsage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
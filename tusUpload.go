@@ -0,0 +1,625 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davecourtois/Utility"
+	"github.com/globulario/services/golang/rbac/rbacpb"
+)
+
+// The tus protocol version supported.
+const tusVersion = "1.0.0"
+
+// The tus extensions supported.
+const tusExtensions = "creation,termination,checksum,expiration"
+
+// An upload that receive no data during that time is abandoned and removed.
+const tusUploadExpiration = 24 * time.Hour
+
+// The tus upload url, the upload id is append to it.
+const tusUploadPath = "/uploads/tus/"
+
+// The status return when the checksum of a chunk is not the one given.
+const tusChecksumMismatch = 460
+
+/**
+ * Return the hash function of a tus checksum algorithm.
+ */
+func getTusChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+
+	return nil
+}
+
+/**
+ * An upload in progress, the data received are kept in the uploads directory
+ * until the upload is completed, the file is then moved to its path.
+ */
+type TusUpload struct {
+	Id          string
+	Length      int64
+	Metadata    map[string]string
+	Path        string // The directory where to upload the file.
+	Filename    string
+	Owner       string // The subject that create the upload.
+	OwnerType   rbacpb.SubjectType
+	Application string
+	Created     time.Time
+	Reserved    int64 // The storage reserved for the upload.
+}
+
+// Only one request can write an upload at time.
+var tusUploadsLock = struct {
+	sync.Mutex
+	uploads map[string]*sync.Mutex
+}{uploads: make(map[string]*sync.Mutex)}
+
+func lockTusUpload(id string) func() {
+	tusUploadsLock.Lock()
+	lock, ok := tusUploadsLock.uploads[id]
+	if !ok {
+		lock = new(sync.Mutex)
+		tusUploadsLock.uploads[id] = lock
+	}
+	tusUploadsLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+/**
+ * Return the directory where the uploads in progress are kept.
+ */
+func (globule *Globule) getTusUploadsDir() string {
+	return globule.data + "/uploads"
+}
+
+/**
+ * Return the path of the data of an upload.
+ */
+func (globule *Globule) getTusUploadFile(id string) string {
+	return globule.getTusUploadsDir() + "/" + id
+}
+
+/**
+ * Read the information of an upload.
+ */
+func (globule *Globule) getTusUpload(id string) (*TusUpload, error) {
+	// The id is part of the url and must not be a path.
+	if len(id) == 0 || strings.ContainsAny(id, `/\.`) {
+		return nil, os.ErrNotExist
+	}
+
+	data, err := ioutil.ReadFile(globule.getTusUploadFile(id) + ".info")
+	if err != nil {
+		return nil, err
+	}
+
+	upload := new(TusUpload)
+	err = json.Unmarshal(data, upload)
+	if err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+/**
+ * Save the information of an upload.
+ */
+func (globule *Globule) saveTusUpload(upload *TusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(globule.getTusUploadFile(upload.Id)+".info", data, 0600)
+}
+
+/**
+ * Remove the data and the information of an upload, the storage reserved
+ * for it is released.
+ */
+func (globule *Globule) removeTusUpload(id string) {
+	if upload, err := globule.getTusUpload(id); err == nil {
+		releaseStorageQuota(path.Join(upload.Path, upload.Filename), upload.Reserved)
+	}
+
+	os.Remove(globule.getTusUploadFile(id))
+	os.Remove(globule.getTusUploadFile(id) + ".info")
+
+	tusUploadsLock.Lock()
+	delete(tusUploadsLock.uploads, id)
+	tusUploadsLock.Unlock()
+}
+
+/**
+ * Return the number of bytes received for an upload.
+ */
+func (globule *Globule) getTusUploadOffset(id string) (int64, error) {
+	info, err := os.Stat(globule.getTusUploadFile(id))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+/**
+ * Return the time, in the http date format, when an upload will be removed
+ * if it receive no more data.
+ */
+func (globule *Globule) getTusUploadExpires(id string) string {
+	modTime := time.Now()
+	if info, err := os.Stat(globule.getTusUploadFile(id)); err == nil {
+		modTime = info.ModTime()
+	}
+
+	return modTime.Add(tusUploadExpiration).UTC().Format(http.TimeFormat)
+}
+
+/**
+ * Remove the uploads that receive no data since the expiration delay.
+ */
+func (globule *Globule) removeExpiredTusUploads() {
+	files, err := ioutil.ReadDir(globule.getTusUploadsDir())
+	if err != nil {
+		return
+	}
+
+	for _, info := range files {
+		id := info.Name()
+		if info.IsDir() || strings.HasSuffix(id, ".info") || time.Since(info.ModTime()) < tusUploadExpiration {
+			continue
+		}
+
+		// Wait for the request that write the upload if there is one.
+		unlock := lockTusUpload(id)
+		info, err := os.Stat(globule.getTusUploadFile(id))
+		if err == nil && time.Since(info.ModTime()) >= tusUploadExpiration {
+			globule.removeTusUpload(id)
+		}
+		unlock()
+	}
+
+	// The information without data are left by an interrupted creation.
+	for _, info := range files {
+		id := strings.TrimSuffix(info.Name(), ".info")
+		if id != info.Name() && !Utility.Exists(globule.getTusUploadFile(id)) && time.Since(info.ModTime()) >= tusUploadExpiration {
+			os.Remove(globule.getTusUploadFile(id) + ".info")
+		}
+	}
+}
+
+/**
+ * Reserve again the storage of the uploads in progress.
+ */
+func (globule *Globule) loadTusUploads() {
+	files, err := ioutil.ReadDir(globule.getTusUploadsDir())
+	if err != nil {
+		return
+	}
+
+	for _, info := range files {
+		if !strings.HasSuffix(info.Name(), ".info") {
+			continue
+		}
+
+		upload, err := globule.getTusUpload(strings.TrimSuffix(info.Name(), ".info"))
+		if err == nil && upload.Reserved > 0 {
+			owner := getStorageOwner(path.Join(upload.Path, upload.Filename))
+			if len(owner) > 0 {
+				storageUsage.Lock()
+				storageUsage.reserved[owner] += upload.Reserved
+				storageUsage.Unlock()
+			}
+		}
+	}
+}
+
+/**
+ * Reserve the storage of the uploads in progress and remove the abandoned
+ * ones at start and then every hour.
+ */
+func (globule *Globule) startTusUploadsCleanup() {
+	globule.loadTusUploads()
+	globule.removeExpiredTusUploads()
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		for {
+			select {
+			case <-ticker.C:
+				globule.removeExpiredTusUploads()
+			case <-globule.exit:
+				ticker.Stop()
+				return // exit from the loop when the service exit.
+			}
+		}
+	}()
+}
+
+/**
+ * Parse the Upload-Metadata header, a list of key and base64 value separated
+ * by comma.
+ */
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+
+		values := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(values) == 2 {
+			data, err := base64.StdEncoding.DecodeString(values[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(data)
+		}
+		metadata[values[0]] = value
+	}
+
+	return metadata, nil
+}
+
+/**
+ * Format the metadata of an upload for the Upload-Metadata header.
+ */
+func formatTusMetadata(metadata map[string]string) string {
+	values := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		if len(value) == 0 {
+			values = append(values, key)
+		} else {
+			values = append(values, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+		}
+	}
+
+	return strings.Join(values, ",")
+}
+
+/**
+ * Resumable file upload with the tus protocol (https://tus.io/protocols/resumable-upload.html).
+ * The upload is created with a POST to /uploads/tus/, the metadata filename
+ * and path give the name and the directory of the file. The data are sent
+ * with PATCH requests to the url of the upload (the Location header).
+ */
+func tusUploadHandler(w http.ResponseWriter, r *http.Request) {
+
+	setupResponse(&w, r)
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Checksum-Algorithm, Upload-Length, Upload-Offset, Upload-Metadata")
+
+	// Set the security headers of the response.
+	globule.applyHeaderPolicies(w, r, "", "")
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(tusUploadPath, "/")), "/")
+
+	if r.Method == http.MethodPost && len(id) == 0 {
+		createTusUpload(w, r)
+		return
+	}
+
+	upload, err := globule.getTusUpload(id)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	// The requester must be the one that create the upload and must still
+	// have the right to write in the directory.
+	subject, subjectType, hasAccess := globule.validateFileAccess(r, r.Header.Get("application"), "/file.FileService/FileUploadHandler", "write", upload.Path)
+	if !hasAccess || subject != upload.Owner || subjectType != upload.OwnerType {
+		http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
+		return
+	}
+
+	unlock := lockTusUpload(id)
+	defer unlock()
+
+	switch r.Method {
+	case http.MethodHead:
+		offset, err := globule.getTusUploadOffset(id)
+		if err != nil {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Expires", globule.getTusUploadExpires(id))
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if len(upload.Metadata) > 0 {
+			w.Header().Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		writeTusUpload(w, r, upload)
+
+	case http.MethodDelete:
+		globule.removeTusUpload(id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/**
+ * Create a new upload (tus creation extension).
+ */
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "the Upload-Length header is missing or invalid", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "the Upload-Metadata header is invalid", http.StatusBadRequest)
+		return
+	}
+
+	filename := metadata["filename"]
+	if len(filename) == 0 {
+		filename = metadata["name"]
+	}
+
+	filename, err = cleanUploadFilename(filename)
+	if err == nil {
+		err = globule.validateUpload(filename, length)
+	}
+
+	dir := cleanUploadPath(metadata["path"])
+	if err == nil {
+		_, err = getUploadFilePath(path.Join(dir, filename))
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), getUploadErrorStatus(err))
+		return
+	}
+
+	application := r.Header.Get("application")
+
+	owner, ownerType, hasAccess := globule.validateFileAccess(r, application, "/file.FileService/FileUploadHandler", "write", dir)
+	if !hasAccess {
+		http.Error(w, "unable to create the file for writing. Check your access privilege", http.StatusUnauthorized)
+		return
+	}
+
+	// The storage is reserved until the upload is completed or removed.
+	reserved, err := globule.reserveStorageQuota(path.Join(dir, filename), length)
+	if err != nil {
+		http.Error(w, err.Error(), getUploadErrorStatus(err))
+		return
+	}
+
+	err = Utility.CreateDirIfNotExist(globule.getTusUploadsDir())
+	if err != nil {
+		releaseStorageQuota(path.Join(dir, filename), reserved)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload := &TusUpload{
+		Id:          strings.ReplaceAll(Utility.RandomUUID(), "-", ""),
+		Length:      length,
+		Metadata:    metadata,
+		Path:        dir,
+		Filename:    filename,
+		Owner:       owner,
+		OwnerType:   ownerType,
+		Application: application,
+		Created:     time.Now(),
+		Reserved:    reserved,
+	}
+
+	f, err := os.Create(globule.getTusUploadFile(upload.Id))
+	if err != nil {
+		releaseStorageQuota(path.Join(dir, filename), reserved)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+
+	err = globule.saveTusUpload(upload)
+	if err != nil {
+		releaseStorageQuota(path.Join(dir, filename), reserved)
+		globule.removeTusUpload(upload.Id)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// An empty file is completed at creation.
+	if length == 0 {
+		err = globule.completeTusUpload(upload)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", tusUploadPath+upload.Id)
+	if length > 0 {
+		w.Header().Set("Upload-Expires", globule.getTusUploadExpires(upload.Id))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+/**
+ * Append the body of a PATCH request to an upload. If a checksum is given
+ * the data are kept only if the checksum match.
+ */
+func writeTusUpload(w http.ResponseWriter, r *http.Request, upload *TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "the Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "the Upload-Offset header is missing or invalid", http.StatusBadRequest)
+		return
+	}
+
+	current, err := globule.getTusUploadOffset(upload.Id)
+	if err != nil {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+
+	if offset != current {
+		http.Error(w, "the Upload-Offset does not match the upload offset", http.StatusConflict)
+		return
+	}
+
+	var checksum hash.Hash
+	var expected []byte
+	if values := strings.SplitN(r.Header.Get("Upload-Checksum"), " ", 2); len(values[0]) > 0 {
+		checksum = getTusChecksumHash(values[0])
+		if checksum == nil || len(values) != 2 {
+			http.Error(w, "unsupported checksum algorithm", http.StatusBadRequest)
+			return
+		}
+
+		expected, err = base64.StdEncoding.DecodeString(values[1])
+		if err != nil {
+			http.Error(w, "the Upload-Checksum header is invalid", http.StatusBadRequest)
+			return
+		}
+	}
+
+	f, err := os.OpenFile(globule.getTusUploadFile(upload.Id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var writer io.Writer = f
+	if checksum != nil {
+		writer = io.MultiWriter(f, checksum)
+	}
+
+	// Never write more than the upload length.
+	n, err := io.Copy(writer, io.LimitReader(r.Body, upload.Length-offset))
+
+	// A chunk with a checksum is kept only if it's complete and valid, a
+	// chunk without is kept to the last byte received.
+	if checksum != nil && (err != nil || string(checksum.Sum(nil)) != string(expected)) {
+		f.Truncate(offset)
+		f.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			http.Error(w, "checksum mismatch", tusChecksumMismatch)
+		}
+		return
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	offset += n
+	if offset == upload.Length {
+		err = globule.completeTusUpload(upload)
+		if err != nil {
+			http.Error(w, err.Error(), getUploadErrorStatus(err))
+			return
+		}
+	}
+
+	if offset < upload.Length {
+		w.Header().Set("Upload-Expires", globule.getTusUploadExpires(upload.Id))
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/**
+ * Move a completed upload to its path, set it owner and process it the same
+ * way as the files uploaded with FileUploadHandler.
+ */
+func (globule *Globule) completeTusUpload(upload *TusUpload) error {
+	path_, err := getUploadFilePath(path.Join(upload.Path, upload.Filename))
+	if err != nil {
+		return err
+	}
+
+	// The size of the file replaced.
+	var previousSize int64
+	if info, err := os.Stat(path_); err == nil {
+		previousSize = info.Size()
+	}
+
+	err = Utility.CreateDirIfNotExist(filepath.Dir(path_))
+	if err != nil {
+		return err
+	}
+
+	err = moveFileAtomic(globule.getTusUploadFile(upload.Id), path_)
+	if err != nil {
+		return err
+	}
+
+	// The file is counted before the storage reserved is released.
+	globule.updateStorageUsage(path.Join(upload.Path, upload.Filename), upload.Length-previousSize)
+	globule.removeTusUpload(upload.Id)
+
+	// Here I will set the ressource owner.
+	if len(upload.Owner) > 0 {
+		globule.addResourceOwner(path.Join(upload.Path, upload.Filename), upload.Owner, upload.OwnerType)
+	}
+
+	processUploadedFile(path_)
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/davecourtois/Utility"
+)
+
+/**
+ * The result of the upload of a file.
+ */
+type UploadResult struct {
+	Name   string // The name of the file.
+	Path   string // The path of the file on the server.
+	Size   int64
+	Status int // The http status of the file upload.
+	Error  string
+}
+
+/**
+ * An error with the http status to return.
+ */
+type uploadError struct {
+	status int
+	err    error
+}
+
+func (err *uploadError) Error() string {
+	return err.err.Error()
+}
+
+func newUploadError(status int, msg string) error {
+	return &uploadError{status: status, err: errors.New(msg)}
+}
+
+/**
+ * Return the http status of an upload error.
+ */
+func getUploadErrorStatus(err error) int {
+	if err_, ok := err.(*uploadError); ok {
+		return err_.status
+	}
+
+	return http.StatusInternalServerError
+}
+
+/**
+ * Return the canonical form of an upload path, the path is always absolute
+ * and can't contain '..'.
+ */
+func cleanUploadPath(path_ string) string {
+	return path.Clean("/" + strings.ReplaceAll(path_, "\\", "/"))
+}
+
+/**
+ * Return true if a path is the directory or a sub directory of another.
+ */
+func isSubPath(dir string, path_ string) bool {
+	return path_ == dir || strings.HasPrefix(path_, dir+"/")
+}
+
+/**
+ * Return true if a file is in the web root, the web root files can be read by
+ * anyone. The other files are in the data directory and their access is
+ * validated.
+ */
+func isPublicFile(path_ string) bool {
+	for _, dir := range []string{"/users", "/applications", "/templates", "/projects"} {
+		if isSubPath(dir, path_) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * Return the root directory of an upload path, the files of the users and
+ * applications are kept in the data directory, the others in the web root.
+ */
+func getUploadRoot(path_ string) string {
+	if isSubPath("/users", path_) || isSubPath("/applications", path_) {
+		return globule.data + "/files"
+	}
+
+	return globule.webRoot
+}
+
+/**
+ * Return the path on the disk of an uploaded file. An error is return if the
+ * path is outside of its root directory, symbolic links included.
+ */
+func getUploadFilePath(path_ string) (string, error) {
+	path_ = cleanUploadPath(path_)
+	root, err := filepath.Abs(getUploadRoot(path_))
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Join(root, filepath.FromSlash(path_))
+	rel, err := filepath.Rel(root, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", newUploadError(http.StatusBadRequest, "the path "+path_+" is outside of the server directories")
+	}
+
+	// The nearest existing directory must also be in the root once the
+	// symbolic links are resolved.
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err == nil {
+		existing := name
+		for !Utility.Exists(existing) && existing != root {
+			existing = filepath.Dir(existing)
+		}
+
+		realPath, err := filepath.EvalSymlinks(existing)
+		if err != nil {
+			return "", err
+		}
+
+		rel, err = filepath.Rel(realRoot, realPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", newUploadError(http.StatusBadRequest, "the path "+path_+" is outside of the server directories")
+		}
+	}
+
+	return filepath.ToSlash(name), nil
+}
+
+/**
+ * Return the name of an uploaded file without any directory, an error is
+ * return if the name is not valid.
+ */
+func cleanUploadFilename(filename string) (string, error) {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if filename == "." || filename == "/" || filename == ".." || strings.ContainsRune(filename, 0) {
+		return "", newUploadError(http.StatusBadRequest, "invalid file name")
+	}
+
+	return filename, nil
+}
+
+/**
+ * Validate the size and the extension of a file before it's uploaded, a
+ * negative size mean the size is unknown.
+ */
+func (globule *Globule) validateUpload(filename string, size int64) error {
+	if globule.MaxUploadSize > 0 && size > globule.MaxUploadSize {
+		return newUploadError(http.StatusRequestEntityTooLarge, "the file "+filename+" is bigger than the maximum upload size")
+	}
+
+	extension := strings.ToLower(filepath.Ext(filename))
+	for _, denied := range globule.DeniedUploadExtensions {
+		if strings.ToLower(denied) == extension {
+			return newUploadError(http.StatusUnsupportedMediaType, "the files "+extension+" can not be uploaded")
+		}
+	}
+
+	if len(globule.AllowedUploadExtensions) == 0 {
+		return nil
+	}
+
+	for _, allowed := range globule.AllowedUploadExtensions {
+		if strings.ToLower(allowed) == extension {
+			return nil
+		}
+	}
+
+	return newUploadError(http.StatusUnsupportedMediaType, "the files "+extension+" can not be uploaded")
+}
+
+/**
+ * Write a file atomically, the content is written in a temporary file of the
+ * same directory then renamed, so a file is never partially written.
+ */
+func writeFileAtomic(name string, src io.Reader, maxSize int64) (int64, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+
+	reader := src
+	if maxSize > 0 {
+		// Read one more byte to know if the file is too big.
+		reader = io.LimitReader(src, maxSize+1)
+	}
+
+	size, err := io.Copy(tmp, reader)
+	if err == nil && maxSize > 0 && size > maxSize {
+		err = newUploadError(http.StatusRequestEntityTooLarge, "the file "+filepath.Base(name)+" is bigger than the maximum upload size")
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+
+	return size, nil
+}
+
+/**
+ * Move a file atomically, the file is copied if it's on another device.
+ */
+func moveFileAtomic(source string, dest string) error {
+	if err := os.Rename(source, dest); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFileAtomic(dest, src, 0)
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(source)
+}